@@ -3,17 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	gcfg "gopkg.in/gcfg.v1"
 
+	"github.com/ndlib/disadis/download"
 	"github.com/ndlib/disadis/fedora"
 )
 
@@ -85,17 +89,184 @@ type config struct {
 		Log_filename string
 		Fedora_addr  string
 		Bendo_token  string
+
+		Fedora_replica        []string // read replicas, used when fedora-addr is down
+		Fedora_check_interval string
+		Fedora_info_cache     int      // datastream infos to revalidate with conditional requests
+		Fedora_route          []string // "namespace url" for objects kept elsewhere
+
+		Vault_addr       string
+		Vault_token_file string
+		Secret_refresh   string // how often to read the secrets again
+
+		Selftest bool // run the self test when starting
+
+		Location_cache      string // file to remember external content locations in
+		Location_cache_size int
+
+		Event_dir       string // directory to record download events in
+		Event_retention string // how long to keep download events
+
+		Clamd       string // address of clamd, to scan external content
+		Scan_ttl    string // how long to remember scan verdicts
+		Scan_notify string // URL to POST detections to
+
+		Restore_interval string // how often to check on content being staged
+		Restore_timeout  string
+		Restore_notify   string // URL to POST finished restores to
+
+		Tls_cert_file string
+		Tls_key_file  string
+		H2c           bool
+
+		Dav_port   string
+		Dav_prefix string
+		Dav_root   []string
+
+		Client_concurrent int // requests in progress at once from each client
+
+		Rate_limit    int // requests a minute from each client
+		Rate_burst    int
+		Rate_allow    []string
+		Trusted_proxy []string
+		User_header   string // set by the front end to the authenticated user
+		Group_header  string // set by the front end to the user's groups
+
+		Read_header_timeout string
+		Read_timeout        string
+		Idle_timeout        string
+		Write_idle_timeout  string
+
+		Watch_config string // how often to check the config file for changes
 	}
 	Handler map[string]*struct {
 		Port          string
 		Prefix        string
 		Datastream    string
 		Datastream_id []string
+
+		Fedora_addr      string // overrides the general section
+		Fedora_namespace string
+		Source           []string // "name key=value ...", tried before stores and fedora
+
+		Cache_size       int64
+		Cache_max_item   int64
+		Disk_cache_dir   string
+		Disk_cache_size  int64
+		Coalesce_timeout string
+		Compress_type    []string
+		Attachment_type  []string
+		Disposition      string
+		Plain_type       []string
+		Not_found_ttl    string
+		Receipt_ttl      string
+		Zip_keep_alive   string
+		Zip_prefetch     int
+		Zip_store_type   []string
+		Zip_level        int
+		Zip_manifest     string
+		Zip_strict       bool
+		Zip_datastream   []string
+		Method           []string
+		Error_page       []string
+		Contact          string
+		Canonical        bool
+		Lowercase_id     bool
+		Multi_range      string
+		Redirect         string
+		Preview          []string
+		Accel_prefix     string
+		Admin_user       []string
+		Admin_group      []string
+		Auth             string // "hydra" to check each object's rights, or "bearer"
+		Auth_datastream  string
+		Embargo_timezone string
+		Identity         []string // "bearer" or "header", in order
+		Auth_policy      bool
+		Auth_inherit_ttl string
+
+		Auth_collection_depth     int
+		Auth_collection_predicate string
+
+		Label         []string
+		Primary_type  []string
+		Signpost      []string
+		Media         bool
+		Media_page    int64
+		Cache_control string
+		Checksum_etag bool
+		Verify        string
+
+		Bearer_token            []string // "user token"
+		Bearer_introspect       string
+		Bearer_introspect_token string
+		Bearer_query            bool
+		Bearer_ttl              string
+
+		Identifier_table  string
+		Identifier_search bool
+
+		Alternate          []string
+		Quality            []string
+		Quality_datastream string
+		Greedy_id          bool
+
+		Extra_prefix   []string
+		Prefix_segment bool
+
+		Cors_origin      []string
+		Cors_method      []string
+		Cors_expose      []string
+		Cors_credentials bool
+		Cors_max_age     string
+
+		Id_pattern  string
+		Id_template string
+
+		Max_concurrent int
+		Queue_length   int
+		Queue_wait     string
+
+		Thumbnail_size    []int
+		Thumbnail_command []string
+
+		Stamp_command string // to stamp PDFs for licensed collections
+		Stamp_text    string
+
+		Dav   bool
+		Probe string // identifier to request in the self test
+	}
+	Backend map[string]*struct {
+		Cert_file string
+		Key_file  string
+		Ca_file   string
+		Proxy     string
+
+		Server_name          string
+		Insecure_skip_verify bool
+
+		Retries           int
+		Retry_backoff     string
+		Breaker_threshold int
+		Breaker_cooldown  string
+
+		Tiered bool // content may be on tape, and a 503 means it is being staged
+	}
+	Store map[string]*struct {
+		Prefix     string
+		Auth       string
+		Header     string
+		Token      string
+		Access_key string
+		Secret_key string
+		Region     string
+		Service    string
 	}
 }
 
 var (
-	pidfilename string
+	pidfilename  string
+	selftestOnly bool // run the self test and exit
 )
 
 func main() {
@@ -115,6 +286,7 @@ func main() {
 		"name of config file to use")
 	flag.StringVar(&pidfilename, "pid", "", "file to store pid of server")
 	flag.BoolVar(&showVersion, "version", false, "Display the version and exit")
+	flag.BoolVar(&selftestOnly, "selftest", false, "Request the probe of each handler, report the results, and exit")
 
 	flag.Parse()
 
@@ -131,7 +303,6 @@ func main() {
 			log.Println(err)
 		}
 		logfilename = config.General.Log_filename
-		fedoraAddr = config.General.Fedora_addr
 	}
 
 	/* first set up the log file */
@@ -145,12 +316,37 @@ func main() {
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go signalHandler(sig, logw)
 
+	if configFile != "" {
+		// secrets may be kept outside the config file
+		err := resolveSecrets(&config)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fedoraAddr = config.General.Fedora_addr
+	}
+
 	/* Now set up the handler chains */
 	if fedoraAddr == "" {
 		log.Printf("Error: Fedora address must be set. (--fedora <server addr>)")
 		os.Exit(1)
 	}
-	fedora := fedora.NewRemote(fedoraAddr, "")
+	fedoraClient, err := backendClient(config, "fedora")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	fedora := newFedora(config, fedoraAddr, "", fedoraClient)
+	if len(config.General.Fedora_replica) > 0 {
+		fedora = makeFailover(fedora, config, fedoraClient)
+	}
+	if len(config.General.Fedora_route) > 0 {
+		fedora, err = makeRouter(fedora, config, fedoraClient)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
 	if config.General.Bendo_token != "" {
 		log.Println("Bendo token supplied")
 	}
@@ -163,53 +359,819 @@ func main() {
 		writePID(pidfilename)
 	}
 
-	runHandlers(config, fedora)
+	stores, err := makeStores(config)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	runHandlers(config, configFile, fedora, stores)
 
 	if pidfilename != "" {
 		os.Remove(pidfilename)
 	}
 }
 
+// makeFailover returns a Fedora which uses the replicas listed in the
+// config file when the primary is down.
+func makeFailover(primary fedora.Fedora, config config, client *http.Client) fedora.Fedora {
+	names := []string{"primary"}
+	repos := []fedora.Fedora{primary}
+	for i, addr := range config.General.Fedora_replica {
+		names = append(names, fmt.Sprintf("replica %d", i+1))
+		repos = append(repos, newFedora(config, addr, "", client))
+	}
+	interval, err := parseDuration(config.General.Fedora_check_interval, 10*time.Second)
+	if err != nil {
+		log.Printf("fedora-check-interval: %s", err)
+		os.Exit(1)
+	}
+	f := fedora.NewFailover(names, repos)
+	go f.Monitor(interval)
+	log.Printf("Fedora failover to %d replicas", len(config.General.Fedora_replica))
+	return f
+}
+
+// makeRouter returns a Fedora which sends requests for objects in the
+// namespaces listed in the config file to other repositories.
+func makeRouter(def fedora.Fedora, config config, client *http.Client) (fedora.Fedora, error) {
+	rt := &fedora.Router{
+		Default: def,
+		Routes:  make(map[string]fedora.Fedora),
+	}
+	for _, route := range config.General.Fedora_route {
+		fields := strings.Fields(route)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("fedora-route %q: expected namespace and url", route)
+		}
+		namespace := strings.TrimSuffix(fields[0], ":")
+		rt.Routes[namespace] = newFedora(config, fields[1], "", client)
+		log.Printf("Fedora route for namespace %s", namespace)
+	}
+	return rt, nil
+}
+
+// backendClient returns an http client using the connection settings in the
+// config file for the given backend. The default client is returned if the
+// backend has no settings.
+func backendClient(config config, name string) (*http.Client, error) {
+	v, ok := config.Backend[name]
+	if !ok {
+		return http.DefaultClient, nil
+	}
+	log.Printf("Backend %s (cert %s, ca %s, proxy %s, server name %s)", name, v.Cert_file, v.Ca_file, v.Proxy, v.Server_name)
+	if v.Insecure_skip_verify {
+		log.Printf("WARNING: Backend %s does not verify TLS certificates. Do not use this in production.", name)
+	}
+	client, err := NewBackendClient(BackendConfig{
+		CertFile:           v.Cert_file,
+		KeyFile:            v.Key_file,
+		CAFile:             v.Ca_file,
+		Proxy:              v.Proxy,
+		ServerName:         v.Server_name,
+		InsecureSkipVerify: v.Insecure_skip_verify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Backend %s: %s", name, err)
+	}
+	return client, nil
+}
+
+// storeBackend returns an ExternalStore having the connection, retry, and
+// circuit breaker settings in the config file for the given backend.
+func storeBackend(config config, name string) (download.ExternalStore, error) {
+	var store download.ExternalStore
+	client, err := backendClient(config, name)
+	if err != nil {
+		return store, err
+	}
+	store.Client = client
+	v, ok := config.Backend[name]
+	if !ok {
+		return store, nil
+	}
+	store.Retries = v.Retries
+	store.Tiered = v.Tiered
+	store.Backoff, err = parseDuration(v.Retry_backoff, time.Second)
+	if err != nil {
+		return store, fmt.Errorf("Backend %s: retry-backoff: %s", name, err)
+	}
+	if v.Breaker_threshold > 0 {
+		cooldown, err := parseDuration(v.Breaker_cooldown, 30*time.Second)
+		if err != nil {
+			return store, fmt.Errorf("Backend %s: breaker-cooldown: %s", name, err)
+		}
+		store.Breaker = &download.CircuitBreaker{
+			Threshold: v.Breaker_threshold,
+			Cooldown:  cooldown,
+		}
+	}
+	return store, nil
+}
+
+// parseDuration parses a duration from the config file, returning def if
+// the value is empty.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// makeStores returns the external content stores listed in the config file.
+// A store uses the backend settings having the same name as the store, if
+// there are any, and the "bendo" backend settings otherwise. If a bendo
+// token is given, a store matching every URL is added which uses it.
+func makeStores(config config) ([]download.ExternalStore, error) {
+	var stores []download.ExternalStore
+	bendo, err := storeBackend(config, "bendo")
+	if err != nil {
+		return nil, err
+	}
+	if config.General.Bendo_token != "" {
+		store := bendo
+		store.Credential = download.APIKey{Header: "X-Api-Key", Token: config.General.Bendo_token}
+		stores = append(stores, store)
+	}
+	for k, v := range config.Store {
+		store := bendo
+		if _, ok := config.Backend[k]; ok {
+			store, err = storeBackend(config, k)
+			if err != nil {
+				return nil, err
+			}
+		}
+		store.Prefix = v.Prefix
+		store.Credential, err = download.NewCredential(v.Auth,
+			v.Header,
+			v.Token,
+			v.Access_key,
+			v.Secret_key,
+			v.Region,
+			v.Service)
+		if err != nil {
+			return nil, fmt.Errorf("Store %s: %s", k, err)
+		}
+		log.Printf("Store %s (prefix %s, auth %s)", k, v.Prefix, v.Auth)
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
 // runHandlers starts a listener for each port in its own goroutine
 // and then waits for all of them to quit.
-func runHandlers(config config, fedora fedora.Fedora) {
+func runHandlers(config config, configFile string, fedora fedora.Fedora, stores []download.ExternalStore) {
 	var wg sync.WaitGroup
-	portHandlers := make(map[string]*DsidMux)
-	// first create the handlers
+	var limiter *download.RateLimiter
+	if config.General.Rate_limit > 0 {
+		limiter = download.NewRateLimiter(float64(config.General.Rate_limit)/60, config.General.Rate_burst)
+		if limiter.Burst <= 0 {
+			limiter.Burst = 20
+		}
+		var err error
+		limiter.Allow, err = download.ParseCIDRs(config.General.Rate_allow)
+		if err == nil {
+			limiter.Trusted, err = download.ParseCIDRs(config.General.Trusted_proxy)
+		}
+		if err != nil {
+			log.Printf("Rate limit: %s", err)
+			os.Exit(1)
+		}
+	}
+	var clients *download.ClientLimit
+	if config.General.Client_concurrent > 0 {
+		clients = download.NewClientLimit(config.General.Client_concurrent)
+		clients.UserHeader = config.General.User_header
+		var err error
+		clients.Allow, err = download.ParseCIDRs(config.General.Rate_allow)
+		if err == nil {
+			clients.Trusted, err = download.ParseCIDRs(config.General.Trusted_proxy)
+		}
+		if err != nil {
+			log.Printf("Client limit: %s", err)
+			os.Exit(1)
+		}
+	}
+	var lastKnown *download.LocationCache
+	if config.General.Location_cache != "" {
+		size := config.General.Location_cache_size
+		if size <= 0 {
+			size = 100000
+		}
+		var err error
+		lastKnown, err = download.LoadLocationCache(config.General.Location_cache, size)
+		if err != nil {
+			log.Printf("location-cache: %s", err)
+			os.Exit(1)
+		}
+		go lastKnown.SaveEvery(time.Minute)
+	}
+	var events *download.EventStore
+	if config.General.Event_dir != "" {
+		retention, err := parseDuration(config.General.Event_retention, 90*24*time.Hour)
+		if err == nil {
+			events, err = download.OpenEventStore(config.General.Event_dir, retention)
+		}
+		if err == nil {
+			err = events.Prune(time.Now())
+		}
+		if err != nil {
+			log.Printf("event-dir: %s", err)
+			os.Exit(1)
+		}
+		events.UserHeader = config.General.User_header
+		events.Trusted, _ = download.ParseCIDRs(config.General.Trusted_proxy)
+		go events.PruneEvery(time.Hour)
+	}
+	var scan *download.ScanGate
+	if config.General.Clamd != "" {
+		ttl, err := parseDuration(config.General.Scan_ttl, 24*time.Hour)
+		if err != nil {
+			log.Printf("scan-ttl: %s", err)
+			os.Exit(1)
+		}
+		scanner := download.ParseClamd(config.General.Clamd)
+		scanner.Timeout = 10 * time.Minute
+		scan = download.NewScanGate(scanner, ttl)
+		scan.Notify = config.General.Scan_notify
+	}
+	restores := &download.RestoreQueue{
+		Notify:     config.General.Restore_notify,
+		UserHeader: config.General.User_header,
+	}
+	var err error
+	restores.Interval, err = parseDuration(config.General.Restore_interval, time.Minute)
+	if err == nil {
+		restores.Timeout, err = parseDuration(config.General.Restore_timeout, 24*time.Hour)
+	}
+	if err == nil {
+		restores.Trusted, err = download.ParseCIDRs(config.General.Trusted_proxy)
+	}
+	if err != nil {
+		log.Printf("restore: %s", err)
+		os.Exit(1)
+	}
+	hs, err := makeHandlers(config, fedora, stores, limiter, clients, lastKnown, events, scan, restores)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if selftestOnly {
+		if !selfTest(config, hs, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if config.General.Selftest && !selfTest(config, hs, log.Writer()) {
+		log.Println("Self test failed. Exiting.")
+		os.Exit(1)
+	}
+	reloader := &Reloader{
+		Filename: configFile,
+		Build:    rebuildHandlers(fedora, limiter, clients, lastKnown, events, scan, restores),
+	}
+	reloader.Start(hs, config)
+	// now start a goroutine for each port
+	serverConfig := ServerConfig{
+		CertFile: config.General.Tls_cert_file,
+		KeyFile:  config.General.Tls_key_file,
+		H2C:      config.General.H2c,
+	}
+	timeouts := []struct {
+		name  string
+		value string
+		def   time.Duration
+		dst   *time.Duration
+	}{
+		{"read-header-timeout", config.General.Read_header_timeout, 10 * time.Second, &serverConfig.ReadHeaderTimeout},
+		{"read-timeout", config.General.Read_timeout, time.Minute, &serverConfig.ReadTimeout},
+		{"idle-timeout", config.General.Idle_timeout, 2 * time.Minute, &serverConfig.IdleTimeout},
+		{"write-idle-timeout", config.General.Write_idle_timeout, time.Minute, &serverConfig.WriteIdleTimeout},
+	}
+	for _, t := range timeouts {
+		d, err := parseDuration(t.value, t.def)
+		if err != nil {
+			log.Printf("%s: %s", t.name, err)
+			os.Exit(1)
+		}
+		*t.dst = d
+	}
+	for port := range hs.ports {
+		wg.Add(1)
+		go listen(newServer(port, reloader.Port(port), serverConfig), serverConfig)
+	}
+	if config.General.Dav_port != "" {
+		log.Printf("WebDAV on port %s (datastreams %d)", config.General.Dav_port, len(hs.dav.Handlers))
+		wg.Add(1)
+		go listen(newServer(config.General.Dav_port, reloader.Dav(), serverConfig), serverConfig)
+	}
+	if configFile != "" {
+		go reloader.OnSignal(syscall.SIGHUP)
+		interval, err := parseDuration(config.General.Watch_config, 0)
+		if err != nil {
+			log.Printf("watch-config: %s", err)
+			os.Exit(1)
+		}
+		if interval > 0 {
+			go reloader.Watch(interval)
+		}
+		interval, err = parseDuration(config.General.Secret_refresh, 0)
+		if err != nil {
+			log.Printf("secret-refresh: %s", err)
+			os.Exit(1)
+		}
+		if interval > 0 {
+			go reloader.Refresh(interval)
+		}
+	}
+	// Listen on 6060 to get pprof output and for admin requests
+	http.Handle("/warm/", reloader.Warm(4))
+	if events != nil {
+		http.Handle("/events", events)
+	}
+	admin := serverConfig
+	admin.H2C = false
+	go newServer("6060", http.DefaultServeMux, admin).ListenAndServe()
+	// We add things to the waitgroup, but never call wg.Done(). This will never return.
+	wg.Wait()
+}
+
+// rebuildHandlers returns a function making the handlers, and the stores
+// they use, from a reloaded config file. The fedora connection, the rate
+// and client limits, the location cache, the event store, the scan
+// verdicts, and the restores in progress are kept.
+func rebuildHandlers(fedora fedora.Fedora, limiter *download.RateLimiter, clients *download.ClientLimit, lastKnown *download.LocationCache, events *download.EventStore, scan *download.ScanGate, restores *download.RestoreQueue) func(config) (*handlerSet, error) {
+	return func(config config) (*handlerSet, error) {
+		stores, err := makeStores(config)
+		if err != nil {
+			return nil, err
+		}
+		return makeHandlers(config, fedora, stores, limiter, clients, lastKnown, events, scan, restores)
+	}
+}
+
+// handlerFedora returns the fedora for a handler which gives its own
+// address or namespace. Otherwise it returns def. The address defaults to
+// the one in the general section.
+func handlerFedora(config config, addr, namespace string, def fedora.Fedora) (fedora.Fedora, error) {
+	if addr == "" && namespace == "" {
+		return def, nil
+	}
+	if addr == "" {
+		addr = config.General.Fedora_addr
+	}
+	client, err := backendClient(config, "fedora")
+	if err != nil {
+		return nil, err
+	}
+	return newFedora(config, addr, namespace, client), nil
+}
+
+// makeSources returns the content sources given by a handler's source
+// settings. Each is the name of a registered kind of source followed by
+// its options, such as "directory root=/srv/content".
+func makeSources(entries []string) ([]download.ContentSource, error) {
+	var sources []download.ContentSource
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("source: empty setting")
+		}
+		options := make(map[string]string)
+		for _, field := range fields[1:] {
+			i := strings.Index(field, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("source %s: option %q is not key=value", fields[0], field)
+			}
+			options[field[:i]] = field[i+1:]
+		}
+		source, err := download.NewSource(fields[0], options)
+		if err != nil {
+			return nil, fmt.Errorf("source: %s", err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// makeBearerAuth returns the bearer tokens a handler accepts, from its
+// list of "user token" entries and its introspection endpoint, or nil if
+// it has neither. Introspection answers are remembered for ttl, which
+// defaults to five minutes.
+func makeBearerAuth(config config, tokens []string, introspect, introspectToken string, query bool, ttl string) (*download.BearerAuth, error) {
+	if len(tokens) == 0 && introspect == "" {
+		return nil, nil
+	}
+	bearer := &download.BearerAuth{
+		Tokens:     make(map[string]string),
+		Introspect: introspect,
+		Query:      query,
+	}
+	for _, entry := range tokens {
+		user, token, err := download.ParseBearerToken(entry)
+		if err != nil {
+			return nil, err
+		}
+		bearer.Tokens[token] = user
+	}
+	if introspect != "" {
+		client, err := backendClient(config, "introspect")
+		if err != nil {
+			return nil, err
+		}
+		bearer.Client = client
+	}
+	if introspectToken != "" {
+		bearer.Credential = download.BearerToken{Token: introspectToken}
+	}
+	d, err := parseDuration(ttl, 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("bearer-ttl: %s", err)
+	}
+	if d > 0 {
+		bearer.Verdicts = download.NewTimeCache(d)
+	}
+	return bearer, nil
+}
+
+// newFedora returns the fedora at addr, which makes conditional requests
+// for datastream info if the config file says to remember any.
+func newFedora(config config, addr, namespace string, client *http.Client) fedora.Fedora {
+	return fedora.NewRemoteConditional(addr, namespace, client, config.General.Fedora_info_cache)
+}
+
+// A handlerSet holds the handlers made from a config file.
+type handlerSet struct {
+	ports     map[string]*download.DsidMux         // by port
+	downloads map[string]*download.DownloadHandler // by handler name
+	dav       *download.DavHandler
+	davServer http.Handler // dav, with the limits and access log
+}
+
+// makeHandlers creates the handlers described in the config file. Every
+// handler shares the rate and client limits, the location cache, the
+// event store, the scan gate, and the restore queue, if there are any.
+func makeHandlers(config config, fedora fedora.Fedora, stores []download.ExternalStore, limiter *download.RateLimiter, clients *download.ClientLimit, lastKnown *download.LocationCache, events *download.EventStore, scan *download.ScanGate, restores *download.RestoreQueue) (*handlerSet, error) {
+	hs := &handlerSet{
+		ports:     make(map[string]*download.DsidMux),
+		downloads: make(map[string]*download.DownloadHandler),
+		dav: &download.DavHandler{
+			Fedora:   fedora,
+			Prefix:   config.General.Dav_prefix,
+			Roots:    config.General.Dav_root,
+			Handlers: make(map[string]*download.DownloadHandler),
+			Limits:   make(map[string]*download.ConcurrencyLimit),
+		},
+	}
+	trusted, err := download.ParseCIDRs(config.General.Trusted_proxy)
+	if err != nil {
+		return nil, fmt.Errorf("trusted-proxy: %s", err)
+	}
 	for k, v := range config.Handler {
-		h := &DownloadHandler{
-			Fedora:     fedora,
-			Ds:         v.Datastream,
-			Prefix:     v.Prefix,
-			BendoToken: config.General.Bendo_token,
+		hfedora, err := handlerFedora(config, v.Fedora_addr, v.Fedora_namespace, fedora)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		h := &download.DownloadHandler{
+			Fedora:        hfedora,
+			Ds:            v.Datastream,
+			Prefix:        v.Prefix,
+			Prefixes:      v.Extra_prefix,
+			PrefixSegment: v.Prefix_segment,
+			BendoToken:    config.General.Bendo_token,
+			Stores:        stores,
+			CompressTypes: v.Compress_type,
+			PlainTypes:    v.Plain_type,
+			Media:         v.Media,
+			MediaPage:     v.Media_page,
+			GreedyID:      v.Greedy_id,
+			CacheControl:  v.Cache_control,
+			ChecksumETag:  v.Checksum_etag,
+			LastKnown:     lastKnown,
+			Scan:          scan,
+			Restores:      restores,
+		}
+		h.Sources, err = makeSources(v.Source)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		if events != nil {
+			h.Hooks = append(h.Hooks, events)
+		}
+		if v.Cache_size > 0 {
+			maxItem := v.Cache_max_item
+			if maxItem <= 0 {
+				maxItem = 1 << 20
+			}
+			h.Cache = download.NewMemoryCache(v.Cache_size, maxItem)
+		}
+		if v.Disk_cache_dir != "" {
+			dc, err := download.NewDiskCache(v.Disk_cache_dir, v.Disk_cache_size)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			h.DiskCache = dc
+		}
+		h.CoalesceTimeout, err = parseDuration(v.Coalesce_timeout, 30*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: coalesce-timeout: %s", k, err)
+		}
+		switch {
+		case v.Id_pattern != "" && v.Id_template != "":
+			return nil, fmt.Errorf("Handler %s: only one of id-pattern and id-template may be given", k)
+		case v.Id_pattern != "":
+			h.Validator, err = download.NewRegexpValidator(v.Id_pattern)
+		case v.Id_template != "":
+			h.Validator, err = download.NewNoidTemplate(v.Id_template)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		switch v.Verify {
+		case "", "false":
+		case "log", "true":
+			h.Verify = true
+		case "abort":
+			h.Verify = true
+			h.VerifyAbort = true
+		default:
+			return nil, fmt.Errorf("Handler %s: verify must be one of false, log, or abort", k)
+		}
+		h.Disposition, err = download.ParseDisposition(v.Disposition)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		// "none" turns off the default attachment types
+		for _, t := range v.Attachment_type {
+			if t != "none" {
+				h.AttachmentTypes = append(h.AttachmentTypes, t)
+			} else if h.AttachmentTypes == nil {
+				h.AttachmentTypes = []string{}
+			}
+		}
+		var resolvers download.Resolvers
+		if v.Identifier_table != "" {
+			table, err := download.LoadLookupTable(v.Identifier_table)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			resolvers = append(resolvers, table)
+		}
+		if v.Identifier_search {
+			resolvers = append(resolvers, download.FedoraResolver{Fedora: hfedora})
+		}
+		if len(resolvers) > 0 {
+			h.Resolver = resolvers
+		}
+		for _, sp := range v.Signpost {
+			signpost, err := download.ParseSignpost(sp)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			h.Signposts = append(h.Signposts, signpost)
+		}
+		notFoundTTL, err := parseDuration(v.Not_found_ttl, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: not-found-ttl: %s", k, err)
+		}
+		if notFoundTTL > 0 {
+			h.NotFound = download.NewTimeCache(notFoundTTL)
+		}
+		receiptTTL, err := parseDuration(v.Receipt_ttl, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: receipt-ttl: %s", k, err)
+		}
+		if receiptTTL > 0 {
+			h.Receipts = download.NewTimeCache(receiptTTL)
+		}
+		h.ZipKeepAlive, err = parseDuration(v.Zip_keep_alive, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: zip-keep-alive: %s", k, err)
+		}
+		h.Canonical = v.Canonical
+		h.ZipPrefetch = v.Zip_prefetch
+		h.ZipStoreTypes = v.Zip_store_type
+		if v.Zip_level < 0 || v.Zip_level > 9 {
+			return nil, fmt.Errorf("Handler %s: zip-level must be from 0 to 9, where 0 is the default level", k)
+		}
+		h.ZipLevel = v.Zip_level
+		h.ZipManifest, err = download.ParseZipManifest(v.Zip_manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: zip-manifest: %s", k, err)
+		}
+		h.LowercaseID = v.Lowercase_id
+		h.MultiRange, err = download.ParseMultiRange(v.Multi_range)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		h.Redirect, err = download.ParseRedirect(v.Redirect)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		h.AccelPrefix = v.Accel_prefix
+		for _, desc := range v.Preview {
+			p, err := download.ParsePreview(desc)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			h.Previews = append(h.Previews, p)
+		}
+		if v.Stamp_command != "" {
+			args, err := download.ParseStampCommand(v.Stamp_command)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			h.Stamp = &download.Stamper{
+				Args:       args,
+				Text:       v.Stamp_text,
+				UserHeader: config.General.User_header,
+				Trusted:    trusted,
+			}
+		}
+		if len(v.Thumbnail_size) > 0 {
+			h.Thumbnails = &download.Thumbnailer{Sizes: v.Thumbnail_size}
+			for _, desc := range v.Thumbnail_command {
+				c, err := download.ParseThumbnailCommand(desc)
+				if err != nil {
+					return nil, fmt.Errorf("Handler %s: %s", k, err)
+				}
+				h.Thumbnails.Commands = append(h.Thumbnails.Commands, c)
+			}
+		}
+		if len(v.Admin_user) > 0 || len(v.Admin_group) > 0 {
+			h.Admins = &download.AdminList{
+				UserHeader:  config.General.User_header,
+				GroupHeader: config.General.Group_header,
+				Trusted:     trusted,
+				Users:       v.Admin_user,
+				Groups:      v.Admin_group,
+			}
+		}
+		bearer, err := makeBearerAuth(config, v.Bearer_token, v.Bearer_introspect, v.Bearer_introspect_token, v.Bearer_query, v.Bearer_ttl)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: %s", k, err)
+		}
+		switch v.Auth {
+		case "":
+			if bearer != nil {
+				return nil, fmt.Errorf("Handler %s: bearer tokens need an auth setting", k)
+			}
+		case "hydra":
+			h.Auth = &download.HydraAuth{
+				Fedora:      hfedora,
+				Datastream:  v.Auth_datastream,
+				UserHeader:  config.General.User_header,
+				GroupHeader: config.General.Group_header,
+				Trusted:     trusted,
+				Tokens:      bearer,
+				Identity:    v.Identity,
+			}
+			for _, source := range v.Identity {
+				switch source {
+				case "header":
+				case "bearer":
+					if bearer == nil {
+						return nil, fmt.Errorf("Handler %s: identity bearer needs bearer-token or bearer-introspect", k)
+					}
+				default:
+					return nil, fmt.Errorf("Handler %s: unknown identity %q", k, source)
+				}
+			}
+			if v.Embargo_timezone != "" {
+				loc, err := time.LoadLocation(v.Embargo_timezone)
+				if err != nil {
+					return nil, fmt.Errorf("Handler %s: embargo-timezone: %s", k, err)
+				}
+				h.Auth.(*download.HydraAuth).Timezone = loc
+			}
+			if v.Auth_collection_depth < 0 {
+				return nil, fmt.Errorf("Handler %s: auth-collection-depth cannot be negative", k)
+			}
+			if v.Auth_policy || v.Auth_collection_depth > 0 {
+				ha := h.Auth.(*download.HydraAuth)
+				ha.Policy = v.Auth_policy
+				ha.CollectionDepth = v.Auth_collection_depth
+				ha.CollectionPredicate = v.Auth_collection_predicate
+				ttl, err := parseDuration(v.Auth_inherit_ttl, 5*time.Minute)
+				if err != nil {
+					return nil, fmt.Errorf("Handler %s: auth-inherit-ttl: %s", k, err)
+				}
+				if ttl > 0 {
+					ha.Inherited = download.NewTimeCache(ttl)
+				}
+			}
+		case "bearer":
+			if bearer == nil {
+				return nil, fmt.Errorf("Handler %s: auth bearer needs bearer-token or bearer-introspect", k)
+			}
+			h.Auth = bearer
+		default:
+			return nil, fmt.Errorf("Handler %s: unknown auth %q", k, v.Auth)
+		}
+		if (v.Embargo_timezone != "" || v.Auth_policy || v.Auth_collection_depth != 0 || len(v.Identity) > 0) && v.Auth != "hydra" {
+			return nil, fmt.Errorf("Handler %s: embargo-timezone, identity, auth-policy, and auth-collection-depth need auth = hydra", k)
+		}
+		h.ZipStrict = v.Zip_strict
+		for _, pattern := range v.Zip_datastream {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Handler %s: zip-datastream %q: %s", k, pattern, err)
+			}
+		}
+		h.ZipDatastreams = v.Zip_datastream
+		for _, pattern := range v.Label {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Handler %s: label %q: %s", k, pattern, err)
+			}
+		}
+		h.Labels = v.Label
+		h.PrimaryTypes = v.Primary_type
+		h.Methods, err = download.ParseMethods(v.Method)
+		if err != nil {
+			return nil, fmt.Errorf("Handler %s: method: %s", k, err)
+		}
+		for _, desc := range v.Alternate {
+			alt, err := h.NewAlternate(desc)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+			h.Alternates = append(h.Alternates, alt)
+		}
+		for _, name := range v.Quality {
+			err := h.AddQuality(name, v.Quality_datastream)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: %s", k, err)
+			}
+		}
+		hs.downloads[k] = h
+		if v.Dav {
+			hs.dav.Handlers[v.Datastream] = h
+		}
+		var dl http.Handler = h
+		if v.Max_concurrent > 0 {
+			wait, err := parseDuration(v.Queue_wait, 5*time.Second)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: queue-wait: %s", k, err)
+			}
+			limit := download.NewConcurrencyLimit(h, v.Max_concurrent, v.Queue_length, wait)
+			if v.Dav {
+				hs.dav.Limits[v.Datastream] = limit
+			}
+			dl = limit
+		}
+		if clients != nil {
+			dl = clients.Wrap(dl)
+		}
+		if limiter != nil {
+			dl = limiter.Wrap(dl)
+		}
+		if len(v.Cors_origin) > 0 {
+			if v.Cors_credentials {
+				for _, o := range v.Cors_origin {
+					if o == "*" {
+						return nil, fmt.Errorf("Handler %s: cors-credentials needs each cors-origin listed, not *", k)
+					}
+				}
+			}
+			maxAge, err := parseDuration(v.Cors_max_age, 0)
+			if err != nil {
+				return nil, fmt.Errorf("Handler %s: cors-max-age: %s", k, err)
+			}
+			dl = &download.CORS{
+				Handler:     dl,
+				Origins:     v.Cors_origin,
+				Methods:     h.CORSMethods(v.Cors_method),
+				Expose:      v.Cors_expose,
+				Credentials: v.Cors_credentials,
+				MaxAge:      maxAge,
+			}
+		}
+		if len(v.Error_page) > 0 {
+			pages := &download.ErrorPages{
+				Handler:   dl,
+				Templates: make(map[int]*template.Template),
+				Contact:   v.Contact,
+				Pid:       h.RequestPid,
+			}
+			for _, desc := range v.Error_page {
+				status, t, err := download.ParseErrorPage(desc)
+				if err != nil {
+					return nil, fmt.Errorf("Handler %s: %s", k, err)
+				}
+				pages.Templates[status] = t
+			}
+			dl = pages
 		}
 		log.Printf("Handler %s (datastream %s, port %s, dsid %v)",
 			k,
 			v.Datastream,
 			v.Port,
 			v.Datastream_id)
-		mux, ok := portHandlers[v.Port]
+		mux, ok := hs.ports[v.Port]
 		if !ok {
-			mux = &DsidMux{}
-			portHandlers[v.Port] = mux
-		}
-		// see http://golang.org/doc/faq#closures_and_goroutines
-		k := k // make local ref to var for closure
-		hh := http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				t := time.Now()
-				realip := r.Header.Get("X-Real-IP")
-				if realip == "" {
-					realip = r.RemoteAddr
-				}
-				h.ServeHTTP(w, r)
-				log.Printf("%s %s %s %s %v",
-					k,
-					realip,
-					r.Method,
-					r.RequestURI,
-					time.Now().Sub(t))
-			})
+			mux = &download.DsidMux{}
+			hs.ports[v.Port] = mux
+		}
+		hh := accessLog(k, dl, config.General.User_header, trusted)
 		if len(v.Datastream_id) == 0 {
 			mux.DefaultHandler = hh
 		}
@@ -221,13 +1183,14 @@ func runHandlers(config config, fedora fedora.Fedora) {
 			}
 		}
 	}
-	// now start a goroutine for each port
-	for port, h := range portHandlers {
-		wg.Add(1)
-		go http.ListenAndServe(":"+port, h)
+	// the WebDAV listener is limited and logged like the others
+	var dav http.Handler = hs.dav
+	if clients != nil {
+		dav = clients.Wrap(dav)
 	}
-	// Listen on 6060 to get pprof output
-	go http.ListenAndServe(":6060", nil)
-	// We add things to the waitgroup, but never call wg.Done(). This will never return.
-	wg.Wait()
+	if limiter != nil {
+		dav = limiter.Wrap(dav)
+	}
+	hs.davServer = accessLog("dav", dav, config.General.User_header, trusted)
+	return hs, nil
 }
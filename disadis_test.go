@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	gcfg "gopkg.in/gcfg.v1"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// downFedora wraps a Fedora, failing every request like fedora does
+// during an outage.
+type downFedora struct {
+	fedora.Fedora
+}
+
+func (df downFedora) GetDatastreamInfo(id, dsname string) (fedora.DsInfo, error) {
+	return fedora.DsInfo{}, errors.New("Received status 502 from fedora")
+}
+
+func TestCORSPreflightMux(t *testing.T) {
+	var config config
+	err := gcfg.ReadStringInto(&config, `
+[handler "content"]
+port = 8000
+prefix = test:
+datastream = content
+method = GET
+cors-origin = *
+
+[handler "thumbnail"]
+port = 8000
+prefix = test:
+datastream = thumbnail
+datastream-id = thumbnail
+cors-origin = *
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fedora is down, so a preflight reaching a handler would fail
+	hs, err := makeHandlers(config, downFedora{fedora.NewTestFedora()}, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequence = []struct {
+		route   string
+		method  string
+		status  int
+		allowed string
+	}{
+		{"/1", "GET", 204, "GET"},
+		{"/1", "HEAD", 403, ""},
+		{"/1?datastream_id=thumbnail", "HEAD", 204, "GET, HEAD"},
+	}
+	for _, s := range sequence {
+		r := httptest.NewRequest("OPTIONS", s.route, nil)
+		r.Header.Set("Origin", "https://viewer.example.edu")
+		r.Header.Set("Access-Control-Request-Method", s.method)
+		w := httptest.NewRecorder()
+		hs.ports["8000"].ServeHTTP(w, r)
+		if w.Code != s.status {
+			t.Errorf("%s %s: Expected status %d, got %d", s.route, s.method, s.status, w.Code)
+		}
+		if a := w.Header().Get("Access-Control-Allow-Methods"); a != s.allowed {
+			t.Errorf("%s %s: Expected allowed methods %q, got %q", s.route, s.method, s.allowed, a)
+		}
+	}
+}
+
+func TestCORSCredentialsWildcard(t *testing.T) {
+	var config config
+	err := gcfg.ReadStringInto(&config, `
+[handler "content"]
+port = 8000
+prefix = test:
+datastream = content
+cors-origin = *
+cors-credentials = true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = makeHandlers(config, fedora.NewTestFedora(), nil, nil, nil, nil, nil, nil, nil)
+	if err == nil {
+		t.Errorf("Expected credentials with a wildcard origin to be refused")
+	}
+}
+
+func TestSourceSetting(t *testing.T) {
+	var config config
+	err := gcfg.ReadStringInto(&config, `
+[handler "content"]
+port = 8000
+prefix = test:
+datastream = content
+source = directory root=/srv/content
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := makeHandlers(config, fedora.NewTestFedora(), nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(hs.downloads["content"].Sources); n != 1 {
+		t.Errorf("Expected 1 source, got %d", n)
+	}
+
+	for _, setting := range []string{"nosuch", "directory", "directory /srv/content"} {
+		config.Handler["content"].Source = []string{setting}
+		_, err = makeHandlers(config, fedora.NewTestFedora(), nil, nil, nil, nil, nil, nil, nil)
+		if err == nil {
+			t.Errorf("%q: Expected an error", setting)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package download
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// aboutInfo is the JSON description of a datastream returned by the about
+// route. The location of the content is not included since it may be
+// internal.
+type aboutInfo struct {
+	ID           string `json:"id"`
+	Datastream   string `json:"datastream"`
+	Label        string `json:"label"`
+	MIMEType     string `json:"mimetype"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksum_type,omitempty"`
+	Version      string `json:"version"`
+	State        string `json:"state"`
+}
+
+// about replies with the datastream info for pid as JSON.
+func (dh *DownloadHandler) about(pid string, w http.ResponseWriter, r *http.Request) {
+	if !dh.authorized(Download{Pid: pid, Ds: dh.Ds}, w, r) {
+		return
+	}
+	src, dsinfo, ok := dh.datastreamInfo(pid, w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, aboutInfo{
+		ID:           pid,
+		Datastream:   src.Ds,
+		Label:        dsinfo.Label,
+		MIMEType:     dsinfo.MIMEType,
+		Size:         dsinfo.Size,
+		Checksum:     dsinfo.Checksum,
+		ChecksumType: dsinfo.ChecksumType,
+		Version:      dsinfo.VersionID,
+		State:        dsinfo.State,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
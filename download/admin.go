@@ -0,0 +1,66 @@
+package download
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// An AdminList decides whether a request is from an administrator, using
+// the user and groups the application in front of us passes in headers
+// once it has authenticated the user. If trusted proxies are given, the
+// headers are only believed from them.
+type AdminList struct {
+	UserHeader  string
+	GroupHeader string // a comma separated list of groups
+	Trusted     []*net.IPNet
+
+	Users  []string
+	Groups []string
+}
+
+// Allowed returns true if r is from one of the Users or a member of one of
+// the Groups. A nil AdminList allows no one.
+func (al *AdminList) Allowed(r *http.Request) bool {
+	if al == nil {
+		return false
+	}
+	if user := TrustedHeader(r, al.UserHeader, al.Trusted); user != "" {
+		for _, u := range al.Users {
+			if u == user {
+				return true
+			}
+		}
+	}
+	groups := TrustedHeader(r, al.GroupHeader, al.Trusted)
+	for _, g := range strings.Split(groups, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		for _, admin := range al.Groups {
+			if admin == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TrustedHeader returns the given header of r, if it is set and r is from
+// one of the trusted proxies. No client is trusted if none are given, since
+// anyone could otherwise name themselves in the header.
+func TrustedHeader(r *http.Request, header string, trusted []*net.IPNet) string {
+	if header == "" || len(trusted) == 0 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !contains(trusted, ip) {
+		return ""
+	}
+	return r.Header.Get(header)
+}
@@ -0,0 +1,389 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the formats of multi-file downloads. Tar streams better than zip for
+// very large batches, and is what most dataset transfer tools expect.
+const (
+	formatZip   = "zip"
+	formatTar   = "tar"
+	formatTarGz = "tar.gz"
+)
+
+// archiveTypes gives the Content-Type of each archive format.
+var archiveTypes = map[string]string{
+	formatZip:   "application/zip",
+	formatTar:   "application/x-tar",
+	formatTarGz: "application/gzip",
+}
+
+// archiveFormat returns the format of a multi-file download requested with
+// the path segment route, which the format query parameter overrides. It is
+// false if the format is not known.
+func archiveFormat(route string, r *http.Request) (string, bool) {
+	format := route
+	if f := r.FormValue("format"); f != "" {
+		format = strings.ToLower(f)
+	}
+	_, ok := archiveTypes[format]
+	return format, ok
+}
+
+// An archiveMember describes a file to add to an archive. Size is -1 if it
+// is not known.
+type archiveMember struct {
+	Name     string
+	MIMEType string
+	Size     int64
+	Modified time.Time
+	Comment  string
+}
+
+// An archiveWriter writes the members of a multi-file download to a stream.
+type archiveWriter interface {
+	// Create starts a member and returns the writer for its content.
+	Create(m archiveMember) (io.Writer, error)
+	// SetComment sets the comment of the whole archive, if the format
+	// has one.
+	SetComment(comment string) error
+	// Pad writes filler which readers skip, to keep the connection busy
+	// while waiting for slow content. It is not called while a member is
+	// being written.
+	Pad() error
+	// Flush writes out anything buffered.
+	Flush() error
+	Close() error
+}
+
+// DefaultZipStoreTypes are the MIME types stored in zip downloads without
+// compression, if ZipStoreTypes is not set. They are already compressed.
+var DefaultZipStoreTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/jp2",
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/ogg",
+	"audio/flac",
+	"video/*",
+	"application/zip",
+	"application/gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+}
+
+// newArchiveWriter returns a writer of the given format to w, using the
+// compression settings of dh. Any padding members are named from names.
+func (dh *DownloadHandler) newArchiveWriter(format string, w io.Writer, names entryNames) archiveWriter {
+	level := dh.ZipLevel
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	switch format {
+	case formatTar:
+		return &tarArchive{tw: tar.NewWriter(w), names: names}
+	case formatTarGz:
+		// the level was checked when the handler was configured
+		gz, _ := gzip.NewWriterLevel(w, level)
+		return &tarArchive{tw: tar.NewWriter(gz), gz: gz, names: names}
+	}
+	zw := zip.NewWriter(w)
+	if level != flate.DefaultCompression {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	storeTypes := dh.ZipStoreTypes
+	if storeTypes == nil {
+		storeTypes = DefaultZipStoreTypes
+	}
+	return &zipArchive{Writer: zw, storeTypes: storeTypes, out: w, names: names}
+}
+
+// needsSize is true if members of the format must have their size given
+// before their content is written.
+func needsSize(format string) bool {
+	return format != formatZip
+}
+
+// A zipArchive writes a zip file. Members of the storeTypes are stored,
+// and the rest are deflated.
+//
+// Until the first member starts, padding is written ahead of the zip data,
+// and the zip's offsets moved past it, which zip readers accept like the
+// stub of a self-extracting archive. After that there is no place outside
+// a member which every reader skips, so padding goes in a stored member of
+// its own, named like ".keepalive", which is only added to the archive if
+// padding is needed between two members.
+type zipArchive struct {
+	*zip.Writer
+	storeTypes []string
+	out        io.Writer // where the zip is written
+	names      entryNames
+	padding    int64     // bytes written ahead of the zip data
+	started    bool      // whether zip data has been written
+	filler     io.Writer // the padding member being written, if any
+}
+
+// zipPadding is written by zipArchive.Pad.
+var zipPadding = []byte{0}
+
+func (za *zipArchive) Create(m archiveMember) (io.Writer, error) {
+	za.start()
+	za.filler = nil
+	method := zip.Deflate
+	if matchType(za.storeTypes, m.MIMEType) {
+		method = zip.Store
+	}
+	return za.CreateHeader(&zip.FileHeader{
+		Name:     m.Name,
+		Method:   method,
+		Modified: m.Modified,
+		Comment:  m.Comment,
+	})
+}
+
+// start moves the zip's offsets past any padding ahead of it, before the
+// first zip data is written.
+func (za *zipArchive) start() {
+	if za.started {
+		return
+	}
+	za.started = true
+	za.SetOffset(za.padding)
+}
+
+func (za *zipArchive) Pad() error {
+	if !za.started {
+		n, err := za.out.Write(zipPadding)
+		za.padding += int64(n)
+		return err
+	}
+	if za.filler == nil {
+		name := za.names.add(".keepalive", "")
+		w, err := za.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		za.filler = w
+	}
+	_, err := za.filler.Write(zipPadding)
+	if err == nil {
+		err = za.Writer.Flush()
+	}
+	return err
+}
+
+func (za *zipArchive) SetComment(comment string) error {
+	za.start()
+	return za.Writer.SetComment(comment)
+}
+
+func (za *zipArchive) Close() error {
+	za.start()
+	return za.Writer.Close()
+}
+
+// A tarArchive writes a tar file, compressed with gzip if gz is set.
+// Member comments are kept as PAX records, since tar has no other place
+// for them. A tar file has no overall comment.
+//
+// Padding is an empty member named like ".keepalive", repeated as often as
+// needed, which tar readers take as the same file. Readers such as bsdtar
+// refuse several PAX headers in a row, so those cannot be used instead.
+type tarArchive struct {
+	tw     *tar.Writer
+	gz     *gzip.Writer
+	names  entryNames
+	filler string // the name of the padding members, once there are any
+}
+
+func (ta *tarArchive) Create(m archiveMember) (io.Writer, error) {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     m.Name,
+		Size:     m.Size,
+		Mode:     0644,
+		ModTime:  m.Modified,
+	}
+	if m.Comment != "" {
+		hdr.PAXRecords = map[string]string{"comment": m.Comment}
+	}
+	err := ta.tw.WriteHeader(hdr)
+	return ta.tw, err
+}
+
+func (ta *tarArchive) SetComment(comment string) error { return nil }
+
+func (ta *tarArchive) Pad() error {
+	if ta.filler == "" {
+		ta.filler = ta.names.add(".keepalive", "")
+	}
+	err := ta.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ta.filler,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err == nil {
+		err = ta.Flush()
+	}
+	return err
+}
+
+func (ta *tarArchive) Flush() error {
+	err := ta.tw.Flush()
+	if err == nil && ta.gz != nil {
+		err = ta.gz.Flush()
+	}
+	return err
+}
+
+func (ta *tarArchive) Close() error {
+	err := ta.tw.Close()
+	if ta.gz != nil {
+		if gerr := ta.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	return err
+}
+
+// entryNames gives the members of an archive names which are safe to
+// extract and unique, ignoring case, so no member overwrites another when
+// the archive is unpacked. The keys are the lowercased names in use.
+type entryNames map[string]bool
+
+// reserve keeps name from being given to a member.
+func (en entryNames) reserve(name string) {
+	en[strings.ToLower(name)] = true
+}
+
+// add returns the name for a member labelled label, which is the object
+// pid if the label has nothing usable. Names already given get a number
+// before their extension, as in "report (2).pdf".
+func (en entryNames) add(label, pid string) string {
+	name := entryName(label)
+	if name == "" {
+		name = entryName(pid)
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; en[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	en.reserve(name)
+	return name
+}
+
+// entryName makes a label safe to use as the name of an archive member.
+// Path separators, which would put the member in a directory or outside
+// the one it is extracted to, become underscores, as do the other
+// characters Windows does not allow in names. Control characters are
+// removed, as are trailing dots and spaces, which Windows drops. It
+// returns "" if nothing usable is left.
+func entryName(label string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, label)
+	return strings.TrimRight(strings.TrimSpace(name), ". ")
+}
+
+// spoolContent copies content to a temporary file, to learn its size, and
+// returns the file in its place. Content is closed either way.
+func spoolContent(content io.ReadCloser) (io.ReadCloser, int64, error) {
+	defer content.Close()
+	f, err := ioutil.TempFile("", "archive-")
+	if err != nil {
+		return nil, 0, err
+	}
+	spool := spoolFile{f}
+	n, err := CopyBuffer(f, content)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	return spool, n, nil
+}
+
+// the size of the blocks a tar file is made of, and of the zero blocks
+// which end it
+const (
+	tarBlock   = 512
+	tarEndSize = 2 * tarBlock
+)
+
+// tarMemberSize returns the bytes a tar archive uses for a member: a PAX
+// header for its comment, if it has one, and for its name if that does
+// not fit in the ustar header, then its own header and its content, each
+// padded to a whole block. This mirrors what archive/tar writes.
+func tarMemberSize(name, comment string, size int64) int64 {
+	pax := 0
+	if comment != "" {
+		pax += paxRecordSize("comment", comment)
+	}
+	if len(name) > 100 || !isASCII(name) {
+		pax += paxRecordSize("path", name)
+	}
+	if pax > 0 {
+		pax += tarBlock
+	}
+	return tarBlock + tarBlocks(int64(pax)) + tarBlocks(size)
+}
+
+// tarBlocks returns n rounded up to a whole number of blocks.
+func tarBlocks(n int64) int64 {
+	return (n + tarBlock - 1) / tarBlock * tarBlock
+}
+
+// paxRecordSize returns the length of the PAX record "%d key=value\n",
+// whose length includes itself.
+func paxRecordSize(key, value string) int {
+	n := len(key) + len(value) + 3
+	digits := 1
+	for size := 10; n+digits >= size; size *= 10 {
+		digits++
+	}
+	return n + digits
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || s[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
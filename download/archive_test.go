@@ -0,0 +1,261 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// readTar returns the names, contents, and comments of the members of a
+// tar file.
+func readTar(t *testing.T, r io.Reader) (names, files, comments []string) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(hdr.Name, err)
+		}
+		names = append(names, hdr.Name)
+		files = append(files, string(b))
+		comments = append(comments, hdr.PAXRecords["comment"])
+	}
+}
+
+func TestTarDownload(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	long := strings.Repeat("é", 60) + ".txt"
+	dh.Fedora.(*fedora.TestFedora).Set("test:long", "content", fedora.DsInfo{Label: long}, []byte("long name"))
+
+	// badsize has no known size, so it is spooled
+	resp, body := checkRouteX(t, "GET", ts.URL+"/0123/tar/123,missing,badsize,long", 200, "", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-tar" {
+		t.Errorf("Expected application/x-tar, got %q", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasSuffix(cd, `0123.tar"`) {
+		t.Errorf("Expected 0123.tar, got %q", cd)
+	}
+	names, files, comments := readTar(t, bytes.NewReader(body))
+	if strings.Join(files, ",") != "goodbye,hola,long name" {
+		t.Errorf("Unexpected tar contents %v", files)
+	}
+	if len(names) != 3 || names[2] != long || comments[0] != "CurateND:123" {
+		t.Errorf("Unexpected tar headers %v %v", names, comments)
+	}
+
+	// the estimate of a tar is exact when the sizes are known
+	route := ts.URL + "/0123/tar/123,missing,long"
+	resp, _ = checkRouteX(t, "HEAD", route, 200, "", nil)
+	_, body = checkRouteX(t, "GET", route, 200, "", nil)
+	if e := resp.Header.Get("X-Estimated-Length"); e != strconv.Itoa(len(body)) {
+		t.Errorf("Expected an estimate of %d, got %q", len(body), e)
+	}
+	if n := resp.Header.Get("X-Zip-Skipped"); n != "1" {
+		t.Errorf("Expected 1 skipped, got %q", n)
+	}
+}
+
+func TestTarGzDownload(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	for _, route := range []string{"/0123/tar.gz/0123,123", "/0123/zip/0123,123?format=tar.gz"} {
+		resp, body := checkRouteX(t, "GET", ts.URL+route, 200, "", nil)
+		if ct := resp.Header.Get("Content-Type"); ct != "application/gzip" {
+			t.Errorf("%s: Expected application/gzip, got %q", route, ct)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(route, err)
+		}
+		_, files, _ := readTar(t, zr)
+		if strings.Join(files, ",") != "hello,goodbye" {
+			t.Errorf("%s: Unexpected tar contents %v", route, files)
+		}
+	}
+
+	resp, _ := checkRouteX(t, "HEAD", ts.URL+"/0123/tar.gz/0123,123", 200, "", nil)
+	if e := resp.Header.Get("X-Estimated-Length"); e != "" {
+		t.Errorf("Expected no estimate, got %q", e)
+	}
+	checkRouteX(t, "GET", ts.URL+"/0123/zip/0123?format=rar", 400, "", nil)
+}
+
+func TestZipStoreTypes(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:photo", "content", fedora.DsInfo{MIMEType: "image/jpeg"}, []byte("jpeg"))
+	dh.ZipLevel = 9
+
+	methods := func() []uint16 {
+		_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/photo,pdffile", 200, "", nil)
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []uint16
+		for _, f := range zr.File {
+			result = append(result, f.Method)
+		}
+		return result
+	}
+	if m := methods(); len(m) != 2 || m[0] != zip.Store || m[1] != zip.Deflate {
+		t.Errorf("Expected the JPEG stored and the PDF deflated, got %v", m)
+	}
+	dh.ZipStoreTypes = []string{"*/*"}
+	if m := methods(); len(m) != 2 || m[0] != zip.Store || m[1] != zip.Store {
+		t.Errorf("Expected everything stored, got %v", m)
+	}
+}
+
+func TestZipManifest(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	// a stored checksum is used even if the content no longer matches it
+	tf.Set("test:a", "content", fedora.DsInfo{Label: "a.txt", Checksum: "ABC123", ChecksumType: "MD5"}, []byte("hello"))
+	tf.Set("test:b", "content", fedora.DsInfo{Label: "b%c.txt"}, []byte("hello"))
+	dh.ZipManifest = "md5"
+
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/a,b", 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 3 || zr.File[2].Name != "manifest-md5.txt" {
+		t.Fatalf("Expected a manifest after the files")
+	}
+	rc, err := zr.File[2].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	expected := "abc123  a.txt\n5d41402abc4b2a76b9719d911017c592  b%25c.txt\n"
+	if string(manifest) != expected {
+		t.Errorf("Expected manifest %q, got %q", expected, manifest)
+	}
+
+	// the estimate of a tar includes the manifest
+	route := ts.URL + "/0123/tar/a,b?format=tar"
+	resp, _ := checkRouteX(t, "HEAD", route, 200, "", nil)
+	_, body = checkRouteX(t, "GET", route, 200, "", nil)
+	if e := resp.Header.Get("X-Estimated-Length"); e != strconv.Itoa(len(body)) {
+		t.Errorf("Expected an estimate of %d, got %q", len(body), e)
+	}
+	names, _, _ := readTar(t, bytes.NewReader(body))
+	if len(names) != 3 || names[2] != "manifest-md5.txt" {
+		t.Errorf("Unexpected tar members %v", names)
+	}
+}
+
+func TestArchiveModified(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	created := time.Date(2015, 6, 2, 10, 0, 0, 0, time.UTC)
+	dh.Fedora.(*fedora.TestFedora).Set("test:old", "content", fedora.DsInfo{Label: "old.txt", Created: created}, []byte("old"))
+
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/old", 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || !zr.File[0].Modified.Equal(created) {
+		t.Errorf("Expected the zip member to be modified at %s", created)
+	}
+
+	_, body = checkRouteX(t, "GET", ts.URL+"/0123/tar/old", 200, "", nil)
+	hdr, err := tar.NewReader(bytes.NewReader(body)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.ModTime.Equal(created) {
+		t.Errorf("Expected the tar member to be modified at %s, got %s", created, hdr.ModTime)
+	}
+}
+
+func TestEntryNames(t *testing.T) {
+	names := entryNames{}
+	names.reserve("manifest-md5.txt")
+	var table = []struct {
+		label, expected string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"Report.PDF", "Report (2).PDF"},
+		{"report.pdf", "report (3).pdf"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"..", "und_abc"},
+		{"", "und_abc (2)"},
+		{"a\tb:c?. ", "ab_c_"},
+		{"manifest-md5.txt", "manifest-md5 (2).txt"},
+		{".profile", ".profile"},
+		{".profile", ".profile (2)"},
+	}
+	for _, test := range table {
+		if name := names.add(test.label, "und:abc"); name != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.label, test.expected, name)
+		}
+	}
+}
+
+func TestObjectZip(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:obj", "content", fedora.DsInfo{Label: "thesis.pdf"}, []byte("thesis"))
+	tf.Set("test:obj", "thumbnail", fedora.DsInfo{}, []byte("thumb"))
+	tf.Set("test:obj", "OCR1", fedora.DsInfo{Label: "page.txt"}, []byte("page one"))
+	tf.Set("test:obj", "OCR2", fedora.DsInfo{Label: "page.txt"}, []byte("page two"))
+	tf.Set("test:obj", "RELS-EXT", fedora.DsInfo{}, []byte("private"))
+
+	checkRouteX(t, "GET", ts.URL+"/obj/zip", 404, "", nil)
+
+	dh.ZipDatastreams = []string{"content", "thumbnail", "OCR*"}
+	_, body := checkRouteX(t, "GET", ts.URL+"/obj/zip", 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "thesis.pdf,thumbnail,page.txt,page (2).txt" {
+		t.Errorf("Unexpected zip members %v", names)
+	}
+	if len(zr.File) > 0 && zr.File[0].Comment != "CurateND:test:obj/content" {
+		t.Errorf("Unexpected comment %q", zr.File[0].Comment)
+	}
+
+	_, body = checkRouteX(t, "GET", ts.URL+"/obj/tar", 200, "", nil)
+	_, files, _ := readTar(t, bytes.NewReader(body))
+	if strings.Join(files, ",") != "thesis,thumb,page one,page two" {
+		t.Errorf("Unexpected tar contents %v", files)
+	}
+	checkRouteX(t, "GET", ts.URL+"/nothing/zip", 404, "", nil)
+}
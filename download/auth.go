@@ -0,0 +1,321 @@
+package download
+
+import (
+	"encoding/xml"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// An Auth decides whether a request may download a datastream. It is
+// asked about every single download and about each member of a zip or tar
+// download, so restricted items cannot be fetched by listing them in the
+// archive of an open one. It is also asked before the about, checksum,
+// and thumbnail routes, with only the pid and datastream id.
+//
+// Check returns nil if the download is allowed, ErrDenied or
+// ErrUnauthenticated if it is not, and any other error if it cannot tell,
+// such as when a rights service is down.
+type Auth interface {
+	Check(d Download, r *http.Request) error
+}
+
+// the errors an Auth returns to refuse a download: ErrDenied when the
+// request may not have it, and ErrUnauthenticated when it needs a valid
+// token and has none
+var (
+	ErrDenied          = errors.New("access denied")
+	ErrUnauthenticated = errors.New("authentication required")
+)
+
+// isDenied is true if err is an Auth refusing a download.
+func isDenied(err error) bool {
+	return err == ErrDenied || err == ErrUnauthenticated
+}
+
+// authorized returns true if the Auth of dh allows the download d.
+// Otherwise it writes a 403 error, a 401 error if a token is needed, or a
+// 503 error if the Auth failed.
+func (dh *DownloadHandler) authorized(d Download, w http.ResponseWriter, r *http.Request) bool {
+	if dh.Auth == nil {
+		return true
+	}
+	return writeAuthError(d, dh.Auth.Check(d, r), w)
+}
+
+// previewOnly checks the download d like authorized, and also returns true
+// if only a preview of it may be sent. Without an Auth every download of a
+// handler with Previews is a preview. With one, downloads which are allowed
+// are sent whole, and those which are denied are sent as a preview if
+// their type has one.
+func (dh *DownloadHandler) previewOnly(d Download, w http.ResponseWriter, r *http.Request) (bool, bool) {
+	if len(dh.Previews) == 0 {
+		return false, dh.authorized(d, w, r)
+	}
+	if dh.Auth == nil {
+		return true, true
+	}
+	err := dh.Auth.Check(d, r)
+	if _, ok := dh.previewLength(d.DsInfo.MIMEType); ok && err == ErrDenied {
+		return true, true
+	}
+	return false, writeAuthError(d, err, w)
+}
+
+// writeAuthError returns true if err, from an Auth checking d, is nil, and
+// otherwise writes the error response for it.
+func writeAuthError(d Download, err error, w http.ResponseWriter) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == ErrDenied:
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	case err == ErrUnauthenticated:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="disadis"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	default:
+		log.Printf("Authorizing %s/%s: %s", d.Pid, d.Ds, err)
+		writeUnavailable(w, fedoraRetryAfter)
+	}
+	return false
+}
+
+// A HydraAuth allows downloads using the rightsMetadata datastream Hydra
+// keeps in each object. A request may download an object if the user, or
+// one of their groups, has read or edit access to it. Everyone is in the
+// group "public", and every authenticated user is in "registered". While
+// an object is under embargo only those with edit access may download it.
+// Objects without rights are denied.
+//
+// The user and groups are taken from headers, as for an AdminList. If
+// Tokens is set, requests with a bearer token are instead made by the
+// user the token belongs to, in no groups but "registered". Identity may
+// choose and order these sources.
+type HydraAuth struct {
+	Fedora      fedora.Fedora
+	Datastream  string // defaults to "rightsMetadata"
+	UserHeader  string
+	GroupHeader string // a comma separated list of groups
+	Trusted     []*net.IPNet
+	Tokens      *BearerAuth
+
+	// Identity lists where to learn who makes a request, tried in order
+	// until one says: "bearer" for Tokens, and "header" for UserHeader
+	// and GroupHeader. Defaults to DefaultIdentity.
+	Identity []string
+
+	// Timezone is where embargo dates and times without an offset are
+	// read, which should be the repository's policy timezone. Defaults to
+	// the local timezone.
+	Timezone *time.Location
+
+	// Policy adds the rights of the admin policy object each object is
+	// governed by, according to its RELS-EXT, to its own.
+	Policy bool
+
+	// CollectionDepth is how many levels of parent collections to look
+	// through for rights, for objects which grant no access of their
+	// own. The rights of the nearest collections granting some are used.
+	// Zero turns this off.
+	CollectionDepth int
+
+	// CollectionPredicate is the RELS-EXT relationship from an object
+	// to its parent collections. Defaults to isMemberOfCollection.
+	CollectionPredicate string
+
+	// Inherited remembers the rights of policy objects and collections,
+	// which many objects share. Optional.
+	Inherited *TimeCache
+}
+
+// hydraRights is the part of a rightsMetadata datastream which is used.
+type hydraRights struct {
+	Access []struct {
+		Type   string   `xml:"type,attr"`
+		People []string `xml:"machine>person"`
+		Groups []string `xml:"machine>group"`
+	} `xml:"access"`
+	Embargo string `xml:"embargo>machine>date"`
+}
+
+// Check allows the download if the rights of its object do.
+func (ha *HydraAuth) Check(d Download, r *http.Request) error {
+	rights, err := ha.rights(d.Pid)
+	if err != nil {
+		return err
+	}
+
+	user, groupHeader, err := ha.identify(r)
+	if err != nil {
+		return err
+	}
+	groups := []string{"public"}
+	if user != "" {
+		groups = append(groups, "registered")
+	}
+	for _, g := range strings.Split(groupHeader, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	levels := []string{"read", "edit"}
+	if rights.embargoed(time.Now(), ha.Timezone) {
+		levels = []string{"edit"}
+	}
+	for _, access := range rights.Access {
+		if !hasString(levels, access.Type) {
+			continue
+		}
+		if user != "" && hasString(access.People, user) {
+			return nil
+		}
+		for _, g := range groups {
+			if hasString(access.Groups, g) {
+				return nil
+			}
+		}
+	}
+	return ErrDenied
+}
+
+// DefaultIdentity is the order a HydraAuth learns who makes a request in,
+// if its Identity is not set.
+var DefaultIdentity = []string{"bearer", "header"}
+
+// identify returns the user making r and a comma separated list of their
+// groups, from the first source in Identity which knows them.
+func (ha *HydraAuth) identify(r *http.Request) (string, string, error) {
+	sources := ha.Identity
+	if len(sources) == 0 {
+		sources = DefaultIdentity
+	}
+	for _, source := range sources {
+		switch source {
+		case "bearer":
+			if ha.Tokens == nil {
+				continue
+			}
+			user, ok, err := ha.Tokens.User(r)
+			if err != nil || ok {
+				return user, "", err
+			}
+		case "header":
+			user := TrustedHeader(r, ha.UserHeader, ha.Trusted)
+			groups := TrustedHeader(r, ha.GroupHeader, ha.Trusted)
+			if user != "" || groups != "" {
+				return user, groups, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// rights returns the rights of the object pid, with those it inherits.
+// Objects without any rights are denied.
+func (ha *HydraAuth) rights(pid string) (*hydraRights, error) {
+	rights, err := ha.readRights(pid)
+	if err != nil {
+		return nil, err
+	}
+	if ha.Policy {
+		rights, err = ha.inheritPolicy(pid, rights)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ha.CollectionDepth > 0 && !rights.grants() {
+		rights, err = ha.inheritCollections(pid, rights)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rights == nil {
+		return nil, ErrDenied
+	}
+	return rights, nil
+}
+
+// readRights returns the rights datastream of the object pid, or nil if it
+// has none. Rights which cannot be read are denied.
+func (ha *HydraAuth) readRights(pid string) (*hydraRights, error) {
+	ds := ha.Datastream
+	if ds == "" {
+		ds = "rightsMetadata"
+	}
+	body, _, err := ha.Fedora.GetDatastream(pid, ds)
+	if err == fedora.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var rights hydraRights
+	err = xml.NewDecoder(body).Decode(&rights)
+	if err != nil {
+		log.Printf("Bad rights for %s: %s", pid, err)
+		return nil, ErrDenied
+	}
+	return &rights, nil
+}
+
+// grants is true if hr gives anyone read or edit access.
+func (hr *hydraRights) grants() bool {
+	if hr == nil {
+		return false
+	}
+	for _, access := range hr.Access {
+		if (access.Type == "read" || access.Type == "edit") &&
+			(len(access.People) > 0 || len(access.Groups) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns the access of hr together with that of parent. The
+// embargo of hr is kept. Either may be nil.
+func (hr *hydraRights) merge(parent *hydraRights) *hydraRights {
+	if parent == nil {
+		return hr
+	}
+	if hr == nil {
+		return &hydraRights{Access: parent.Access}
+	}
+	merged := *hr
+	merged.Access = append(merged.Access[:len(merged.Access):len(merged.Access)], parent.Access...)
+	return &merged
+}
+
+// embargoLayouts are the forms of embargo end without an offset, which are
+// read in the policy timezone. A date ends at its midnight.
+var embargoLayouts = []string{"2006-01-02T15:04:05", "2006-01-02"}
+
+// embargoed is true if the embargo has not ended by now. The end is an
+// RFC 3339 timestamp, or a date or a date and time in the timezone loc,
+// which is the local timezone if nil. Embargoes with an end which cannot
+// be read never end.
+func (hr *hydraRights) embargoed(now time.Time, loc *time.Location) bool {
+	date := strings.TrimSpace(hr.Embargo)
+	if date == "" {
+		return false
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	end, err := time.Parse(time.RFC3339, date)
+	for _, layout := range embargoLayouts {
+		if err == nil {
+			break
+		}
+		end, err = time.ParseInLocation(layout, date, loc)
+	}
+	if err != nil {
+		return true
+	}
+	return now.Before(end)
+}
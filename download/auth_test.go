@@ -0,0 +1,241 @@
+package download
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+const (
+	openRights = `<rightsMetadata xmlns="http://hydra-collab.stanford.edu/schemas/rightsMetadata/v1" version="0.1">
+  <access type="read"><machine><group>public</group></machine></access>
+  <access type="edit"><machine><person>owner</person></machine></access>
+</rightsMetadata>`
+	restrictedRights = `<rightsMetadata xmlns="http://hydra-collab.stanford.edu/schemas/rightsMetadata/v1" version="0.1">
+  <access type="read"><machine><group>staff</group></machine></access>
+  <access type="edit"><machine><person>owner</person></machine></access>
+</rightsMetadata>`
+	embargoedRights = `<rightsMetadata xmlns="http://hydra-collab.stanford.edu/schemas/rightsMetadata/v1" version="0.1">
+  <access type="read"><machine><group>registered</group></machine></access>
+  <access type="edit"><machine><person>owner</person></machine></access>
+  <embargo><machine><date>2999-01-01</date></machine></embargo>
+</rightsMetadata>`
+)
+
+// relsExtFor returns a RELS-EXT datastream relating an object to others.
+func relsExtFor(pid string, relations ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+  xmlns:hydra="http://projecthydra.org/ns/relations#"
+  xmlns:rel="info:fedora/fedora-system:def/relations-external#">
+  <rdf:Description rdf:about="info:fedora/` + pid + `">`)
+	for i := 0; i+1 < len(relations); i += 2 {
+		b.WriteString(`<` + relations[i] + ` rdf:resource="info:fedora/` + relations[i+1] + `"/>`)
+	}
+	b.WriteString(`</rdf:Description></rdf:RDF>`)
+	return b.Bytes()
+}
+
+func setupAuth(dh *DownloadHandler) {
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:0123", "rightsMetadata", fedora.DsInfo{}, []byte(openRights))
+	tf.Set("test:123", "rightsMetadata", fedora.DsInfo{}, []byte(restrictedRights))
+	tf.Set("test:abc", "rightsMetadata", fedora.DsInfo{}, []byte(embargoedRights))
+	dh.Auth = &HydraAuth{
+		Fedora:      tf,
+		UserHeader:  "X-Remote-User",
+		GroupHeader: "X-Remote-Groups",
+		Trusted:     loopback(),
+	}
+}
+
+func TestHydraAuth(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	setupAuth(ts.Config.Handler.(*DownloadHandler))
+
+	as := func(user, groups string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("X-Remote-User", user)
+			r.Header.Set("X-Remote-Groups", groups)
+		}
+	}
+	var table = []struct {
+		route  string
+		setup  func(*http.Request)
+		status int
+	}{
+		{"/0123", nil, 200},
+		{"/123", nil, 403},
+		{"/123", as("someone", "staff, students"), 200},
+		{"/123", as("owner", ""), 200},
+		{"/abc", as("someone", ""), 403},
+		{"/abc", as("owner", ""), 200},
+		{"/xyz", nil, 404},
+		{"/badsize", nil, 403}, // no rights
+	}
+	for _, test := range table {
+		checkRouteX(t, "GET", ts.URL+test.route, test.status, "", test.setup)
+	}
+
+}
+
+func TestEmbargo(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+	var table = []struct {
+		embargo   string
+		now       time.Time
+		loc       *time.Location
+		embargoed bool
+	}{
+		{"", time.Now(), nil, false},
+		{"2020-06-01", time.Date(2020, 5, 31, 23, 59, 0, 0, time.Local), nil, true},
+		{"2020-06-01", time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local), nil, false},
+		{"2020-06-01T12:00:00Z", time.Date(2020, 6, 1, 11, 59, 0, 0, time.UTC), chicago, true},
+		{"2020-06-01T12:00:00Z", time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), chicago, false},
+		{"2020-06-01T12:00:00-04:00", time.Date(2020, 6, 1, 15, 59, 0, 0, time.UTC), nil, true},
+		// in the policy timezone, which is five hours behind UTC in June
+		{"2020-06-01", time.Date(2020, 6, 1, 4, 59, 0, 0, time.UTC), chicago, true},
+		{"2020-06-01", time.Date(2020, 6, 1, 5, 0, 0, 0, time.UTC), chicago, false},
+		{"2020-06-01T12:00:00", time.Date(2020, 6, 1, 16, 59, 0, 0, time.UTC), chicago, true},
+		{"2020-06-01T12:00:00", time.Date(2020, 6, 1, 17, 0, 0, 0, time.UTC), chicago, false},
+		{"June 1", time.Now(), nil, true}, // unreadable
+	}
+	for _, test := range table {
+		hr := hydraRights{Embargo: test.embargo}
+		if hr.embargoed(test.now, test.loc) != test.embargoed {
+			t.Errorf("%q at %v: expected embargoed %v", test.embargo, test.now, test.embargoed)
+		}
+	}
+}
+
+func TestPolicyRights(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	setupAuth(dh)
+	ha := dh.Auth.(*HydraAuth)
+	ha.Inherited = NewTimeCache(time.Minute)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:apo", "rightsMetadata", fedora.DsInfo{}, []byte(restrictedRights))
+	// governed, with no rights of its own
+	tf.Set("test:gov", "content", fedora.DsInfo{}, []byte("governed"))
+	tf.Set("test:gov", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:gov", "hydra:isGovernedBy", "test:apo"))
+	// governed, and open itself
+	tf.Set("test:0123", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:0123", "hydra:isGovernedBy", "test:apo"))
+
+	staff := func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "someone")
+		r.Header.Set("X-Remote-Groups", "staff")
+	}
+	checkRoute(t, "GET", ts.URL+"/gov", 403, "")
+	checkRouteX(t, "GET", ts.URL+"/gov", 403, "", staff)
+	ha.Policy = true
+	checkRoute(t, "GET", ts.URL+"/gov", 403, "")
+	checkRouteX(t, "GET", ts.URL+"/gov", 200, "governed", staff)
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	// the policy's rights are remembered
+	tf.Set("test:apo", "rightsMetadata", fedora.DsInfo{}, []byte(openRights))
+	checkRoute(t, "GET", ts.URL+"/gov", 403, "")
+}
+
+func TestCollectionRights(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	setupAuth(dh)
+	ha := dh.Auth.(*HydraAuth)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:top", "rightsMetadata", fedora.DsInfo{}, []byte(restrictedRights))
+	tf.Set("test:mid", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:mid", "rel:isMemberOfCollection", "test:top"))
+	tf.Set("test:item", "content", fedora.DsInfo{}, []byte("member"))
+	tf.Set("test:item", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:item", "rel:isMemberOfCollection", "test:mid"))
+	// an item with rights of its own keeps them
+	tf.Set("test:0123", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:0123", "rel:isMemberOfCollection", "test:top"))
+
+	staff := func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "someone")
+		r.Header.Set("X-Remote-Groups", "staff")
+	}
+	checkRouteX(t, "GET", ts.URL+"/item", 403, "", staff)
+	ha.CollectionDepth = 1
+	checkRouteX(t, "GET", ts.URL+"/item", 403, "", staff)
+	ha.CollectionDepth = 2
+	checkRouteX(t, "GET", ts.URL+"/item", 200, "member", staff)
+	checkRoute(t, "GET", ts.URL+"/item", 403, "")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+
+	// a cycle ends the search
+	tf.Set("test:top", "RELS-EXT", fedora.DsInfo{}, relsExtFor("test:top", "rel:isMemberOfCollection", "test:item"))
+	ha.CollectionDepth = 10
+	checkRoute(t, "GET", ts.URL+"/item", 403, "")
+}
+
+func TestZipAuth(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	setupAuth(dh)
+
+	// the restricted items are left out
+	route := ts.URL + "/0123/zip/0123,123,abc"
+	_, body := checkRouteX(t, "GET", route, 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Comment != "CurateND:0123" {
+		t.Errorf("Expected only the open item in the zip")
+	}
+	resp, _ := checkRouteX(t, "HEAD", route, 200, "", nil)
+	if n := resp.Header.Get("X-Zip-Skipped"); n != "2" {
+		t.Errorf("Expected 2 skipped, got %q", n)
+	}
+
+	dh.ZipStrict = true
+	checkRouteX(t, "GET", route, 403, "", nil)
+	checkRouteX(t, "GET", ts.URL+"/0123/tar/0123,missing", 200, "", nil)
+	checkRouteX(t, "GET", route, 200, "", func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "owner")
+	})
+}
+
+// denyAuth refuses every download.
+type denyAuth struct{}
+
+func (denyAuth) Check(d Download, r *http.Request) error {
+	return ErrDenied
+}
+
+func TestAuthRoutes(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Thumbnails = &Thumbnailer{Sizes: []int{100}}
+	dh.Auth = denyAuth{}
+
+	var table = []struct {
+		route  string
+		status int
+	}{
+		{"/0123", 403},
+		{"/0123/about", 403},
+		{"/0123/checksum", 403},
+		{"/0123/checksum?verify=true", 403},
+		{"/0123/thumbnail", 403},
+	}
+	for _, test := range table {
+		checkRoute(t, "GET", ts.URL+test.route, test.status, "")
+	}
+
+	setupAuth(dh)
+	checkRoute(t, "GET", ts.URL+"/0123/about", 200, "")
+	checkRoute(t, "GET", ts.URL+"/123/checksum", 403, "")
+}
@@ -0,0 +1,163 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A BearerAuth identifies scripted clients, such as harvesters, by the
+// token in an "Authorization: Bearer" header, so they can download
+// restricted items without a browser session. Tokens are looked up in
+// Tokens, and failing that, if Introspect is set, checked with an OAuth 2
+// token introspection endpoint (RFC 7662), whose answers are remembered
+// in Verdicts, if it is set, until the token expires. Tokens must name a
+// user, by their username or subject; those which do not, such as tokens
+// of the client credentials grant, are not valid.
+//
+// As an Auth it allows anyone with a valid token. A HydraAuth may instead
+// use it to learn who the user is.
+type BearerAuth struct {
+	Tokens map[string]string // from token to user
+
+	Introspect string
+	Credential Credential   // to call Introspect with. Optional.
+	Client     *http.Client // to call Introspect with. nil means http.DefaultClient
+	Verdicts   *TimeCache
+
+	// Query also accepts the token in the token query parameter, for
+	// clients which cannot set headers. Such URLs end up in logs and
+	// browser histories, so this is off unless asked for.
+	Query bool
+}
+
+// ParseBearerToken parses an entry of the form "user token".
+func ParseBearerToken(s string) (user, token string, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("bearer token: expected a user and a token")
+	}
+	return fields[0], fields[1], nil
+}
+
+// Check allows requests with a valid token.
+func (ba *BearerAuth) Check(d Download, r *http.Request) error {
+	_, ok, err := ba.User(r)
+	if err == nil && !ok {
+		err = ErrUnauthenticated
+	}
+	return err
+}
+
+// User returns the user the token of r belongs to, and notes them on r for
+// RequestUser. It is false if r has no token. A token which is not valid
+// gives ErrUnauthenticated.
+func (ba *BearerAuth) User(r *http.Request) (string, bool, error) {
+	user, ok, err := ba.user(r)
+	if ok {
+		noteUser(r, user)
+	}
+	return user, ok, err
+}
+
+func (ba *BearerAuth) user(r *http.Request) (string, bool, error) {
+	token := bearerToken(r)
+	if token == "" && ba.Query {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return "", false, nil
+	}
+	if user, ok := ba.Tokens[token]; ok {
+		return user, true, nil
+	}
+	if ba.Introspect == "" {
+		return "", false, ErrUnauthenticated
+	}
+	if v, ok := ba.Verdicts.Get(token); ok {
+		if v.(string) == "" {
+			return "", false, ErrUnauthenticated
+		}
+		return v.(string), true, nil
+	}
+	user, expires, err := ba.introspect(r, token)
+	if err != nil {
+		return "", false, err
+	}
+	ba.Verdicts.SetUntil(token, user, expires)
+	if user == "" {
+		return "", false, ErrUnauthenticated
+	}
+	return user, true, nil
+}
+
+// bearerToken returns the token in the Authorization header of r, if it
+// has one.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// introspect asks the introspection endpoint about token, and returns the
+// user it belongs to, or "" if it is not active or names no one, and when
+// it expires, if it says.
+func (ba *BearerAuth) introspect(r *http.Request, token string) (string, time.Time, error) {
+	var expires time.Time
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ba.Introspect, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", expires, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ba.Credential != nil {
+		err = ba.Credential.Authorize(req)
+		if err != nil {
+			return "", expires, err
+		}
+	}
+	client := ba.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", expires, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", expires, fmt.Errorf("token introspection: %s", resp.Status)
+	}
+	var result struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+		Subject  string `json:"sub"`
+		Expires  int64  `json:"exp"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", expires, fmt.Errorf("token introspection: %s", err)
+	}
+	if !result.Active {
+		// an inactive token never becomes active again
+		return "", expires, nil
+	}
+	if result.Expires > 0 {
+		expires = time.Unix(result.Expires, 0)
+	}
+	if result.Username != "" {
+		return result.Username, expires, nil
+	}
+	// an active token which names no one, such as one a client got for
+	// itself, is not valid, since it would count as a registered user
+	return result.Subject, expires, nil
+}
@@ -0,0 +1,123 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBearerAuth(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	calls := 0
+	introspect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.FormValue("token") {
+		case "remote":
+			fmt.Fprint(w, `{"active":true,"username":"someone","sub":"123"}`)
+		case "client":
+			fmt.Fprint(w, `{"active":true,"client_id":"harvester"}`)
+		case "expiring":
+			fmt.Fprintf(w, `{"active":true,"sub":"123","exp":%d}`, time.Now().Unix()-1)
+		default:
+			fmt.Fprint(w, `{"active":false}`)
+		}
+	}))
+	defer introspect.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	setupAuth(dh)
+	bearer := &BearerAuth{
+		Tokens:     map[string]string{"secret": "owner"},
+		Introspect: introspect.URL,
+		Credential: BearerToken{Token: "client-secret"},
+		Client:     introspect.Client(),
+		Verdicts:   NewTimeCache(time.Minute),
+	}
+	dh.Auth.(*HydraAuth).Tokens = bearer
+
+	token := func(tok string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+	}
+	var table = []struct {
+		route  string
+		setup  func(*http.Request)
+		status int
+	}{
+		{"/123", nil, 403},
+		{"/123", token("secret"), 200}, // owner may edit
+		{"/abc", token("remote"), 403}, // under embargo
+		{"/0123", token("remote"), 200},
+		{"/0123", token("expired"), 401},
+		{"/0123?token=secret", nil, 200}, // query tokens are off, but the item is open
+		{"/123?token=secret", nil, 403},
+	}
+	for _, test := range table {
+		checkRouteX(t, "GET", ts.URL+test.route, test.status, "", test.setup)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 introspection calls, got %d", calls)
+	}
+	checkRouteX(t, "GET", ts.URL+"/0123", 200, "", token("remote"))
+	if calls != 2 {
+		t.Errorf("Expected the introspection to be remembered")
+	}
+
+	// tokens naming no one are not valid
+	checkRouteX(t, "GET", ts.URL+"/0123", 401, "", token("client"))
+	// and verdicts are not kept past the token's expiry
+	calls = 0
+	for i := 0; i < 2; i++ {
+		checkRouteX(t, "GET", ts.URL+"/0123", 200, "", token("expiring"))
+	}
+	if calls != 2 {
+		t.Errorf("Expected the expired verdict to be forgotten, got %d calls", calls)
+	}
+
+	bearer.Query = true
+	checkRouteX(t, "GET", ts.URL+"/123?token=secret", 200, "", nil)
+
+	// only the listed identities are used
+	staff := func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "someone")
+		r.Header.Set("X-Remote-Groups", "staff")
+		r.Header.Set("Authorization", "Bearer secret")
+	}
+	ha := dh.Auth.(*HydraAuth)
+	checkRouteX(t, "GET", ts.URL+"/abc", 200, "", staff) // the token's owner
+	ha.Identity = []string{"header", "bearer"}
+	checkRouteX(t, "GET", ts.URL+"/abc", 403, "", staff) // someone, under embargo
+	ha.Identity = []string{"header"}
+	checkRouteX(t, "GET", ts.URL+"/123", 403, "", token("secret")) // the token is ignored
+	ha.Identity = nil
+
+	// with no rights, any valid token will do
+	dh.Auth = bearer
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/123", 401, "", nil)
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a WWW-Authenticate header")
+	}
+	checkRouteX(t, "GET", ts.URL+"/123", 200, "", token("remote"))
+
+	// the token's user is noted for logs and events
+	r := WithUser(httptest.NewRequest("GET", "/123", nil))
+	token("secret")(r)
+	if user := RequestUser(r, "", nil); user != "" {
+		t.Errorf("Expected no user before the check, got %q", user)
+	}
+	if err := bearer.Check(Download{Pid: "test:123"}, r); err != nil {
+		t.Fatal(err)
+	}
+	if user := RequestUser(r, "", nil); user != "owner" {
+		t.Errorf("Expected owner, got %q", user)
+	}
+}
@@ -0,0 +1,93 @@
+package download
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A CircuitBreaker tracks the health of an upstream service. After
+// Threshold consecutive failures the breaker opens, and requests are refused
+// without contacting the service until Cooldown has passed. After that a
+// single request is let through to test the service, and the rest are
+// still refused. If it succeeds the breaker closes, otherwise it opens for
+// another Cooldown. A trial which never reports back, such as one the
+// client abandoned, is given up on after a Cooldown, and another is let
+// through.
+//
+// The zero value never opens. It is safe to be used by multiple goroutines.
+type CircuitBreaker struct {
+	Threshold int           // consecutive failures before opening; 0 disables
+	Cooldown  time.Duration // how long to stay open
+
+	m          sync.Mutex
+	failures   int
+	openUntil  time.Time
+	trialUntil time.Time // while a trial request is in progress
+}
+
+// Allow returns true if a request may be sent to the service. If not, it
+// also returns how long until the breaker will let a request through.
+func (cb *CircuitBreaker) Allow() (bool, time.Duration) {
+	if cb == nil || cb.Threshold <= 0 {
+		return true, 0
+	}
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	if cb.failures < cb.Threshold {
+		return true, 0
+	}
+	now := time.Now()
+	if wait := cb.openUntil.Sub(now); wait > 0 {
+		return false, wait
+	}
+	if wait := cb.trialUntil.Sub(now); wait > 0 {
+		return false, wait
+	}
+	cb.trialUntil = now.Add(cb.Cooldown)
+	return true, 0
+}
+
+// Success records a successful request.
+func (cb *CircuitBreaker) Success() {
+	if cb == nil {
+		return
+	}
+	cb.m.Lock()
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+	cb.trialUntil = time.Time{}
+	cb.m.Unlock()
+}
+
+// Failure records a failed request.
+func (cb *CircuitBreaker) Failure() {
+	if cb == nil || cb.Threshold <= 0 {
+		return
+	}
+	cb.m.Lock()
+	cb.failures++
+	if cb.failures >= cb.Threshold {
+		cb.openUntil = time.Now().Add(cb.Cooldown)
+		cb.trialUntil = time.Time{}
+	}
+	cb.m.Unlock()
+}
+
+// An UnavailableError is returned when an upstream service is temporarily
+// unable to handle requests. RetryAfter is an estimate of when it will be
+// available again, or 0 if unknown. Staging is set when the service is
+// working, but the content is being restored from slow storage such as
+// tape.
+type UnavailableError struct {
+	Service    string
+	RetryAfter time.Duration
+	Staging    bool
+}
+
+func (e *UnavailableError) Error() string {
+	if e.Staging {
+		return fmt.Sprintf("%s is staging the content", e.Service)
+	}
+	return fmt.Sprintf("%s is unavailable", e.Service)
+}
@@ -0,0 +1,64 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &CircuitBreaker{Threshold: 2, Cooldown: 50 * time.Millisecond}
+	if ok, _ := cb.Allow(); !ok {
+		t.Fatalf("Expected new breaker to be closed")
+	}
+	cb.Failure()
+	if ok, _ := cb.Allow(); !ok {
+		t.Errorf("Expected breaker to be closed after one failure")
+	}
+	cb.Failure()
+	ok, wait := cb.Allow()
+	if ok || wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("Expected breaker to be open, got %v %v", ok, wait)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := cb.Allow(); !ok {
+		t.Errorf("Expected breaker to let a trial through after cooldown")
+	}
+	if ok, _ := cb.Allow(); ok {
+		t.Errorf("Expected breaker to refuse others during the trial")
+	}
+	// trial fails, so it opens again
+	cb.Failure()
+	if ok, _ := cb.Allow(); ok {
+		t.Errorf("Expected breaker to reopen after failed trial")
+	}
+	time.Sleep(60 * time.Millisecond)
+	cb.Allow()
+	cb.Success()
+	for i := 0; i < 2; i++ {
+		if ok, _ := cb.Allow(); !ok {
+			t.Errorf("Expected breaker to close after success")
+		}
+	}
+
+	// a trial which never reports back is given up on
+	cb.Failure()
+	cb.Failure()
+	time.Sleep(60 * time.Millisecond)
+	cb.Allow()
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := cb.Allow(); !ok {
+		t.Errorf("Expected breaker to let another trial through")
+	}
+
+	// nil and zero breakers never open
+	var nilcb *CircuitBreaker
+	nilcb.Failure()
+	if ok, _ := nilcb.Allow(); !ok {
+		t.Errorf("Expected nil breaker to be closed")
+	}
+	zero := &CircuitBreaker{}
+	zero.Failure()
+	if ok, _ := zero.Allow(); !ok {
+		t.Errorf("Expected zero breaker to be closed")
+	}
+}
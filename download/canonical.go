@@ -0,0 +1,94 @@
+package download
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// canonicalPath returns the canonical form of an escaped request path:
+// without empty segments, such as from a trailing or doubled slash, and
+// with the pid prefix in the case it is configured in. If LowercaseID is
+// set the identifier is also lower cased.
+func (dh *DownloadHandler) canonicalPath(escaped string) string {
+	var segments []string
+	for _, s := range strings.Split(escaped, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) == 0 {
+		return "/"
+	}
+	i := 0 // the segment holding the identifier
+	if dh.PrefixSegment && len(segments) > 1 {
+		if p, ok := dh.foldPrefix(segments[0] + ":"); ok {
+			segments[0] = strings.TrimSuffix(p, ":")
+			i = 1
+		}
+	}
+	id, err := url.PathUnescape(segments[i])
+	if err != nil {
+		return escaped
+	}
+	canonical := id
+	if i == 0 {
+		if p, ok := dh.foldPrefix(id); ok {
+			canonical = p + id[len(p):]
+		}
+	}
+	if dh.LowercaseID {
+		prefix, rest := dh.splitPrefix(canonical)
+		if !strings.HasPrefix(canonical, prefix) {
+			prefix = ""
+		}
+		canonical = prefix + strings.ToLower(rest)
+	}
+	if canonical != id {
+		segments[i] = url.PathEscape(canonical)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// foldPrefix finds the configured prefix which s starts with, ignoring
+// case.
+func (dh *DownloadHandler) foldPrefix(s string) (string, bool) {
+	best := ""
+	for _, p := range append([]string{dh.Prefix}, dh.Prefixes...) {
+		if p != "" && len(p) > len(best) && len(s) >= len(p) && strings.EqualFold(s[:len(p)], p) {
+			best = p
+		}
+	}
+	return best, best != ""
+}
+
+// redirectCanonical redirects the request to the canonical form of its
+// path, returning true if it did. Only the part of the path the handler
+// sees is rewritten, so the redirect stays under any mount point removed
+// before it, such as by http.StripPrefix.
+func (dh *DownloadHandler) redirectCanonical(w http.ResponseWriter, r *http.Request) bool {
+	escaped := r.URL.EscapedPath()
+	canonical := dh.canonicalPath(escaped)
+	if !strings.HasPrefix(escaped, "/") {
+		canonical = strings.TrimPrefix(canonical, "/")
+	}
+	if canonical == escaped {
+		return false
+	}
+	requested := r.RequestURI
+	if i := strings.IndexByte(requested, '?'); i >= 0 {
+		requested = requested[:i]
+	}
+	if requested != "" {
+		if !strings.HasSuffix(requested, escaped) {
+			// we cannot tell where the mount point ends
+			return false
+		}
+		canonical = requested[:len(requested)-len(escaped)] + canonical
+	}
+	if r.URL.RawQuery != "" {
+		canonical += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, canonical, http.StatusMovedPermanently)
+	return true
+}
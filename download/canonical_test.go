@@ -0,0 +1,95 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	dh := &DownloadHandler{
+		Prefix:   "test:",
+		Prefixes: []string{"temp:"},
+	}
+	var sequence = []struct {
+		path      string
+		canonical string
+	}{
+		{"/", "/"},
+		{"/0123", "/0123"},
+		{"/0123/", "/0123"},
+		{"//0123//about/", "/0123/about"},
+		{"/TEST:0123", "/test:0123"},
+		{"/Temp:ABC/zip/a,b", "/temp:ABC/zip/a,b"},
+		{"/ABC", "/ABC"},
+		{"/a%2Fb/", "/a%2Fb"},
+	}
+	for _, s := range sequence {
+		if c := dh.canonicalPath(s.path); c != s.canonical {
+			t.Errorf("%s: Expected %s, got %s", s.path, s.canonical, c)
+		}
+	}
+
+	dh.LowercaseID = true
+	dh.PrefixSegment = true
+	var lowered = []struct {
+		path      string
+		canonical string
+	}{
+		{"/ABC", "/abc"},
+		{"/TEMP:ABC", "/temp:abc"},
+		{"/TEMP/ABC/about", "/temp/abc/about"},
+		{"/other/ABC", "/other/ABC"},
+	}
+	for _, s := range lowered {
+		if c := dh.canonicalPath(s.path); c != s.canonical {
+			t.Errorf("%s: Expected %s, got %s", s.path, s.canonical, c)
+		}
+	}
+}
+
+func TestCanonicalRedirect(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	// without Canonical every form is served
+	checkRoute(t, "GET", ts.URL+"/0123/", 200, "hello")
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Canonical = true
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"//TEST:0123/?datastream_id=x", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 301 {
+		t.Errorf("Expected status 301, got %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/test:0123?datastream_id=x" {
+		t.Errorf("Expected redirect to /test:0123?datastream_id=x, got %q", loc)
+	}
+	checkRoute(t, "GET", ts.URL+"/0123/", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+
+	// the redirect stays under the mount point
+	for _, prefix := range []string{"/files", "/files/"} {
+		mounted := httptest.NewServer(http.StripPrefix(prefix, dh))
+		req, _ = http.NewRequest("GET", mounted.URL+"/files/TEST:0123/", nil)
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); loc != "/files/test:0123" {
+			t.Errorf("%s: Expected redirect to /files/test:0123, got %q", prefix, loc)
+		}
+		checkRoute(t, "GET", mounted.URL+"/files/test:0123", 200, "hello")
+		mounted.Close()
+	}
+}
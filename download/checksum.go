@@ -0,0 +1,105 @@
+package download
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// checksumInfo is the JSON returned by the checksum route. Stored holds
+// the checksums known for the datastream, by type (e.g. "MD5" or
+// "SHA-256"). When verification is requested, Computed holds the checksums
+// of the content as it is streamed, and Valid is whether every stored
+// checksum matches. Valid is omitted when there is nothing to compare.
+type checksumInfo struct {
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Stored   map[string]string `json:"stored"`
+	Computed map[string]string `json:"computed,omitempty"`
+	Valid    *bool             `json:"valid,omitempty"`
+}
+
+// checksum replies with the stored checksums for the datastream of pid.
+// If the query parameter verify is true, the content is read and the
+// checksums are computed and compared. The content caches are bypassed
+// when verifying.
+func (dh *DownloadHandler) checksum(pid string, w http.ResponseWriter, r *http.Request) {
+	if !dh.authorized(Download{Pid: pid, Ds: dh.Ds}, w, r) {
+		return
+	}
+	src, dsinfo, ok := dh.datastreamInfo(pid, w, r)
+	if !ok {
+		return
+	}
+	result := checksumInfo{
+		ID:      pid,
+		Version: dsinfo.VersionID,
+		Stored:  make(map[string]string),
+	}
+	if dsinfo.Checksum != "" && dsinfo.ChecksumType != "" {
+		result.Stored[dsinfo.ChecksumType] = strings.ToLower(dsinfo.Checksum)
+	}
+	if r.FormValue("verify") != "true" {
+		writeJSON(w, result)
+		return
+	}
+	w, done, ok := dh.runHooks(Download{Pid: pid, Ds: src.Ds, DsInfo: dsinfo}, w, r)
+	defer done()
+	if !ok {
+		return
+	}
+
+	content, info, err := src.getContent(r.Context(), pid, dsinfo)
+	if err != nil {
+		writeContentError(w, r, err)
+		return
+	}
+	defer content.Close()
+	// checksums from the content supplier are only used when fedora does
+	// not have its own of that type
+	if _, ok := result.Stored["MD5"]; !ok && info.MD5 != "" {
+		result.Stored["MD5"] = strings.ToLower(info.MD5)
+	}
+	if _, ok := result.Stored["SHA-256"]; !ok && info.SHA256 != "" {
+		result.Stored["SHA-256"] = strings.ToLower(info.SHA256)
+	}
+
+	// always compute MD5 and SHA-256, and anything else that is stored
+	hashes := map[string]hash.Hash{
+		"MD5":     newHash("MD5"),
+		"SHA-256": newHash("SHA-256"),
+	}
+	for kind := range result.Stored {
+		if h := newHash(kind); h != nil {
+			hashes[kind] = h
+		}
+	}
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	_, err = CopyBuffer(io.MultiWriter(writers...), content)
+	if err != nil {
+		writeContentError(w, r, err)
+		return
+	}
+
+	result.Computed = make(map[string]string)
+	for kind, h := range hashes {
+		result.Computed[kind] = hex.EncodeToString(h.Sum(nil))
+	}
+	// stored checksums of an unsupported type are not compared
+	valid, compared := true, false
+	for kind, sum := range result.Stored {
+		if computed, ok := result.Computed[kind]; ok {
+			compared = true
+			valid = valid && computed == sum
+		}
+	}
+	if compared {
+		result.Valid = &valid
+	}
+	writeJSON(w, result)
+}
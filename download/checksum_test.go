@@ -0,0 +1,53 @@
+package download
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestChecksum(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	// md5 of "hello"
+	tf.Set("test:good", "content",
+		fedora.DsInfo{Checksum: "5D41402ABC4B2A76B9719D911017C592", ChecksumType: "MD5"},
+		[]byte("hello"))
+	tf.Set("test:bad", "content",
+		fedora.DsInfo{Checksum: "00000000000000000000000000000000", ChecksumType: "MD5"},
+		[]byte("hello"))
+
+	var table = []struct {
+		route  string
+		stored string
+		valid  *bool
+	}{
+		{"/good/checksum", "5d41402abc4b2a76b9719d911017c592", nil},
+		{"/good/checksum?verify=true", "5d41402abc4b2a76b9719d911017c592", &[]bool{true}[0]},
+		{"/bad/checksum?verify=true", "00000000000000000000000000000000", &[]bool{false}[0]},
+		{"/0123/checksum?verify=true", "", nil},
+	}
+	for _, s := range table {
+		_, body := checkRouteX(t, "GET", ts.URL+s.route, 200, "", nil)
+		var result checksumInfo
+		err := json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatal(s.route, err)
+		}
+		if result.Stored["MD5"] != s.stored {
+			t.Errorf("%s: Expected stored %s, got %v", s.route, s.stored, result.Stored)
+		}
+		if (result.Valid == nil) != (s.valid == nil) ||
+			(s.valid != nil && *result.Valid != *s.valid) {
+			t.Errorf("%s: Expected valid %v, got %v", s.route, s.valid, result.Valid)
+		}
+		if s.valid != nil && result.Computed["SHA-256"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+			t.Errorf("%s: Bad SHA-256 %v", s.route, result.Computed)
+		}
+	}
+	checkRoute(t, "GET", ts.URL+"/missing/checksum", 404, "")
+}
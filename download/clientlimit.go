@@ -0,0 +1,85 @@
+package download
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A ClientLimit limits how many requests each client may have in progress
+// at once, however slowly it makes them, so a few download managers each
+// opening dozens of connections cannot starve everyone else. Requests
+// over the limit receive a 429 error. One limit is shared by every
+// handler.
+//
+// Clients are told apart by address, as for a RateLimiter, or by user if
+// UserHeader is set and a Trusted proxy sent it, so users behind a shared
+// proxy are not limited together. The header is ignored from anyone else,
+// so a client cannot dodge its limit by naming a new user each time.
+// Clients in Allow are never limited.
+//
+// Use NewClientLimit to make one. It is safe to be used by multiple
+// goroutines.
+type ClientLimit struct {
+	Max        int
+	Allow      []*net.IPNet
+	Trusted    []*net.IPNet
+	UserHeader string
+
+	m      sync.Mutex
+	active map[string]int // requests in progress, by client
+}
+
+// NewClientLimit returns a limit of max requests at once for each client.
+func NewClientLimit(max int) *ClientLimit {
+	return &ClientLimit{
+		Max:    max,
+		active: make(map[string]int),
+	}
+}
+
+// Wrap returns a handler which applies the limit before calling h.
+func (cl *ClientLimit) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, cl.Trusted)
+		if ip != nil && contains(cl.Allow, ip) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var key string
+		if user := TrustedHeader(r, cl.UserHeader, cl.Trusted); user != "" {
+			key = "user:" + user
+		} else if ip != nil {
+			key = ip.String()
+		}
+		if !cl.acquire(key) {
+			writeRetry(w, http.StatusTooManyRequests, time.Second)
+			return
+		}
+		defer cl.release(key)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acquire counts a request for key, unless it would be over the limit.
+func (cl *ClientLimit) acquire(key string) bool {
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	if cl.active[key] >= cl.Max {
+		return false
+	}
+	cl.active[key]++
+	return true
+}
+
+// release counts the end of a request for key. Clients with nothing in
+// progress are forgotten.
+func (cl *ClientLimit) release(key string) {
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	cl.active[key]--
+	if cl.active[key] <= 0 {
+		delete(cl.active, key)
+	}
+}
@@ -0,0 +1,87 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestClientLimit(t *testing.T) {
+	cl := NewClientLimit(2)
+	cl.UserHeader = "X-Remote-User"
+	var err error
+	cl.Allow, err = ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.Trusted, err = ParseCIDRs([]string{"192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	h := cl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+	get := func(remote, realip, user string) int {
+		r := httptest.NewRequest("GET", "/0123", nil)
+		r.RemoteAddr = remote
+		if realip != "" {
+			r.Header.Set("X-Real-IP", realip)
+		}
+		if user != "" {
+			r.Header.Set("X-Remote-User", user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// hold open two requests each from an address and from users behind
+	// the proxy, and more from an allowed address
+	var done sync.WaitGroup
+	hold := func(remote, realip, user string) {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			if code := get(remote, realip, user); code != 200 {
+				t.Errorf("Expected 200 for %s, got %d", remote, code)
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		hold("1.2.3.4:1000", "", "")
+		hold("192.168.1.1:1000", "5.6.7.8", "alice")
+		hold("192.168.1.1:1000", "5.6.7.8", "bob")
+	}
+	for i := 0; i < 3; i++ {
+		hold("10.1.1.1:1000", "", "")
+	}
+	started.Wait()
+
+	var table = []struct {
+		remote, realip, user string
+		status               int
+	}{
+		{"1.2.3.4:1001", "", "", 429},
+		{"192.168.1.1:1001", "5.6.7.8", "alice", 429},
+		{"192.168.1.1:1001", "5.6.7.8", "bob", 429},
+		// only the proxy is believed about users
+		{"1.2.3.4:1001", "", "carol", 429},
+	}
+	for _, test := range table {
+		if code := get(test.remote, test.realip, test.user); code != test.status {
+			t.Errorf("%s %s: expected %d, got %d", test.remote, test.user, test.status, code)
+		}
+	}
+	close(release)
+	done.Wait()
+
+	// the slots are given back
+	if len(cl.active) != 0 {
+		t.Errorf("Expected no requests in progress, got %v", cl.active)
+	}
+}
@@ -0,0 +1,48 @@
+package download
+
+import (
+	"sync"
+)
+
+// A flightGroup coalesces concurrent fetches of the same item. The first
+// caller for a key becomes the leader and does the fetch. Later callers
+// wait until the leader is finished, and then look for the item in the
+// cache the leader was filling.
+//
+// The zero value is ready to use. It is safe to be used by multiple
+// goroutines. The lock is shared by every group, so that handlers holding
+// one can be copied.
+type flightGroup struct {
+	calls map[string]chan struct{}
+}
+
+// flightLock guards the calls of every flightGroup.
+var flightLock sync.Mutex
+
+// Begin starts a fetch for key. If there is no fetch in progress, leader is
+// true and the caller must call End when finished. Otherwise, the returned
+// channel is closed when the leader is finished.
+func (g *flightGroup) Begin(key string) (done <-chan struct{}, leader bool) {
+	flightLock.Lock()
+	defer flightLock.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]chan struct{})
+	}
+	c := make(chan struct{})
+	g.calls[key] = c
+	return c, true
+}
+
+// End finishes the fetch for key, releasing any waiters.
+func (g *flightGroup) End(key string) {
+	flightLock.Lock()
+	c := g.calls[key]
+	delete(g.calls, key)
+	flightLock.Unlock()
+	if c != nil {
+		close(c)
+	}
+}
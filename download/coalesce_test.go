@@ -0,0 +1,121 @@
+package download
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// slowFedora wraps a Fedora, counting and delaying content requests.
+type slowFedora struct {
+	fedora.Fedora
+	delay time.Duration
+	count int32
+}
+
+func (sf *slowFedora) GetDatastream(id, dsname string) (io.ReadCloser, fedora.ContentInfo, error) {
+	atomic.AddInt32(&sf.count, 1)
+	time.Sleep(sf.delay)
+	return sf.Fedora.GetDatastream(id, dsname)
+}
+
+func TestCoalesce(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	sf := &slowFedora{Fedora: dh.Fedora, delay: 50 * time.Millisecond}
+	dh.Fedora = sf
+	dh.Cache = NewMemoryCache(1000, 100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRoute(t, "GET", ts.URL+"/abc", 200, "a longer string")
+		}()
+	}
+	wg.Wait()
+	if sf.count != 1 {
+		t.Errorf("Expected 1 fetch from fedora, got %d", sf.count)
+	}
+}
+
+// heldSource counts the items opened, and holds back their content until
+// release is closed.
+type heldSource struct {
+	opened  chan string
+	release chan struct{}
+}
+
+func (hs *heldSource) Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	hs.opened <- pid
+	return heldReader{hs.release, strings.NewReader("a longer string")}, fedora.ContentInfo{Length: "15"}, nil
+}
+
+type heldReader struct {
+	release chan struct{}
+	io.Reader
+}
+
+func (hr heldReader) Read(p []byte) (int, error) {
+	<-hr.release
+	return hr.Reader.Read(p)
+}
+
+func (hr heldReader) Close() error { return nil }
+
+func TestCoalesceUncacheable(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	hs := &heldSource{opened: make(chan string, 2), release: make(chan struct{})}
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Sources = []ContentSource{hs}
+	dh.Cache = NewMemoryCache(1000, 10) // too small for the item
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRoute(t, "GET", ts.URL+"/abc", 200, "a longer string")
+		}()
+	}
+	// neither waits for the other
+	for i := 0; i < 2; i++ {
+		select {
+		case <-hs.opened:
+		case <-time.After(5 * time.Second):
+			close(hs.release)
+			t.Fatalf("Expected 2 concurrent fetches, got %d", i)
+		}
+	}
+	close(hs.release)
+	wg.Wait()
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	_, leader := g.Begin("a")
+	if !leader {
+		t.Fatalf("Expected first caller to be leader")
+	}
+	done, leader := g.Begin("a")
+	if leader {
+		t.Fatalf("Expected second caller to not be leader")
+	}
+	g.End("a")
+	<-done
+	_, leader = g.Begin("a")
+	if !leader {
+		t.Errorf("Expected caller after End to be leader")
+	}
+}
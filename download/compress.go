@@ -0,0 +1,69 @@
+package download
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressible returns true if content of the given MIME type should be
+// compressed when the client accepts it. Entries in CompressTypes may be a
+// full type, such as "text/csv", or a wildcard, such as "text/*".
+func (dh *DownloadHandler) compressible(mimetype string) bool {
+	return matchType(dh.CompressTypes, mimetype)
+}
+
+// matchType returns true if the MIME type matches one of the patterns,
+// which may be a full type, a wildcard such as "text/*", or "*/*".
+func matchType(patterns []string, mimetype string) bool {
+	t, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == t || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(t, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding returns true if the request's Accept-Encoding header
+// allows the given content coding with a non-zero quality.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name != coding && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// writeGzip copies content to w, compressing it with gzip.
+func writeGzip(w io.Writer, content io.Reader) error {
+	gz := gzip.NewWriter(w)
+	_, err := CopyBuffer(gz, content)
+	cerr := gz.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
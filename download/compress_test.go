@@ -0,0 +1,62 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestCompress(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.CompressTypes = []string{"text/*", "application/json"}
+	dh.Fedora.(*fedora.TestFedora).Set("test:csv",
+		"content",
+		fedora.DsInfo{MIMEType: "text/csv; charset=utf-8"},
+		[]byte("a,b,c\n1,2,3\n"))
+
+	// the client does not accept gzip
+	r, _ := checkRouteX(t, "GET", ts.URL+"/csv", 200, "a,b,c\n1,2,3\n", func(req *http.Request) {
+		req.Header.Set("Accept-Encoding", "identity")
+	})
+	if r.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary header, got %q", r.Header.Get("Vary"))
+	}
+
+	r, body := checkRouteX(t, "GET", ts.URL+"/csv", 200, "", func(req *http.Request) {
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.5")
+	})
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", r.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gz)
+	if string(b) != "a,b,c\n1,2,3\n" {
+		t.Errorf("Received %q", b)
+	}
+
+	// gzip explicitly refused
+	r, _ = checkRouteX(t, "GET", ts.URL+"/csv", 200, "a,b,c\n1,2,3\n", func(req *http.Request) {
+		req.Header.Set("Accept-Encoding", "gzip;q=0")
+	})
+	if r.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected no encoding, got %q", r.Header.Get("Content-Encoding"))
+	}
+
+	// types not listed are never compressed
+	r, _ = checkRouteX(t, "GET", ts.URL+"/redirect", 200, "", func(req *http.Request) {
+		req.Header.Set("Accept-Encoding", "gzip")
+	})
+	if r.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected no encoding for audio, got %q", r.Header.Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,59 @@
+package download
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// copyBufPool holds the buffers used by CopyBuffer, so that high volume
+// handlers do not allocate a new buffer for every download.
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// CopyBuffer is like io.Copy, but uses a pooled buffer. As with io.Copy, if
+// src implements io.WriterTo or dst implements io.ReaderFrom, no buffer is
+// used. In particular, copying an *os.File to an http.ResponseWriter will use
+// sendfile(2) where it is available.
+func CopyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBufPool.Get().(*[]byte)
+	n, err := io.CopyBuffer(dst, src, *bp)
+	copyBufPool.Put(bp)
+	return n, err
+}
+
+// readSeekNopCloser adds a no-op Close method to an io.ReadSeeker.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+// closeOnDone closes rc when ctx is done, so that a blocked upstream read
+// is abandoned as soon as the client goes away.
+func closeOnDone(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	cc := &ctxCloser{ReadCloser: rc}
+	cc.stop = context.AfterFunc(ctx, cc.close)
+	return cc
+}
+
+type ctxCloser struct {
+	io.ReadCloser
+	stop func() bool
+	once sync.Once
+	err  error
+}
+
+func (cc *ctxCloser) Close() error {
+	cc.stop()
+	cc.close()
+	return cc.err
+}
+
+func (cc *ctxCloser) close() {
+	cc.once.Do(func() { cc.err = cc.ReadCloser.Close() })
+}
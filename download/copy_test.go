@@ -0,0 +1,41 @@
+package download
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closeRecorder notes when it is closed.
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (cr *closeRecorder) Close() error {
+	close(cr.closed)
+	return nil
+}
+
+func TestCloseOnDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cr := &closeRecorder{Reader: strings.NewReader("abc"), closed: make(chan struct{})}
+	rc := closeOnDone(ctx, cr)
+	cancel()
+	select {
+	case <-cr.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected reader to be closed when context is canceled")
+	}
+	// closing again does not close the reader twice
+	rc.Close()
+
+	// closing before cancel works as usual
+	ctx, cancel = context.WithCancel(context.Background())
+	cr = &closeRecorder{Reader: strings.NewReader("abc"), closed: make(chan struct{})}
+	rc = closeOnDone(ctx, cr)
+	rc.Close()
+	cancel()
+}
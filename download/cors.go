@@ -0,0 +1,155 @@
+package download
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A CORS wraps a handler to allow cross-origin requests from web pages on
+// other sites, such as viewers embedded in other applications. Requests
+// from origins not in Origins are passed through without any CORS
+// headers, so the browser blocks them. Preflight requests are answered
+// directly.
+type CORS struct {
+	Handler http.Handler
+
+	// Origins lists the allowed origins, e.g. "https://curate.nd.edu".
+	// The entry "*" allows every origin.
+	Origins []string
+
+	// Methods are the allowed methods. Defaults to GET and HEAD.
+	Methods []string
+
+	// Expose lists the response headers scripts may read, e.g.
+	// "Content-Range".
+	Expose []string
+
+	// Credentials allows requests with cookies from the origins listed by
+	// name. Origins only allowed through "*" never get credentials, since
+	// any site could then read what a signed in user may download.
+	Credentials bool
+
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+func (c *CORS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && c.allowed(origin)
+	credentials := c.Credentials && origin != "" && c.listed(origin)
+	h := w.Header()
+	if !c.wildcard() || c.Credentials {
+		// the response depends on the origin
+		addVary(h, "Origin")
+	}
+	if allowed {
+		if credentials || !c.wildcard() {
+			h.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+		if credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(c.Expose) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.Expose, ", "))
+		}
+	}
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		c.preflight(w, r, allowed)
+		return
+	}
+	c.Handler.ServeHTTP(w, r)
+}
+
+// preflight answers a preflight request. A refused preflight gets no CORS
+// headers, which the browser treats as a refusal.
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, allowed bool) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !allowed || !c.allowedMethod(method) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	addVary(h, "Access-Control-Request-Method")
+	addVary(h, "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+	// allow whatever headers are asked for, such as Range
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) allowed(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// listed returns true if origin is allowed by name rather than by "*".
+func (c *CORS) listed(origin string) bool {
+	for _, o := range c.Origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) wildcard() bool {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methods() []string {
+	if len(c.Methods) == 0 {
+		return []string{"GET", "HEAD"}
+	}
+	return c.Methods
+}
+
+func (c *CORS) allowedMethod(method string) bool {
+	for _, m := range c.methods() {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMethods returns the methods to allow in cross-origin requests to a
+// handler serving the given methods. Unless others are configured these
+// are the handler's own methods, so preflights are not approved for
+// requests the handler would refuse. OPTIONS is left out since browsers
+// never ask for it.
+func corsMethods(configured, methods []string) []string {
+	if len(configured) > 0 {
+		return configured
+	}
+	var result []string
+	for _, m := range methods {
+		if m != "OPTIONS" {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// CORSMethods returns the methods to allow in cross-origin requests to
+// dh, given the configured ones, if any.
+func (dh *DownloadHandler) CORSMethods(configured []string) []string {
+	return corsMethods(configured, dh.methods())
+}
@@ -0,0 +1,73 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	ts := setupHandler()
+	ts.Close()
+	c := &CORS{
+		Handler: ts.Config.Handler,
+		Origins: []string{"https://viewer.example.edu"},
+		Expose:  []string{"Content-Range", "Content-Length"},
+		MaxAge:  10 * time.Minute,
+	}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	origin := func(o string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Origin", o) }
+	}
+	resp, _ := checkRouteX(t, "GET", server.URL+"/0123", 200, "hello", origin("https://viewer.example.edu"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://viewer.example.edu" {
+		t.Errorf("Expected allowed origin, got %v", resp.Header)
+	}
+	if resp.Header.Get("Access-Control-Expose-Headers") != "Content-Range, Content-Length" {
+		t.Errorf("Expected exposed headers, got %v", resp.Header)
+	}
+	resp, _ = checkRouteX(t, "GET", server.URL+"/0123", 200, "hello", origin("https://evil.example.com"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers, got %v", resp.Header)
+	}
+
+	preflight := func(o, method string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Origin", o)
+			r.Header.Set("Access-Control-Request-Method", method)
+			r.Header.Set("Access-Control-Request-Headers", "range")
+		}
+	}
+	resp, _ = checkRouteX(t, "OPTIONS", server.URL+"/0123", 204, "", preflight("https://viewer.example.edu", "GET"))
+	if resp.Header.Get("Access-Control-Allow-Methods") != "GET, HEAD" ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "range" ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Bad preflight response %v", resp.Header)
+	}
+	checkRouteX(t, "OPTIONS", server.URL+"/0123", 403, "", preflight("https://viewer.example.edu", "DELETE"))
+	checkRouteX(t, "OPTIONS", server.URL+"/0123", 403, "", preflight("https://evil.example.com", "GET"))
+	// not a preflight
+	checkRoute(t, "OPTIONS", server.URL+"/0123", 405, "")
+
+	// wildcards
+	c.Origins = []string{"*"}
+	resp, _ = checkRouteX(t, "GET", server.URL+"/0123", 200, "hello", origin("https://any.example.com"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected wildcard, got %v", resp.Header)
+	}
+	c.Credentials = true
+	resp, _ = checkRouteX(t, "GET", server.URL+"/0123", 200, "hello", origin("https://any.example.com"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Expected no credentials through a wildcard, got %v", resp.Header)
+	}
+	c.Origins = []string{"*", "https://viewer.example.edu"}
+	resp, _ = checkRouteX(t, "GET", server.URL+"/0123", 200, "hello", origin("https://viewer.example.edu"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://viewer.example.edu" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Expected echoed origin with credentials, got %v", resp.Header)
+	}
+}
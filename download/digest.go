@@ -0,0 +1,78 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// digestAlgorithms maps fedora checksum types to the names used in RFC 3230
+// Digest headers, in the order they are listed in a header.
+var digestAlgorithms = []struct {
+	checksum, digest string
+}{
+	{"MD5", "MD5"},
+	{"SHA-1", "SHA"},
+	{"SHA-256", "SHA-256"},
+	{"SHA-512", "SHA-512"},
+}
+
+// digestHeader returns the value of a Digest header for the known
+// checksums of the content, e.g. "MD5=XUFAKrxLKna5cZ2REBfFkg==", or ""
+// if there are none. Checksums from the content supplier are used along
+// with the one stored in fedora.
+func digestHeader(dsinfo fedora.DsInfo, info fedora.ContentInfo) string {
+	sums := map[string]string{
+		"MD5":     info.MD5,
+		"SHA-256": info.SHA256,
+	}
+	if dsinfo.Checksum != "" {
+		sums[dsinfo.ChecksumType] = dsinfo.Checksum
+	}
+	var digests []string
+	for _, a := range digestAlgorithms {
+		b, err := hex.DecodeString(sums[a.checksum])
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		digests = append(digests, a.digest+"="+base64.StdEncoding.EncodeToString(b))
+	}
+	return strings.Join(digests, ", ")
+}
+
+// digestWriter computes the SHA-256 digest of a response body as it is
+// written, and sends it in a Digest trailer. Use it for responses whose
+// checksum is not known in advance. Trailers are only sent with chunked
+// responses, so the response should not have a Content-Length.
+type digestWriter struct {
+	http.ResponseWriter
+	h hash.Hash
+}
+
+// newDigestWriter declares the trailer. It must be called before the
+// header is written.
+func newDigestWriter(w http.ResponseWriter) *digestWriter {
+	w.Header().Set("Trailer", "Digest")
+	return &digestWriter{ResponseWriter: w, h: sha256.New()}
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	dw.h.Write(p)
+	return dw.ResponseWriter.Write(p)
+}
+
+// Finish sets the trailer. Call it once the whole body has been written.
+func (dw *digestWriter) Finish() {
+	sum := base64.StdEncoding.EncodeToString(dw.h.Sum(nil))
+	dw.Header().Set("Digest", "SHA-256="+sum)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (dw *digestWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
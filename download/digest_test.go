@@ -0,0 +1,44 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestDigestHeader(t *testing.T) {
+	var table = []struct {
+		dsinfo fedora.DsInfo
+		info   fedora.ContentInfo
+		output string
+	}{
+		{fedora.DsInfo{}, fedora.ContentInfo{}, ""},
+		{fedora.DsInfo{Checksum: "5d41402abc4b2a76b9719d911017c592", ChecksumType: "MD5"},
+			fedora.ContentInfo{},
+			"MD5=XUFAKrxLKna5cZ2REBfFkg=="},
+		{fedora.DsInfo{Checksum: "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", ChecksumType: "SHA-1"},
+			fedora.ContentInfo{MD5: "5d41402abc4b2a76b9719d911017c592"},
+			"MD5=XUFAKrxLKna5cZ2REBfFkg==, SHA=qvTGHdzF6KLavt4PO0gs2a6pQ00="},
+		{fedora.DsInfo{Checksum: "nothex", ChecksumType: "MD5"}, fedora.ContentInfo{}, ""},
+	}
+	for _, s := range table {
+		if out := digestHeader(s.dsinfo, s.info); out != s.output {
+			t.Errorf("%v: expected %q, got %q", s.dsinfo, s.output, out)
+		}
+	}
+}
+
+func TestDigestTrailer(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	// badsize has no length and no checksum, so the digest is a trailer
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/badsize", 200, "hola", nil)
+	if resp.Header.Get("Digest") != "" {
+		t.Errorf("Expected no Digest header, got %q", resp.Header.Get("Digest"))
+	}
+	expected := "SHA-256=siHZ27CDp/M0KNfCo8MZiuklYU1wIQ4ocWzKp81N23k="
+	if resp.Trailer.Get("Digest") != expected {
+		t.Errorf("Expected Digest trailer %q, got %q", expected, resp.Trailer.Get("Digest"))
+	}
+}
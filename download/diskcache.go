@@ -0,0 +1,310 @@
+package download
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A DiskCache keeps copies of datastream content in a directory, so that
+// popular items do not need to be streamed from fedora or bendo on every
+// download. Files are evicted in least-recently-used order once the total
+// size of the cache would exceed MaxSize.
+//
+// Content is only added to the cache after it has been verified against a
+// checksum, either the one fedora has for the datastream or one supplied
+// by the external store. Keys should include the datastream version.
+//
+// A nil *DiskCache is a cache which is always empty. The implementation is
+// safe to be called by multiple goroutines.
+type DiskCache struct {
+	Root    string // the directory to keep files in
+	MaxSize int64  // total size of all files, in bytes
+
+	m     sync.Mutex
+	size  int64
+	lru   *list.List // of *diskEntry, most recently used at the front
+	items map[string]*list.Element
+}
+
+type diskEntry struct {
+	name string // file name inside Root
+	size int64
+}
+
+// prefix for files being written which have not been verified yet
+const diskTempPrefix = "tmp-"
+
+// NewDiskCache returns a cache using the given directory, creating it if
+// necessary. Files already in the directory are added to the cache.
+func NewDiskCache(root string, maxSize int64) (*DiskCache, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	dc := &DiskCache{
+		Root:    root,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	// add the oldest files first, so they are the first evicted
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), diskTempPrefix) {
+			// left over from an interrupted download
+			os.Remove(filepath.Join(root, fi.Name()))
+			continue
+		}
+		dc.add(fi.Name(), fi.Size())
+	}
+	return dc, nil
+}
+
+// diskName returns the file name to use for a key.
+func diskName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Open returns the cached file for key, if there is one, along with its
+// size. The file should be closed when finished.
+func (dc *DiskCache) Open(key string) (*os.File, int64, bool) {
+	if dc == nil {
+		return nil, 0, false
+	}
+	name := diskName(key)
+	dc.m.Lock()
+	e, ok := dc.items[name]
+	if ok {
+		dc.lru.MoveToFront(e)
+	}
+	dc.m.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	fname := filepath.Join(dc.Root, name)
+	f, err := os.Open(fname)
+	if err != nil {
+		log.Println("diskcache:", err)
+		return nil, 0, false
+	}
+	// remember the access across restarts
+	now := time.Now()
+	os.Chtimes(fname, now, now)
+	return f, e.Value.(*diskEntry).size, true
+}
+
+// add records a file which is in Root, evicting other files as needed.
+func (dc *DiskCache) add(name string, size int64) {
+	dc.m.Lock()
+	defer dc.m.Unlock()
+	if e, ok := dc.items[name]; ok {
+		dc.lru.Remove(e)
+		delete(dc.items, name)
+		dc.size -= e.Value.(*diskEntry).size
+	}
+	for dc.size+size > dc.MaxSize && dc.lru.Len() > 0 {
+		old := dc.lru.Remove(dc.lru.Back()).(*diskEntry)
+		delete(dc.items, old.name)
+		dc.size -= old.size
+		os.Remove(filepath.Join(dc.Root, old.name))
+	}
+	dc.items[name] = dc.lru.PushFront(&diskEntry{name: name, size: size})
+	dc.size += size
+}
+
+// Put adds data to the cache under key, for content made by disadis
+// itself, such as thumbnails, which has no checksum to verify.
+func (dc *DiskCache) Put(key string, data []byte) error {
+	if dc == nil || int64(len(data)) > dc.MaxSize {
+		return nil
+	}
+	f, err := ioutil.TempFile(dc.Root, diskTempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	name := diskName(key)
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dc.Root, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	dc.add(name, int64(len(data)))
+	return nil
+}
+
+// Filler wraps the content for key so that it is written to the cache as
+// it is read. Once the expected number of bytes has been read and the
+// checksum matches, the file is added to the cache. The content is returned
+// unchanged if it is not cacheable, such as when there is no checksum to
+// verify it with.
+func (dc *DiskCache) Filler(key string, dsinfo fedora.DsInfo, info fedora.ContentInfo, content io.ReadCloser) io.ReadCloser {
+	if dc == nil {
+		return content
+	}
+	n, err := strconv.ParseInt(info.Length, 10, 64)
+	if err != nil || n <= 0 || n > dc.MaxSize {
+		return content
+	}
+	h, expected := contentChecksum(dsinfo, info)
+	if h == nil {
+		return content
+	}
+	f, err := ioutil.TempFile(dc.Root, diskTempPrefix)
+	if err != nil {
+		log.Println("diskcache:", err)
+		return content
+	}
+	return &diskFiller{
+		ReadCloser: content,
+		cache:      dc,
+		name:       diskName(key),
+		f:          f,
+		h:          h,
+		checksum:   expected,
+		expect:     n,
+	}
+}
+
+// contentChecksum returns a hash and the hex encoded checksum the content
+// should have. The checksum stored in fedora is preferred over the ones
+// provided by the content supplier. It returns nil if there is no
+// checksum of a supported type.
+func contentChecksum(dsinfo fedora.DsInfo, info fedora.ContentInfo) (hash.Hash, string) {
+	if dsinfo.Checksum != "" {
+		if h := newHash(dsinfo.ChecksumType); h != nil {
+			return h, strings.ToLower(dsinfo.Checksum)
+		}
+	}
+	if info.SHA256 != "" {
+		return sha256.New(), strings.ToLower(info.SHA256)
+	}
+	if info.MD5 != "" {
+		return md5.New(), strings.ToLower(info.MD5)
+	}
+	return nil, ""
+}
+
+// newHash returns a hash for the given fedora checksum type, or nil if the
+// type is not supported.
+func newHash(kind string) hash.Hash {
+	switch kind {
+	case "MD5":
+		return md5.New()
+	case "SHA-1":
+		return sha1.New()
+	case "SHA-256":
+		return sha256.New()
+	case "SHA-384":
+		return sha512.New384()
+	case "SHA-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// diskFiller copies everything read from a stream into a temporary file.
+// The file is moved into the cache once the expected number of bytes has
+// been read and verified. Otherwise the file is removed on Close.
+type diskFiller struct {
+	io.ReadCloser
+	cache    *DiskCache
+	name     string
+	f        *os.File // nil once finished
+	h        hash.Hash
+	checksum string
+	expect   int64
+	n        int64
+}
+
+func (df *diskFiller) Read(p []byte) (int, error) {
+	n, err := df.ReadCloser.Read(p)
+	if df.f == nil {
+		return n, err
+	}
+	df.n += int64(n)
+	if df.n > df.expect {
+		// the stream is longer than advertised. Don't cache it.
+		df.abort()
+		return n, err
+	}
+	df.h.Write(p[:n])
+	_, werr := df.f.Write(p[:n])
+	if werr != nil {
+		log.Println("diskcache:", werr)
+		df.abort()
+		return n, err
+	}
+	if df.n == df.expect {
+		df.finish()
+	}
+	return n, err
+}
+
+// finish verifies the temporary file and moves it into the cache.
+func (df *diskFiller) finish() {
+	tmpname := df.f.Name()
+	err := df.f.Close()
+	df.f = nil
+	sum := hex.EncodeToString(df.h.Sum(nil))
+	if err == nil && sum != df.checksum {
+		log.Printf("diskcache: checksum mismatch for %s: expected %s, got %s", df.name, df.checksum, sum)
+		os.Remove(tmpname)
+		return
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filepath.Join(df.cache.Root, df.name))
+	}
+	if err != nil {
+		log.Println("diskcache:", err)
+		os.Remove(tmpname)
+		return
+	}
+	df.cache.add(df.name, df.n)
+}
+
+// abort removes the temporary file.
+func (df *diskFiller) abort() {
+	df.f.Close()
+	os.Remove(df.f.Name())
+	df.f = nil
+}
+
+func (df *diskFiller) Close() error {
+	if df.f != nil {
+		df.abort()
+	}
+	return df.ReadCloser.Close()
+}
@@ -0,0 +1,80 @@
+package download
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dc, err := NewDiskCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(key, content string, dsinfo fedora.DsInfo) {
+		info := fedora.ContentInfo{Length: "11"}
+		r := dc.Filler(key, dsinfo, info, ioutil.NopCloser(strings.NewReader(content)))
+		ioutil.ReadAll(r)
+		r.Close()
+	}
+	// md5 of "hello world"
+	good := fedora.DsInfo{Checksum: "5eb63bbbe01eeed093cb22bb8f5acdc3", ChecksumType: "MD5"}
+
+	fill("a", "hello world", good)
+	f, size, ok := dc.Open("a")
+	if !ok || size != 11 {
+		t.Fatalf("Expected a to be cached")
+	}
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(b) != "hello world" {
+		t.Errorf("Expected hello world, got %s", b)
+	}
+
+	// checksum mismatches are not cached
+	fill("b", "HELLO WORLD", good)
+	if _, _, ok := dc.Open("b"); ok {
+		t.Errorf("Expected b to not be cached")
+	}
+	// neither is content without a checksum
+	fill("c", "hello world", fedora.DsInfo{})
+	if _, _, ok := dc.Open("c"); ok {
+		t.Errorf("Expected c to not be cached")
+	}
+
+	// adding another evicts a
+	fill("d", "hello world", good)
+	if _, _, ok := dc.Open("a"); ok {
+		t.Errorf("Expected a to be evicted")
+	}
+
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected 1 file, found %d", len(files))
+	}
+
+	// a new cache picks up existing files
+	ioutil.WriteFile(filepath.Join(dir, diskTempPrefix+"xyz"), []byte("partial"), 0644)
+	dc, err = NewDiskCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := dc.Open("d"); !ok {
+		t.Errorf("Expected d to be in the reopened cache")
+	}
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected temporary files to be removed, found %d files", len(files))
+	}
+}
@@ -0,0 +1,127 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// the types which are served as attachments unless configured otherwise,
+// since a browser would run any scripts in them
+var defaultAttachmentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// the values of the Disposition setting
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// ParseDisposition checks a Disposition setting. The empty string means
+// DispositionInline.
+func ParseDisposition(s string) (string, error) {
+	switch s {
+	case "":
+		return DispositionInline, nil
+	case DispositionInline, DispositionAttachment:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown disposition %q", s)
+}
+
+// disposition returns the Content-Disposition type and the Content-Type to
+// use for a datastream of the given MIME type. Types in AttachmentTypes
+// are served as attachments, so browsers download them instead of
+// rendering them, as is everything if the handler's Disposition or the
+// request's disposition parameter is "attachment". A request may also ask
+// for "inline", but not for types in AttachmentTypes. Types in PlainTypes
+// are served as text/plain.
+func (dh *DownloadHandler) disposition(r *http.Request, mimetype string) (string, string) {
+	kind := DispositionInline
+	if dh.Disposition == DispositionAttachment {
+		kind = DispositionAttachment
+	}
+	switch r.FormValue("disposition") {
+	case DispositionInline:
+		kind = DispositionInline
+	case DispositionAttachment:
+		kind = DispositionAttachment
+	}
+	patterns := dh.AttachmentTypes
+	if patterns == nil {
+		patterns = defaultAttachmentTypes
+	}
+	if matchType(patterns, mimetype) {
+		kind = DispositionAttachment
+	}
+	if matchType(dh.PlainTypes, mimetype) {
+		mimetype = "text/plain"
+	}
+	return kind, mimetype
+}
+
+// sanitizeFilename removes anything from a requested filename which could
+// confuse a browser: directories, quotes, and control characters. It
+// returns "" if nothing usable is left.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// contentDisposition returns a Content-Disposition header of the given type
+// ("inline" or "attachment") for the filename. Names which are not plain
+// ASCII, or which have characters that cannot be quoted, are also given in
+// the RFC 6266 filename* form, with an ASCII fallback for old clients.
+func contentDisposition(kind, filename string) string {
+	if strings.IndexFunc(filename, unquotable) < 0 {
+		return kind + `; filename="` + filename + `"`
+	}
+	fallback := strings.Map(func(r rune) rune {
+		if unquotable(r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	return kind + `; filename="` + fallback + `"; filename*=UTF-8''` + encodeExtValue(filename)
+}
+
+// unquotable is true for the characters which cannot be put in the quoted
+// filename parameter.
+func unquotable(r rune) bool {
+	return r >= unicode.MaxASCII || r == '"' || r == '\\' || unicode.IsControl(r)
+}
+
+// encodeExtValue percent-encodes s as the value of an RFC 5987 extended
+// parameter, which allows fewer unescaped characters than a URL path.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package download
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	var table = []struct {
+		input, output string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\temp\a "b".txt`, "a b.txt"},
+		{"a\r\nSet-Cookie: x", "aSet-Cookie: x"},
+		{"..", ""},
+		{"  ", ""},
+	}
+	for _, s := range table {
+		if out := sanitizeFilename(s.input); out != s.output {
+			t.Errorf("%q: expected %q, got %q", s.input, s.output, out)
+		}
+	}
+}
+
+func TestFilenameOverride(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	var table = []struct {
+		route, disposition string
+	}{
+		{"/0123", `inline; filename=""`},
+		{"/0123?filename=Hello.txt", `inline; filename="Hello.txt"`},
+		{"/0123?filename=..%2Fsecret", `inline; filename="secret"`},
+		{"/0123?filename=r%C3%A9sum%C3%A9.pdf", `inline; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, s := range table {
+		resp, _ := checkRouteX(t, "GET", ts.URL+s.route, 200, "hello", nil)
+		if d := resp.Header.Get("Content-Disposition"); d != s.disposition {
+			t.Errorf("%s: expected %s, got %s", s.route, s.disposition, d)
+		}
+	}
+}
+
+func TestDisposition(t *testing.T) {
+	var table = []struct {
+		attachment, plain []string
+		input             string
+		kind, mimetype    string
+	}{
+		{nil, nil, "text/html; charset=utf-8", "attachment", "text/html; charset=utf-8"},
+		{nil, nil, "image/svg+xml", "attachment", "image/svg+xml"},
+		{nil, nil, "application/pdf", "inline", "application/pdf"},
+		{[]string{}, nil, "text/html", "inline", "text/html"},
+		{[]string{"text/*"}, nil, "text/xml", "attachment", "text/xml"},
+		{nil, []string{"text/html"}, "text/html", "attachment", "text/plain"},
+	}
+	for _, s := range table {
+		dh := &DownloadHandler{AttachmentTypes: s.attachment, PlainTypes: s.plain}
+		kind, mimetype := dh.disposition(httptest.NewRequest("GET", "/", nil), s.input)
+		if kind != s.kind || mimetype != s.mimetype {
+			t.Errorf("%q: expected %s %s, got %s %s", s.input, s.kind, s.mimetype, kind, mimetype)
+		}
+	}
+}
+
+func TestDispositionMode(t *testing.T) {
+	var table = []struct {
+		mode, query string
+		input       string
+		kind        string
+	}{
+		{"", "", "image/tiff", "inline"},
+		{"attachment", "", "image/tiff", "attachment"},
+		{"", "?disposition=attachment", "image/tiff", "attachment"},
+		{"attachment", "?disposition=inline", "image/tiff", "inline"},
+		{"", "?disposition=bogus", "image/tiff", "inline"},
+		// scripts are never inline
+		{"", "?disposition=inline", "text/html", "attachment"},
+	}
+	for _, s := range table {
+		dh := &DownloadHandler{Disposition: s.mode}
+		kind, _ := dh.disposition(httptest.NewRequest("GET", "/"+s.query, nil), s.input)
+		if kind != s.kind {
+			t.Errorf("%q %q %q: expected %s, got %s", s.mode, s.query, s.input, s.kind, kind)
+		}
+	}
+}
+
+func TestParseDisposition(t *testing.T) {
+	if d, err := ParseDisposition(""); d != DispositionInline || err != nil {
+		t.Errorf("Expected inline, got %q, %v", d, err)
+	}
+	if _, err := ParseDisposition("save"); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	var table = []struct {
+		kind, filename, header string
+	}{
+		{"inline", "report.pdf", `inline; filename="report.pdf"`},
+		{"attachment", "été.tif", `attachment; filename="_t_.tif"; filename*=UTF-8''%C3%A9t%C3%A9.tif`},
+		{"inline", "論文.pdf", `inline; filename="__.pdf"; filename*=UTF-8''%E8%AB%96%E6%96%87.pdf`},
+		{"inline", `say "hi".txt`, `inline; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		// characters a URL path allows but RFC 5987 does not
+		{"inline", "l'été (1).pdf", `inline; filename="l'_t_ (1).pdf"; filename*=UTF-8''l%27%C3%A9t%C3%A9%20%281%29.pdf`},
+	}
+	for _, s := range table {
+		if h := contentDisposition(s.kind, s.filename); h != s.header {
+			t.Errorf("%q: expected %s, got %s", s.filename, s.header, h)
+		}
+	}
+}
+
+func TestZipDisposition(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/0123/zip/123", 200, "", nil)
+	if d := resp.Header.Get("Content-Disposition"); d != `inline; filename="test:0123.zip"` {
+		t.Errorf("Got %s", d)
+	}
+	resp, _ = checkRouteX(t, "GET", ts.URL+"/0123/zip/123?disposition=attachment", 200, "", nil)
+	if d := resp.Header.Get("Content-Disposition"); d != `attachment; filename="test:0123.zip"` {
+		t.Errorf("Got %s", d)
+	}
+}
@@ -0,0 +1,496 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestDownload(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	var sequence = []struct {
+		verb, route string
+		status      int
+		expected    string
+	}{
+		// Test pool list and creation
+		{"GET", "/0123", 200, "hello"},
+		{"HEAD", "/0123", 200, ""},
+
+		{"GET", "/123", 200, "goodbye"},
+		{"HEAD", "/123", 200, ""},
+
+		{"GET", "/0123?datastream_id=content", 200, "hello"},
+		{"POST", "/0123", 405, ""},
+
+		{"GET", "/badsize", 200, "hola"},
+
+		{"GET", "/0123/zip/123,0123", 200, ""},
+		{"GET", "/0123/zip/123,0124", 200, ""},
+
+		// It applies the correct prefix
+		{"GET", "/xyz", 404, ""},
+		{"HEAD", "/xyz", 404, ""},
+
+		{"GET", "/123/zip/123,0123", 200, ""},
+		{"GET", "/123/zip/123,0124", 200, ""},
+
+		// identifiers are assumed to not have more than 64 characters
+		{"GET", "/1234567890123456789012345678901234567890123456789012345678901234567890", 404, ""},
+	}
+	for _, s := range sequence {
+		checkRoute(t, s.verb, ts.URL+s.route, s.status, s.expected)
+	}
+}
+
+// See if the returned content type is pulled from the datastream metadata and not
+// from the returned Content-Type. (DLTP-568)
+func TestDLTP568(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	table := []struct {
+		verb, route, contenttype string
+	}{
+		{"GET", "/redirect", "audio/mpeg"},
+		{"HEAD", "/redirect", "audio/mpeg"},
+		{"GET", "/0123", ""},
+		{"HEAD", "/0123", ""},
+	}
+	for _, s := range table {
+		checkContentType(t, s.verb, ts.URL+s.route, 200, s.contenttype)
+	}
+}
+
+// See if we don't advertise range requests for files with application/pdf
+// mime type.
+func TestCURATE173(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	table := []struct {
+		verb, route string
+		haveRange   bool
+	}{
+		{"GET", "/abc", true},
+		{"HEAD", "/abc", true},
+		{"GET", "/pdffile", false},
+		{"HEAD", "/pdffile", false},
+		{"GET", "/badsize", false},  // <= 0 length files also don't support ranges
+		{"HEAD", "/badsize", false}, // <= 0 length files also don't support ranges
+		{"GET", "/redirect", true},
+		{"HEAD", "/redirect", true},
+	}
+	for _, s := range table {
+		r, _ := checkRouteX(t, s.verb, ts.URL+s.route, 200, "", nil)
+		acceptRanges := r.Header.Get("Accept-Ranges")
+		ok := (s.haveRange && acceptRanges == "bytes") ||
+			(!s.haveRange && acceptRanges == "")
+		if !ok {
+			t.Errorf("%s %s: Expected Range %v, Received Accept-Ranges: %s",
+				s.verb,
+				s.route,
+				s.haveRange, acceptRanges)
+		}
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Cache = NewMemoryCache(1000, 100)
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	if _, ok := dh.Cache.Get("test:0123/content/content.0"); !ok {
+		t.Errorf("Expected content to be cached")
+	}
+
+	// cached content handles ranges itself
+	checkRouteX(t, "GET", ts.URL+"/0123", 206, "ell", func(req *http.Request) {
+		req.Header.Add("Range", "bytes=1-3")
+	})
+
+	// change content without changing the version
+	dh.Fedora.(*fedora.TestFedora).Set("test:0123", "content", fedora.DsInfo{}, []byte("HELLO"))
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+
+	// a new version is fetched
+	dh.Fedora.(*fedora.TestFedora).Set("test:0123",
+		"content",
+		fedora.DsInfo{VersionID: "content.1"},
+		[]byte("HELLO"))
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "HELLO")
+}
+
+func TestNotFoundCache(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.NotFound = NewTimeCache(time.Minute)
+	checkRoute(t, "GET", ts.URL+"/new", 404, "")
+
+	// the item is created, but we still remember it as missing
+	dh.Fedora.(*fedora.TestFedora).Set("test:new", "content", fedora.DsInfo{}, []byte("new"))
+	checkRoute(t, "GET", ts.URL+"/new", 404, "")
+
+	dh.NotFound.Delete("test:new")
+	checkRoute(t, "GET", ts.URL+"/new", 200, "new")
+}
+
+// Check that redirects use the token, if supplied
+func TestRedirectToken(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "")
+
+	// make token invalid
+	// and see if we get an unquthorized error.
+	// this is dirty, but it is just a test.
+	ts.Config.Handler.(*DownloadHandler).BendoToken = "abc"
+	checkRoute(t, "GET", ts.URL+"/remote", 500, "")
+
+	// remove token config
+	// and see if we get the fedora response
+	// this is dirty, but it is just a test.
+	ts.Config.Handler.(*DownloadHandler).BendoToken = ""
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "from fedora")
+}
+
+func checkContentType(t *testing.T, verb, route string, status int, expectedType string) {
+	r, _ := checkRouteX(t, verb, route, status, "", nil)
+	recvType := r.Header.Get("Content-Type")
+	if recvType != expectedType {
+		t.Errorf("%s: Expected %s, Received %s", route, expectedType, recvType)
+	}
+}
+
+func checkRoute(t *testing.T, verb, route string, status int, expected string) {
+	checkRouteX(t, verb, route, status, expected, nil)
+}
+
+// loopback returns the address range of test servers, so they may be trusted
+// as a proxy.
+func loopback() []*net.IPNet {
+	trusted, err := ParseCIDRs([]string{"127.0.0.0/8", "::1/128"})
+	if err != nil {
+		panic(err)
+	}
+	return trusted
+}
+
+// checkRouteX is like checkRoute, but returns a response structure
+func checkRouteX(t *testing.T, verb, route string, status int, expected string, setup func(*http.Request)) (*http.Response, []byte) {
+	req, err := http.NewRequest(verb, route, nil)
+	if err != nil {
+		t.Fatal("Problem creating request", err)
+	}
+	if setup != nil {
+		setup(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	if resp.StatusCode != status {
+		t.Errorf("%s: Expected status %d and received %d",
+			route,
+			status,
+			resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	if expected != "" {
+		if string(body) != expected {
+			t.Errorf("%s: Expected body %s, got %v",
+				route,
+				expected,
+				body)
+		}
+	}
+	resp.Body.Close()
+	return resp, body
+}
+
+func TestRangeRequest(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	checkRouteX(t, "GET", ts.URL+"/abc", 206, "longer", func(req *http.Request) {
+		req.Header.Add("Range", "bytes=2-7")
+	})
+	checkRouteX(t, "GET", ts.URL+"/abc", 206, "longer string", func(req *http.Request) {
+		req.Header.Add("Range", "bytes=2-")
+	})
+	// merged into one range, since the gap is small
+	checkRouteX(t, "GET", ts.URL+"/abc", 206, "longer string", func(req *http.Request) {
+		req.Header.Add("Range", "bytes=2-7,10-")
+	})
+}
+
+// An AuthTarget is a simple handler that returns 200 if
+// a correct token is provided in the X-Api-Key header.
+// Otherwise, a 401 is returned.
+type AuthTarget struct {
+	Tokens []string
+}
+
+func (t *AuthTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	goal := r.Header.Get("X-Api-Key")
+	// token in list?
+	for _, token := range t.Tokens {
+		if goal == token {
+			w.Write([]byte("c"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("c"))
+}
+
+var BendoServer *httptest.Server
+
+func init() {
+	BendoServer = httptest.NewServer(&AuthTarget{
+		Tokens: []string{"12345"},
+	})
+}
+
+// setupHandler returns a test server seeded with some content.
+func setupHandler() *httptest.Server {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:0123", "content", fedora.DsInfo{}, []byte("hello"))
+	tf.Set("test:123", "content", fedora.DsInfo{}, []byte("goodbye"))
+	tf.Set("test:abc", "content", fedora.DsInfo{}, []byte("a longer string"))
+	tf.Set("another:xyz", "content", fedora.DsInfo{}, []byte("hola"))
+	// fedora reports a size of 0 for inline datastreams
+	tf.Set("test:badsize", "content", fedora.DsInfo{ControlGroup: "X"}, []byte("hola"))
+	tf.Set("test:redirect",
+		"content",
+		fedora.DsInfo{
+			Location:     BendoServer.URL + "/another/file",
+			LocationType: "URL",
+			MIMEType:     "audio/mpeg"},
+		[]byte("audio stream")) // for DLTP-568
+	tf.Set("test:remote",
+		"content",
+		fedora.DsInfo{
+			Location:     BendoServer.URL + "/test",
+			LocationType: "URL",
+			MIMEType:     "image/png",
+		},
+		[]byte("from fedora"))
+	tf.Set("test:pdffile",
+		"content",
+		fedora.DsInfo{MIMEType: "application/pdf"},
+		[]byte("pdf contents here"))
+	h := &DownloadHandler{
+		Fedora:     tf,
+		Ds:         "content",
+		Prefix:     "test:",
+		BendoToken: "12345",
+	}
+	return httptest.NewServer(h)
+}
+
+func TestAbout(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:info", "content",
+		fedora.DsInfo{Label: "a b.pdf", MIMEType: "application/pdf", Checksum: "abc", ChecksumType: "MD5"},
+		[]byte("pdf"))
+	resp, body := checkRouteX(t, "GET", ts.URL+"/info/about", 200, "", nil)
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON, got %s", resp.Header.Get("Content-Type"))
+	}
+	var info aboutInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := aboutInfo{
+		ID:           "test:info",
+		Datastream:   "content",
+		Label:        "a b.pdf",
+		MIMEType:     "application/pdf",
+		Size:         3,
+		Checksum:     "abc",
+		ChecksumType: "MD5",
+		Version:      "content.0",
+		State:        "A",
+	}
+	if info != expected {
+		t.Errorf("Expected %v, got %v", expected, info)
+	}
+	checkRoute(t, "GET", ts.URL+"/missing/about", 404, "")
+}
+
+func TestSlashIdentifiers(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:ark:/13030/q", "content", fedora.DsInfo{}, []byte("ark"))
+	dh.Fedora.(*fedora.TestFedora).Set("test:a b", "content", fedora.DsInfo{}, []byte("space"))
+
+	checkRoute(t, "GET", ts.URL+"/ark:%2F13030%2Fq", 200, "ark")
+	checkRoute(t, "GET", ts.URL+"/a%20b", 200, "space")
+	checkRoute(t, "GET", ts.URL+"/ark:/13030/q", 404, "")
+
+	dh.GreedyID = true
+	checkRoute(t, "GET", ts.URL+"/ark:/13030/q", 200, "ark")
+	checkRoute(t, "GET", ts.URL+"/ark:%2F13030%2Fq", 200, "ark")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/ark:/13030/q/about", 200, "", nil)
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected about route, got %s", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("temp:abc", "content", fedora.DsInfo{}, []byte("temporary"))
+
+	checkRoute(t, "GET", ts.URL+"/temp:abc", 404, "")
+	checkRoute(t, "GET", ts.URL+"/test:0123", 200, "hello")
+
+	dh.Prefixes = []string{"temp:"}
+	checkRoute(t, "GET", ts.URL+"/temp:abc", 200, "temporary")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/another:xyz", 404, "")
+	checkRoute(t, "GET", ts.URL+"/temp/abc", 404, "")
+	checkRoute(t, "GET", ts.URL+"/0123/zip/temp:abc,123", 200, "")
+
+	dh.PrefixSegment = true
+	checkRoute(t, "GET", ts.URL+"/temp/abc", 200, "temporary")
+	checkRoute(t, "GET", ts.URL+"/test/0123", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/another/xyz", 404, "")
+}
+
+// noLengthFedora wraps a Fedora, leaving out the length of the content
+// like fedora does for inline datastreams.
+type noLengthFedora struct {
+	fedora.Fedora
+}
+
+func (nf noLengthFedora) GetDatastream(id, dsname string) (io.ReadCloser, fedora.ContentInfo, error) {
+	rc, info, err := nf.Fedora.GetDatastream(id, dsname)
+	info.Length = ""
+	return rc, info, err
+}
+
+func TestHeadLength(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora = noLengthFedora{dh.Fedora}
+
+	resp, _ := checkRouteX(t, "HEAD", ts.URL+"/0123", 200, "", nil)
+	if resp.Header.Get("Content-Length") != "5" {
+		t.Errorf("Expected Content-Length 5, got %q", resp.Header.Get("Content-Length"))
+	}
+	resp, _ = checkRouteX(t, "HEAD", ts.URL+"/badsize", 200, "", nil)
+	if resp.Header.Get("Content-Length") != "" {
+		t.Errorf("Expected no Content-Length, got %q", resp.Header.Get("Content-Length"))
+	}
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+}
+
+// downFedora wraps a Fedora, failing every request like fedora does
+// during an outage.
+type downFedora struct {
+	fedora.Fedora
+}
+
+func (df downFedora) GetDatastreamInfo(id, dsname string) (fedora.DsInfo, error) {
+	return fedora.DsInfo{}, errors.New("Received status 502 from fedora")
+}
+
+func TestFedoraOutage(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.NotFound = NewTimeCache(time.Minute)
+	dh.Fedora = downFedora{dh.Fedora}
+
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/0123", 503, "", nil)
+	if resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", resp.Header.Get("Retry-After"))
+	}
+	checkRoute(t, "GET", ts.URL+"/0123/about", 503, "")
+	// outages are not remembered as missing items
+	if _, ok := dh.NotFound.Get("test:0123"); ok {
+		t.Errorf("Expected test:0123 to not be cached as missing")
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/0123", 200, "hello", nil)
+	if resp.Header.Get("Cache-Control") != "private" {
+		t.Errorf("Expected private, got %q", resp.Header.Get("Cache-Control"))
+	}
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.CacheControl = "public, max-age=60"
+	resp, _ = checkRouteX(t, "GET", ts.URL+"/0123", 200, "hello", nil)
+	if resp.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Expected public, got %q", resp.Header.Get("Cache-Control"))
+	}
+	resp, _ = checkRouteX(t, "GET", ts.URL+"/0123", 304, "", func(r *http.Request) {
+		r.Header.Set("If-None-Match", `"content.0"`)
+	})
+	if resp.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Expected public on 304, got %q", resp.Header.Get("Cache-Control"))
+	}
+	dh.CacheControl = "public, max-age=60, s-maxage=600"
+	setupAuth(dh)
+	resp, _ = checkRouteX(t, "GET", ts.URL+"/0123", 200, "hello", nil)
+	if resp.Header.Get("Cache-Control") != "private, max-age=60" {
+		t.Errorf("Expected private with auth, got %q", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestEmptyDatastream(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:empty", "content", fedora.DsInfo{}, []byte{})
+
+	for _, verb := range []string{"GET", "HEAD"} {
+		resp, body := checkRouteX(t, verb, ts.URL+"/empty", 200, "", nil)
+		if resp.Header.Get("Content-Length") != "0" {
+			t.Errorf("%s: Expected Content-Length 0, got %q", verb, resp.Header.Get("Content-Length"))
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: Expected no body, got %q", verb, body)
+		}
+	}
+	// a range of an empty datastream gets all of it
+	checkRouteX(t, "GET", ts.URL+"/empty", 200, "", func(req *http.Request) {
+		req.Header.Set("Range", "bytes=0-10")
+	})
+}
@@ -0,0 +1,160 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorPages wraps a handler to replace its plain text error replies, such
+// as those from http.Error, with HTML pages made from templates. Statuses
+// without a template are passed through unchanged, as are HEAD requests.
+type ErrorPages struct {
+	Handler http.Handler
+
+	// Templates gives the template for each status code, e.g. 404.
+	Templates map[int]*template.Template
+
+	// Contact is an email address to show on the pages. Optional.
+	Contact string
+
+	// Pid finds the identifier a request is for. Optional.
+	Pid func(*http.Request) string
+}
+
+// errorPageData is passed to the error page templates.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string // the plain text error, e.g. "404 page not found"
+	Path       string
+	Pid        string
+	Contact    string
+}
+
+// ParseErrorPage parses a description of the form "status filename", such
+// as "404 /etc/disadis/404.html", and returns the status and template.
+func ParseErrorPage(desc string) (int, *template.Template, error) {
+	fields := strings.Fields(desc)
+	if len(fields) != 2 {
+		return 0, nil, fmt.Errorf("error page %q: expected a status and a file", desc)
+	}
+	status, err := strconv.Atoi(fields[0])
+	if err != nil || status < 400 || status > 599 {
+		return 0, nil, fmt.Errorf("error page %q: bad status", desc)
+	}
+	t, err := template.ParseFiles(fields[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("error page %q: %s", desc, err)
+	}
+	return status, t, nil
+}
+
+func (ep *ErrorPages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "HEAD" || len(ep.Templates) == 0 {
+		ep.Handler.ServeHTTP(w, r)
+		return
+	}
+	ew := &errorPageWriter{ResponseWriter: w, pages: ep}
+	ep.Handler.ServeHTTP(ew, r)
+	if ew.t == nil {
+		return
+	}
+	data := errorPageData{
+		Status:     ew.status,
+		StatusText: http.StatusText(ew.status),
+		Message:    strings.TrimSpace(ew.body.String()),
+		Path:       r.URL.Path,
+		Contact:    ep.Contact,
+	}
+	if ep.Pid != nil {
+		data.Pid = ep.Pid(r)
+	}
+	ep.write(w, ew.t, data)
+}
+
+// write renders the page, falling back to the plain message if the
+// template fails.
+func (ep *ErrorPages) write(w http.ResponseWriter, t *template.Template, data errorPageData) {
+	var page bytes.Buffer
+	h := w.Header()
+	h.Del("Content-Length")
+	if err := t.Execute(&page, data); err != nil {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(data.Status)
+		fmt.Fprintln(w, data.Message)
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(data.Status)
+	w.Write(page.Bytes())
+}
+
+// maxErrorMessage limits how much of an error reply is kept for the page.
+const maxErrorMessage = 4096
+
+// errorPageWriter holds back plain text error replies having a template,
+// so the page can be written in their place.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages  *ErrorPages
+	t      *template.Template // the template to use, if holding back
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.wrote {
+		return
+	}
+	ew.wrote = true
+	t := ew.pages.Templates[status]
+	if t != nil && strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") {
+		ew.t = t
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorPageWriter) Write(p []byte) (int, error) {
+	if !ew.wrote {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.t != nil {
+		if ew.body.Len() < maxErrorMessage {
+			ew.body.Write(p)
+		}
+		return len(p), nil
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// Flush passes through to the underlying ResponseWriter, unless an error
+// is being held back.
+func (ew *errorPageWriter) Flush() {
+	if ew.t != nil {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// RequestPid returns the identifier a request is for, or "" if there is
+// none.
+func (dh *DownloadHandler) RequestPid(r *http.Request) string {
+	prefix, id, _, ok := dh.splitRoute(r.URL.EscapedPath())
+	if !ok || id == "" {
+		return ""
+	}
+	return prefix + id
+}
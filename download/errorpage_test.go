@@ -0,0 +1,62 @@
+package download
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseErrorPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errorpage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "404.html")
+	err = ioutil.WriteFile(fname, []byte("<p>{{.Pid}} not found</p>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, tmpl, err := ParseErrorPage("404 " + fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 404 || tmpl == nil {
+		t.Errorf("Unexpected status %d", status)
+	}
+	for _, desc := range []string{fname, "200 " + fname, "404 " + fname + ".missing"} {
+		if _, _, err := ParseErrorPage(desc); err == nil {
+			t.Errorf("%s: Expected an error", desc)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	ts := setupHandler()
+	ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	ep := &ErrorPages{
+		Handler: dh,
+		Templates: map[int]*template.Template{
+			404: template.Must(template.New("404").Parse(
+				`<p>{{.Pid}}: {{.Message}}. Contact {{.Contact}}</p>`)),
+		},
+		Contact: "<help@example.edu>",
+		Pid:     dh.RequestPid,
+	}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	resp, _ := checkRouteX(t, "GET", server.URL+"/missing", 404,
+		"<p>test:missing: 404 page not found. Contact &lt;help@example.edu&gt;</p>", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Expected HTML, got %q", ct)
+	}
+	checkRoute(t, "GET", server.URL+"/0123", 200, "hello")
+	checkRoute(t, "HEAD", server.URL+"/missing", 404, "")
+	checkRoute(t, "POST", server.URL+"/0123", 405, "405 Method Not Allowed\n")
+}
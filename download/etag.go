@@ -0,0 +1,48 @@
+package download
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// etag returns the quoted entity tag for the datastream.
+func (dh *DownloadHandler) etag(dsinfo fedora.DsInfo) string {
+	if dh.ChecksumETag && dsinfo.Checksum != "" && dsinfo.ChecksumType != "" {
+		kind := strings.ToLower(strings.Replace(dsinfo.ChecksumType, "-", "", -1))
+		return `"` + kind + ":" + strings.ToLower(dsinfo.Checksum) + `"`
+	}
+	return `"` + dsinfo.VersionID + `"`
+}
+
+// etagMatch returns true if the request's If-None-Match header matches
+// etag, using the weak comparison of RFC 7232, section 3.2. The header may
+// be "*", which matches any etag, or a list of etags, each of which may be
+// weak. A malformed header matches nothing.
+func etagMatch(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(strings.Join(r.Header.Values("If-None-Match"), ","))
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			return false
+		}
+		header = strings.TrimPrefix(header, "W/")
+		if header[0] != '"' {
+			return false
+		}
+		// entity tags may contain commas, but not quotes
+		end := strings.IndexByte(header[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if header[:end+2] == etag {
+			return true
+		}
+		header = header[end+2:]
+	}
+}
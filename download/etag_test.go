@@ -0,0 +1,63 @@
+package download
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestEtagMatch(t *testing.T) {
+	var table = []struct {
+		headers []string
+		match   bool
+	}{
+		{nil, false},
+		{[]string{`"content.1"`}, true},
+		{[]string{`W/"content.1"`}, true},
+		{[]string{`*`}, true},
+		{[]string{`"content.0", "content.1"`}, true},
+		{[]string{`"a,b", W/"content.1"`}, true},
+		{[]string{`"content.0"`, `"content.1"`}, true},
+		{[]string{`"content.0"`}, false},
+		{[]string{`content.1`}, false},
+		{[]string{`"content.1`}, false},
+		{[]string{`"content.0", *`}, false},
+	}
+	for _, s := range table {
+		r, _ := http.NewRequest("GET", "/", nil)
+		for _, h := range s.headers {
+			r.Header.Add("If-None-Match", h)
+		}
+		if etagMatch(r, `"content.1"`) != s.match {
+			t.Errorf("%q: expected %v", s.headers, s.match)
+		}
+	}
+}
+
+func TestChecksumETag(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:sum", "content",
+		fedora.DsInfo{Checksum: "5D41402ABC4B2A76B9719D911017C592", ChecksumType: "MD5"},
+		[]byte("hello"))
+	dh.ChecksumETag = true
+
+	var table = []struct {
+		route, etag string
+	}{
+		{"/sum", `"md5:5d41402abc4b2a76b9719d911017c592"`},
+		{"/0123", `"content.0"`}, // no checksum
+	}
+	for _, s := range table {
+		resp, _ := checkRouteX(t, "GET", ts.URL+s.route, 200, "", nil)
+		if resp.Header.Get("ETag") != s.etag {
+			t.Errorf("%s: expected ETag %s, got %s", s.route, s.etag, resp.Header.Get("ETag"))
+		}
+		checkRouteX(t, "GET", ts.URL+s.route, 304, "", func(r *http.Request) {
+			r.Header.Set("If-None-Match", s.etag)
+		})
+	}
+}
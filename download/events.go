@@ -0,0 +1,289 @@
+package download
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Event records one download.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Pid        string    `json:"pid"`
+	Datastream string    `json:"datastream"`
+	Version    string    `json:"version"`
+	User       string    `json:"user,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// An EventStore records every download in files in Dir, so usage
+// questions can be answered without an external log pipeline. It is a
+// Hook; add it to the Hooks of each handler whose downloads are to be
+// recorded. Each member of a zip or tar download is recorded as a download
+// of its own. The user is taken from UserHeader, as for an AdminList.
+//
+// Events are appended to one file per day, named for the date in UTC,
+// holding a JSON object per line. Files older than Retention are removed
+// by Prune. Use OpenEventStore to make one. It is safe to be called by
+// multiple goroutines.
+type EventStore struct {
+	Dir        string
+	Retention  time.Duration // zero keeps events forever
+	UserHeader string
+	Trusted    []*net.IPNet
+
+	m    sync.Mutex
+	day  string // of the open file
+	file *os.File
+}
+
+// the prefix and suffix of the event file names
+const (
+	eventFilePrefix = "events-"
+	eventFileSuffix = ".jsonl"
+	eventDay        = "2006-01-02"
+)
+
+// OpenEventStore returns a store keeping its files in dir, creating the
+// directory if needed.
+func OpenEventStore(dir string, retention time.Duration) (*EventStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStore{Dir: dir, Retention: retention}, nil
+}
+
+// Before allows every download.
+func (es *EventStore) Before(d Download, w http.ResponseWriter, r *http.Request) bool {
+	return true
+}
+
+// After records the download.
+func (es *EventStore) After(d Download, result DownloadResult, r *http.Request) {
+	err := es.Record(Event{
+		Time:       time.Now(),
+		Pid:        d.Pid,
+		Datastream: d.Ds,
+		Version:    d.DsInfo.VersionID,
+		User:       RequestUser(r, es.UserHeader, es.Trusted),
+		Status:     result.Status,
+		Bytes:      result.Bytes,
+	})
+	if err != nil {
+		log.Println("Recording download:", err)
+	}
+}
+
+// Record appends e to the file for its day.
+func (es *EventStore) Record(e Event) error {
+	e.Time = e.Time.UTC()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	day := e.Time.Format(eventDay)
+	es.m.Lock()
+	defer es.m.Unlock()
+	if es.file == nil || es.day != day {
+		if es.file != nil {
+			es.file.Close()
+			es.file = nil
+		}
+		f, err := os.OpenFile(es.filename(day), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		es.file = f
+		es.day = day
+	}
+	_, err = es.file.Write(b)
+	return err
+}
+
+func (es *EventStore) filename(day string) string {
+	return filepath.Join(es.Dir, eventFilePrefix+day+eventFileSuffix)
+}
+
+// days returns the days having event files, oldest first.
+func (es *EventStore) days() ([]string, error) {
+	infos, err := ioutil.ReadDir(es.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, eventFilePrefix) || !strings.HasSuffix(name, eventFileSuffix) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, eventFilePrefix), eventFileSuffix)
+		if _, err := time.Parse(eventDay, day); err == nil {
+			result = append(result, day)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Prune removes the files holding only events older than Retention.
+func (es *EventStore) Prune(now time.Time) error {
+	if es.Retention <= 0 {
+		return nil
+	}
+	days, err := es.days()
+	if err != nil {
+		return err
+	}
+	cutoff := now.UTC().Add(-es.Retention).Format(eventDay)
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+		if err := os.Remove(es.filename(day)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneEvery prunes the store every interval. It does not return.
+func (es *EventStore) PruneEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := es.Prune(now); err != nil {
+			log.Println("Event store:", err)
+		}
+	}
+}
+
+// An EventQuery selects events. Empty fields match everything.
+type EventQuery struct {
+	Pid   string
+	User  string
+	Since time.Time
+	Until time.Time // exclusive
+	Limit int       // the most events to return; zero means no limit
+}
+
+func (q EventQuery) match(e Event) bool {
+	return (q.Pid == "" || e.Pid == q.Pid) &&
+		(q.User == "" || e.User == q.User) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Query returns the events matching q, newest first.
+func (es *EventStore) Query(q EventQuery) ([]Event, error) {
+	days, err := es.days()
+	if err != nil {
+		return nil, err
+	}
+	result := []Event{}
+	for i := len(days) - 1; i >= 0; i-- {
+		day := days[i]
+		if !q.Since.IsZero() && day < q.Since.UTC().Format(eventDay) {
+			break
+		}
+		if !q.Until.IsZero() && day > q.Until.UTC().Format(eventDay) {
+			continue
+		}
+		events, err := es.readDay(day, q)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(events) - 1; j >= 0; j-- {
+			result = append(result, events[j])
+			if q.Limit > 0 && len(result) >= q.Limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// readDay returns the events matching q in the file for day, oldest
+// first. Lines which cannot be decoded, such as one being written, are
+// skipped.
+func (es *EventStore) readDay(day string, q EventQuery) ([]Event, error) {
+	f, err := os.Open(es.filename(day))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if q.match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// ServeHTTP answers queries for events, with the route
+//
+//	GET /events?pid=:pid&user=:user&since=:time&until=:time&limit=:n
+//
+// where every parameter is optional. Times are in RFC 3339 format or are
+// dates, such as 2006-01-02. The limit defaults to 1000.
+func (es *EventStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := EventQuery{
+		Pid:   r.FormValue("pid"),
+		User:  r.FormValue("user"),
+		Limit: 1000,
+	}
+	var err error
+	q.Since, err = parseEventTime(r.FormValue("since"))
+	if err == nil {
+		q.Until, err = parseEventTime(r.FormValue("until"))
+	}
+	if err == nil && r.FormValue("limit") != "" {
+		q.Limit, err = strconv.Atoi(r.FormValue("limit"))
+	}
+	if err != nil {
+		http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := es.Query(q)
+	if err != nil {
+		log.Println("Event store:", err)
+		http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
+
+// parseEventTime parses a time given in a query. The empty string is the
+// zero time.
+func parseEventTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(eventDay, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
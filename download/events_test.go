@@ -0,0 +1,125 @@
+package download
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es, err := OpenEventStore(dir, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.UserHeader = "X-Remote-User"
+	es.Trusted = loopback()
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Hooks = []Hook{es}
+	checkRouteX(t, "GET", ts.URL+"/abc", 200, "a longer string", func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "alice")
+	})
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+
+	old := time.Date(2015, 6, 2, 10, 0, 0, 0, time.UTC)
+	err = es.Record(Event{Time: old, Pid: "test:abc", Status: 200, Bytes: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hook runs after the response, so wait for it
+	var events []Event
+	for i := 0; i < 100 && len(events) < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		events, err = es.Query(EventQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+	if e := events[2]; !e.Time.Equal(old) {
+		t.Errorf("Expected the oldest event last, got %v", events)
+	}
+
+	rec := httptest.NewRecorder()
+	es.ServeHTTP(rec, httptest.NewRequest("GET", "/events?pid=test:abc&since=2016-01-01", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].User != "alice" || events[0].Bytes != 15 || events[0].Version != "content.0" {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	rec = httptest.NewRecorder()
+	es.ServeHTTP(rec, httptest.NewRequest("GET", "/events?since=yesterday", nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected status 400, got %d", rec.Code)
+	}
+
+	err = es.Prune(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "events-2015-06-02.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("Expected the old file to be removed, got %v", err)
+	}
+	events, _ = es.Query(EventQuery{Limit: 1})
+	if len(events) != 1 {
+		t.Errorf("Expected 1 event, got %v", events)
+	}
+}
+
+func TestArchiveEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es, err := OpenEventStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.UserHeader = "X-Remote-User"
+	es.Trusted = loopback()
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Hooks = []Hook{es}
+	checkRouteX(t, "GET", ts.URL+"/0123/tar/0123,abc,missing", 200, "", func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "alice")
+	})
+
+	// each member is recorded once the archive is written
+	events, err := es.Query(EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %v", events)
+	}
+	bytes := map[string]int64{"test:0123": 5, "test:abc": 15}
+	for _, e := range events {
+		if e.User != "alice" || e.Status != 200 || e.Bytes != bytes[e.Pid] {
+			t.Errorf("Unexpected event %v", e)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package download
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// export replies with fedora's archival FOXML export of pid. It is only
+// available to administrators, and is a 404 if the handler has none.
+func (dh *DownloadHandler) export(pid string, w http.ResponseWriter, r *http.Request) {
+	if dh.Admins == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !dh.Admins.Allowed(r) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	body, err := dh.Fedora.Export(pid)
+	if err != nil {
+		if err == fedora.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Received Fedora error exporting %s: %s", pid, err)
+		writeUnavailable(w, fedoraRetryAfter)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", pid+".xml"))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if r.Method == "HEAD" {
+		return
+	}
+	_, err = CopyBuffer(w, body)
+	if err != nil {
+		log.Printf("export %s: %s", pid, err)
+	}
+}
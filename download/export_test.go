@@ -0,0 +1,66 @@
+package download
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	// there are no admins by default
+	checkRoute(t, "GET", ts.URL+"/0123/export", 404, "")
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Admins = &AdminList{
+		UserHeader:  "X-Remote-User",
+		GroupHeader: "X-Remote-Groups",
+		Trusted:     loopback(),
+		Users:       []string{"alice"},
+		Groups:      []string{"preservation"},
+	}
+	as := func(user, groups string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("X-Remote-User", user)
+			r.Header.Set("X-Remote-Groups", groups)
+		}
+	}
+	checkRouteX(t, "GET", ts.URL+"/0123/export", 403, "", nil)
+	checkRouteX(t, "GET", ts.URL+"/0123/export", 403, "", as("bob", "staff"))
+	resp, body := checkRouteX(t, "GET", ts.URL+"/0123/export", 200, "", as("alice", ""))
+	if !strings.Contains(string(body), `PID="test:0123"`) {
+		t.Errorf("Unexpected export %q", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/xml; charset=utf-8" {
+		t.Errorf("Expected text/xml, got %q", ct)
+	}
+	checkRouteX(t, "GET", ts.URL+"/0123/export", 200, "", as("bob", "staff, preservation"))
+	checkRouteX(t, "GET", ts.URL+"/missing/export", 404, "", as("alice", ""))
+}
+
+func TestAdminListTrusted(t *testing.T) {
+	trusted, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	al := &AdminList{UserHeader: "X-Remote-User", Trusted: trusted, Users: []string{"alice"}}
+	r, _ := http.NewRequest("GET", "/0123/export", nil)
+	r.Header.Set("X-Remote-User", "alice")
+	r.RemoteAddr = "192.168.1.1:1234"
+	if al.Allowed(r) {
+		t.Errorf("Expected the header to be ignored from an untrusted client")
+	}
+	r.RemoteAddr = "10.1.2.3:1234"
+	if !al.Allowed(r) {
+		t.Errorf("Expected the header to be believed from a trusted proxy")
+	}
+	al.Trusted = nil
+	if al.Allowed(r) {
+		t.Errorf("Expected the header to be ignored with no trusted proxies")
+	}
+	if (*AdminList)(nil).Allowed(r) {
+		t.Errorf("Expected a nil list to allow no one")
+	}
+}
@@ -0,0 +1,333 @@
+package download
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// An ExternalStore describes how to fetch the content of datastreams which
+// are stored outside of fedora, i.e. those with a LocationType of "URL".
+// A store applies to every location beginning with Prefix. If more than
+// one store matches a location, the one with the longest prefix is used.
+//
+// Requests receiving a 502, 503, or 504 response are retried up to Retries
+// times, waiting Backoff before the first retry and doubling the wait each
+// time (or waiting as long as a Retry-After header asks, if it is longer).
+// Failures are reported to Breaker, if there is one, and while it is open
+// requests fail immediately with an *UnavailableError.
+//
+// A Tiered store keeps some content on slow storage, such as tape, and
+// answers with a 202 or 503 while it stages the content. Those responses
+// are not retried or counted as failures, and give an *UnavailableError
+// with Staging set.
+type ExternalStore struct {
+	Prefix     string
+	Credential Credential      // nil means requests are sent without credentials
+	Client     *http.Client    // nil means http.DefaultClient
+	Retries    int             // number of retries for retryable errors
+	Backoff    time.Duration   // wait before the first retry
+	Breaker    *CircuitBreaker // optional
+	Tiered     bool
+}
+
+// the longest we will wait between retries
+const maxBackoff = 30 * time.Second
+
+// A Credential adds authentication information to a request sent to an
+// external store.
+type Credential interface {
+	Authorize(req *http.Request) error
+}
+
+// APIKey passes a token in the given request header. Bendo uses the header
+// "X-Api-Key".
+type APIKey struct {
+	Header string
+	Token  string
+}
+
+// Authorize adds the key to the request.
+func (k APIKey) Authorize(req *http.Request) error {
+	req.Header.Set(k.Header, k.Token)
+	return nil
+}
+
+// BearerToken passes a token in the Authorization header.
+type BearerToken struct {
+	Token string
+}
+
+// Authorize adds the token to the request.
+func (b BearerToken) Authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+b.Token)
+	return nil
+}
+
+// AWSSigV4 signs requests using AWS Signature Version 4, as used by S3 and
+// S3-compatible object stores. Only requests without a body are supported.
+type AWSSigV4 struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // optional
+	Region       string
+	Service      string // defaults to "s3"
+
+	now func() time.Time // for testing
+}
+
+// the hex encoded SHA-256 hash of the empty string
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Authorize signs the request.
+func (s AWSSigV4) Authorize(req *http.Request) error {
+	if s.AccessKey == "" || s.SecretKey == "" || s.Region == "" {
+		return fmt.Errorf("sigv4: access key, secret key, and region are required")
+	}
+	service := s.Service
+	if service == "" {
+		service = "s3"
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	t := now().UTC()
+	amzdate := t.Format("20060102T150405Z")
+	date := amzdate[:8]
+
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	// the headers to sign. The host header is not in req.Header.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-date":           amzdate,
+		"x-amz-content-sha256": emptyPayloadHash,
+	}
+	if s.SessionToken != "" {
+		headers["x-amz-security-token"] = s.SessionToken
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query parameters sorted by key, with spaces
+// encoded as %20, as required by signature version 4.
+func canonicalQuery(v url.Values) string {
+	s := v.Encode() // sorted by key
+	return strings.Replace(s, "+", "%20", -1)
+}
+
+// NewCredential makes a Credential from configuration values.
+// kind is one of "apikey", "bearer", "sigv4", or "none". The empty string
+// is the same as "none".
+func NewCredential(kind, header, token, accessKey, secretKey, region, service string) (Credential, error) {
+	switch strings.ToLower(kind) {
+	case "", "none":
+		return nil, nil
+	case "apikey":
+		if header == "" {
+			header = "X-Api-Key"
+		}
+		return APIKey{Header: header, Token: token}, nil
+	case "bearer":
+		return BearerToken{Token: token}, nil
+	case "sigv4":
+		return AWSSigV4{
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Region:    region,
+			Service:   service,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown credential type %q", kind)
+}
+
+// getExternalContent returns the contents of the given URL from the store.
+// The request is abandoned if ctx is canceled.
+// The returned stream needs to be closed when finished.
+func (store *ExternalStore) getExternalContent(ctx context.Context, url string) (io.ReadCloser, fedora.ContentInfo, error) {
+	body, info, _, err := store.getExternalRange(ctx, url, 0)
+	return body, info, err
+}
+
+// getExternalRange is like getExternalContent, but asks for the content
+// starting at offset. Stores may ignore the request, so it also returns the
+// offset the body actually starts at. The Length is of the body returned.
+func (store *ExternalStore) getExternalRange(ctx context.Context, url string, offset int64) (io.ReadCloser, fedora.ContentInfo, int64, error) {
+	var info fedora.ContentInfo
+	wait := store.Backoff
+	for attempt := 0; ; attempt++ {
+		if ok, d := store.Breaker.Allow(); !ok {
+			return nil, info, 0, &UnavailableError{Service: url, RetryAfter: d}
+		}
+		r, err := store.get(ctx, url, offset)
+		if err != nil {
+			// a client hanging up says nothing about the store
+			if ctx.Err() == nil {
+				store.Breaker.Failure()
+			}
+			return nil, info, 0, err
+		}
+		if store.Tiered && (r.StatusCode == 202 || r.StatusCode == 503) {
+			// the store is up, but the content is on tape
+			r.Body.Close()
+			return nil, info, 0, &UnavailableError{
+				Service:    r.Request.URL.Host,
+				RetryAfter: parseRetryAfter(r.Header.Get("Retry-After")),
+				Staging:    true,
+			}
+		}
+		switch r.StatusCode {
+		case 200, 206:
+			store.Breaker.Success()
+			info.Type = r.Header.Get("Content-Type")
+			info.Length = r.Header.Get("Content-Length")
+			info.Disposition = r.Header.Get("Content-Disposition")
+			// these are sent by bendo
+			info.MD5 = r.Header.Get("X-Content-Md5")
+			info.SHA256 = r.Header.Get("X-Content-Sha256")
+			var start int64
+			if r.StatusCode == 206 {
+				start = offset
+			}
+			return r.Body, info, start, nil
+		case 502, 503, 504:
+			r.Body.Close()
+			store.Breaker.Failure()
+			retryAfter := parseRetryAfter(r.Header.Get("Retry-After"))
+			if attempt >= store.Retries {
+				if retryAfter <= 0 {
+					// the store didn't say, so suggest our next backoff
+					retryAfter = wait
+				}
+				return nil, info, 0, &UnavailableError{Service: r.Request.URL.Host, RetryAfter: retryAfter}
+			}
+			d := wait
+			if retryAfter > d {
+				d = retryAfter
+			}
+			if d > maxBackoff {
+				d = maxBackoff
+			}
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return nil, info, 0, ctx.Err()
+			}
+			wait *= 2
+			continue
+		}
+		r.Body.Close()
+		store.Breaker.Success()
+		switch r.StatusCode {
+		case 404:
+			return nil, info, 0, fedora.ErrNotFound
+		case 401, 403:
+			return nil, info, 0, fedora.ErrNotAuthorized
+		default:
+			return nil, info, 0, fmt.Errorf("Received status %d from %s", r.StatusCode, r.Request.URL.Host)
+		}
+	}
+}
+
+// get sends a single authorized GET request to the store. If offset is
+// positive, only the content from offset to the end is requested.
+func (store *ExternalStore) get(ctx context.Context, url string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	if store.Credential != nil {
+		err = store.Credential.Authorize(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := store.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// parseRetryAfter decodes the value of a Retry-After header, which may be
+// either a number of seconds or an HTTP date. It returns 0 if the value is
+// missing or invalid.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
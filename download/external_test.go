@@ -0,0 +1,196 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExternalStore(t *testing.T) {
+	dh := &DownloadHandler{
+		Stores: []ExternalStore{
+			{Prefix: "http://bendo/", Credential: APIKey{Header: "X-Api-Key", Token: "a"}},
+			{Prefix: "http://bendo/special/", Credential: BearerToken{Token: "b"}},
+			{Prefix: "https://s3/"},
+		},
+	}
+	var table = []struct {
+		location string
+		prefix   string
+		found    bool
+	}{
+		{"http://bendo/item/1/file", "http://bendo/", true},
+		{"http://bendo/special/1/file", "http://bendo/special/", true},
+		{"https://s3/bucket/key", "https://s3/", true},
+		{"http://elsewhere/file", "", false},
+	}
+	for _, s := range table {
+		store := dh.externalStore(s.location)
+		if (store != nil) != s.found {
+			t.Errorf("%s: expected found %v, got %v", s.location, s.found, store)
+			continue
+		}
+		if store != nil && store.Prefix != s.prefix {
+			t.Errorf("%s: expected prefix %s, got %s", s.location, s.prefix, store.Prefix)
+		}
+	}
+
+	// a bendo token matches everything not otherwise matched
+	dh.BendoToken = "xyz"
+	store := dh.externalStore("http://elsewhere/file")
+	if store == nil || store.Credential != (APIKey{Header: "X-Api-Key", Token: "xyz"}) {
+		t.Errorf("Expected bendo token, got %v", store)
+	}
+}
+
+func TestExternalStoreToken(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.BendoToken = ""
+	dh.Stores = []ExternalStore{
+		{Prefix: BendoServer.URL, Credential: APIKey{Header: "X-Api-Key", Token: "12345"}},
+	}
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "c")
+
+	dh.Stores[0].Credential = APIKey{Header: "X-Api-Key", Token: "bad"}
+	checkRoute(t, "GET", ts.URL+"/remote", 500, "")
+
+	// a store without credentials
+	dh.Stores[0].Credential = nil
+	checkRoute(t, "GET", ts.URL+"/remote", 500, "")
+}
+
+func TestSigV4(t *testing.T) {
+	s := AWSSigV4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+	req, _ := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/some%20file.pdf?b=2&a=1", nil)
+	err := s.Authorize(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+		t.Errorf("Bad X-Amz-Date %s", req.Header.Get("X-Amz-Date"))
+	}
+	auth := req.Header.Get("Authorization")
+	prefix := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	if !strings.HasPrefix(auth, prefix) || len(auth) != len(prefix)+64 {
+		t.Errorf("Bad Authorization header %s", auth)
+	}
+
+	// signing is deterministic
+	req2, _ := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/some%20file.pdf?a=1&b=2", nil)
+	s.Authorize(req2)
+	if req2.Header.Get("Authorization") != auth {
+		t.Errorf("Expected %s, got %s", auth, req2.Header.Get("Authorization"))
+	}
+
+	// missing keys are an error
+	s.SecretKey = ""
+	if err := s.Authorize(req); err == nil {
+		t.Errorf("Expected error for missing secret key")
+	}
+}
+
+// A FlakyTarget returns 503 for the first Failures requests and
+// then succeeds. The 503 responses include RetryAfter, if it is set.
+type FlakyTarget struct {
+	Failures   int
+	RetryAfter string
+	count      int
+}
+
+func (t *FlakyTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.count++
+	if t.count <= t.Failures {
+		if t.RetryAfter != "" {
+			w.Header().Set("Retry-After", t.RetryAfter)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("staged"))
+}
+
+func TestExternalStoreRetry(t *testing.T) {
+	target := &FlakyTarget{Failures: 2}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	store := &ExternalStore{Retries: 2, Backoff: time.Millisecond}
+	body, _, err := store.getExternalContent(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if target.count != 3 {
+		t.Errorf("Expected 3 requests, got %d", target.count)
+	}
+
+	// without retries the Retry-After is passed back
+	target.count = 0
+	target.RetryAfter = "7"
+	store.Retries = 0
+	_, _, err = store.getExternalContent(context.Background(), server.URL)
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter != 7*time.Second {
+		t.Errorf("Expected UnavailableError with Retry-After, got %v", err)
+	}
+
+	// without a Retry-After the backoff is suggested
+	target.count = 0
+	target.RetryAfter = ""
+	store.Backoff = 3 * time.Second
+	_, _, err = store.getExternalContent(context.Background(), server.URL)
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter != 3*time.Second {
+		t.Errorf("Expected UnavailableError with backoff, got %v", err)
+	}
+
+	// an open breaker does not contact the store
+	target.count = 0
+	target.Failures = 100
+	store.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Minute}
+	store.getExternalContent(context.Background(), server.URL)
+	_, _, err = store.getExternalContent(context.Background(), server.URL)
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter <= 0 {
+		t.Errorf("Expected UnavailableError from breaker, got %v", err)
+	}
+	if target.count != 1 {
+		t.Errorf("Expected 1 request, got %d", target.count)
+	}
+}
+
+func TestExternalStoreCanceled(t *testing.T) {
+	target := &FlakyTarget{}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	// clients hanging up do not open the breaker
+	store := &ExternalStore{Breaker: &CircuitBreaker{Threshold: 1, Cooldown: time.Minute}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := store.getExternalContent(ctx, server.URL)
+	if err == nil {
+		t.Fatalf("Expected an error for a canceled request")
+	}
+	if ok, _ := store.Breaker.Allow(); !ok {
+		t.Errorf("Expected the breaker to stay closed")
+	}
+	body, _, err := store.getExternalContent(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+}
@@ -0,0 +1,113 @@
+package download
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// historyInfo is the JSON description of the changes to an object returned
+// by the history route: every version of the datastream, newest first,
+// and the object's audit trail.
+type historyInfo struct {
+	ID         string           `json:"id"`
+	Datastream string           `json:"datastream"`
+	Versions   []historyVersion `json:"versions"`
+	Audit      []auditRecord    `json:"audit"`
+}
+
+type historyVersion struct {
+	Version      string    `json:"version"`
+	Created      time.Time `json:"created"`
+	Label        string    `json:"label"`
+	MIMEType     string    `json:"mimetype"`
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"checksum,omitempty"`
+	ChecksumType string    `json:"checksum_type,omitempty"`
+	State        string    `json:"state"`
+}
+
+// auditRecord is one entry in the AUDIT datastream fedora keeps for each
+// object.
+type auditRecord struct {
+	Action        string    `xml:"action" json:"action"`
+	Component     string    `xml:"componentID" json:"component"`
+	User          string    `xml:"responsibility" json:"user"`
+	Date          time.Time `xml:"date" json:"date"`
+	Justification string    `xml:"justification" json:"justification,omitempty"`
+}
+
+// history replies with the version history of the datastream of pid and
+// the object's audit trail as JSON, so staff can see when a file changed
+// without using the fedora console. Like export, it is only available to
+// administrators.
+func (dh *DownloadHandler) history(pid string, w http.ResponseWriter, r *http.Request) {
+	if dh.Admins == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !dh.Admins.Allowed(r) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	src, _, err := dh.lookup(pid)
+	var versions []fedora.DsInfo
+	if err == nil {
+		versions, err = dh.Fedora.GetDatastreamHistory(pid, src.Ds)
+	}
+	var audit []auditRecord
+	if err == nil {
+		audit, err = dh.auditTrail(pid)
+	}
+	if err != nil {
+		if err == fedora.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Received Fedora error getting history of %s: %s", pid, err)
+		writeUnavailable(w, fedoraRetryAfter)
+		return
+	}
+	result := historyInfo{
+		ID:         pid,
+		Datastream: src.Ds,
+		Versions:   []historyVersion{},
+		Audit:      audit,
+	}
+	for _, v := range versions {
+		result.Versions = append(result.Versions, historyVersion{
+			Version:      v.VersionID,
+			Created:      v.Created,
+			Label:        v.Label,
+			MIMEType:     v.MIMEType,
+			Size:         v.Size,
+			Checksum:     v.Checksum,
+			ChecksumType: v.ChecksumType,
+			State:        v.State,
+		})
+	}
+	writeJSON(w, result)
+}
+
+// auditTrail returns the records in the AUDIT datastream of pid. Objects
+// without one have an empty trail.
+func (dh *DownloadHandler) auditTrail(pid string) ([]auditRecord, error) {
+	body, _, err := dh.Fedora.GetDatastream(pid, "AUDIT")
+	if err == fedora.ErrNotFound {
+		return []auditRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var trail struct {
+		Records []auditRecord `xml:"record"`
+	}
+	err = xml.NewDecoder(body).Decode(&trail)
+	if trail.Records == nil {
+		trail.Records = []auditRecord{}
+	}
+	return trail.Records, err
+}
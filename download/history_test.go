@@ -0,0 +1,59 @@
+package download
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestHistory(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:1", "content", fedora.DsInfo{Label: "report.pdf"}, []byte("hello"))
+	tf.Set("test:1", "AUDIT", fedora.DsInfo{}, []byte(`<audit:auditTrail xmlns:audit="info:fedora/fedora-system:def/audit#">
+<audit:record ID="AUDREC1">
+<audit:process type="Fedora API-M"/>
+<audit:action>modifyDatastreamByValue</audit:action>
+<audit:componentID>content</audit:componentID>
+<audit:responsibility>fedoraAdmin</audit:responsibility>
+<audit:date>2015-06-02T10:00:00.000Z</audit:date>
+<audit:justification></audit:justification>
+</audit:record>
+</audit:auditTrail>`))
+	tf.Set("test:2", "content", fedora.DsInfo{}, []byte("no audit"))
+	dh := &DownloadHandler{
+		Fedora: tf,
+		Ds:     "content",
+		Prefix: "test:",
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	checkRoute(t, "GET", ts.URL+"/1/history", 404, "")
+
+	dh.Admins = &AdminList{UserHeader: "X-Remote-User", Trusted: loopback(), Users: []string{"alice"}}
+	alice := func(r *http.Request) { r.Header.Set("X-Remote-User", "alice") }
+	checkRouteX(t, "GET", ts.URL+"/1/history", 403, "", nil)
+	_, body := checkRouteX(t, "GET", ts.URL+"/1/history", 200, "", alice)
+	var result historyInfo
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Versions) != 1 || result.Versions[0].Label != "report.pdf" || result.Versions[0].Size != 5 {
+		t.Errorf("Unexpected versions %v", result.Versions)
+	}
+	if len(result.Audit) != 1 || result.Audit[0].Action != "modifyDatastreamByValue" || result.Audit[0].User != "fedoraAdmin" {
+		t.Errorf("Unexpected audit trail %v", result.Audit)
+	}
+
+	_, body = checkRouteX(t, "GET", ts.URL+"/2/history", 200, "", alice)
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Audit == nil || len(result.Audit) != 0 {
+		t.Errorf("Expected an empty audit trail, got %v", result.Audit)
+	}
+	checkRouteX(t, "GET", ts.URL+"/missing/history", 404, "", alice)
+}
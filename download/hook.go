@@ -0,0 +1,139 @@
+package download
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Hook adds site specific policies and integrations to downloads, such
+// as embargo checks or usage statistics, without changing the handler.
+//
+// Hooks are run for single downloads, for each member of zip and tar
+// downloads, and for thumbnails and checksum verification, which also read
+// the content. Members of archives are left out if a hook refuses them, and
+// what a hook writes for them is thrown away.
+//
+// Before is called once the datastream to send is known, before any
+// content is fetched. It may set response headers. To refuse the download
+// it writes a response and returns false, and no later hooks are called.
+// After is called once the response is finished, including refused ones,
+// with what was sent.
+type Hook interface {
+	Before(d Download, w http.ResponseWriter, r *http.Request) bool
+	After(d Download, result DownloadResult, r *http.Request)
+}
+
+// Download describes the datastream a request is downloading.
+type Download struct {
+	Pid    string
+	Ds     string
+	DsInfo fedora.DsInfo
+}
+
+// DownloadResult describes the response to a download.
+type DownloadResult struct {
+	Status   int
+	Bytes    int64 // of the body
+	Duration time.Duration
+}
+
+// runHooks calls the Before method of each hook in order. It returns a
+// function to call when the response is finished, and false if a hook
+// refused the download. The returned writer is to be used for the
+// response.
+func (dh *DownloadHandler) runHooks(d Download, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	if len(dh.Hooks) == 0 {
+		return w, func() {}, true
+	}
+	start := time.Now()
+	hw := &hookWriter{ResponseWriter: w}
+	ok := true
+	for _, h := range dh.Hooks {
+		if !h.Before(d, hw, r) {
+			ok = false
+			break
+		}
+	}
+	after := func() {
+		result := DownloadResult{
+			Status:   hw.status,
+			Bytes:    hw.n,
+			Duration: time.Since(start),
+		}
+		if result.Status == 0 {
+			result.Status = http.StatusOK
+		}
+		for _, h := range dh.Hooks {
+			h.After(d, result, r)
+		}
+	}
+	return hw, after, ok
+}
+
+// A discardWriter is the response given to hooks for the members of an
+// archive, which have no response of their own. Whatever is written to it
+// is thrown away.
+type discardWriter struct {
+	header http.Header
+}
+
+func newDiscardWriter() discardWriter {
+	return discardWriter{header: make(http.Header)}
+}
+
+func (dw discardWriter) Header() http.Header         { return dw.header }
+func (dw discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (dw discardWriter) WriteHeader(code int)        {}
+
+// A hookWriter records the status code and the number of bytes sent.
+type hookWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (hw *hookWriter) WriteHeader(code int) {
+	if hw.status == 0 {
+		hw.status = code
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *hookWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	n, err := hw.ResponseWriter.Write(p)
+	hw.n += int64(n)
+	return n, err
+}
+
+// ReadFrom passes through to the underlying ResponseWriter, if it can, so
+// that sendfile(2) is still used for files.
+func (hw *hookWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := hw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{hw}, src)
+	}
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	n, err := rf.ReadFrom(src)
+	hw.n += n
+	return n, err
+}
+
+// Flush passes through to the underlying ResponseWriter, if it can.
+func (hw *hookWriter) Flush() {
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (hw *hookWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
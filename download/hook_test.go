@@ -0,0 +1,92 @@
+package download
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// policyHook refuses downloads of test:123 and passes on the results.
+type policyHook struct {
+	results chan DownloadResult
+}
+
+func (ph *policyHook) Before(d Download, w http.ResponseWriter, r *http.Request) bool {
+	if d.Pid == "test:123" {
+		http.Error(w, "451 Unavailable For Legal Reasons", http.StatusUnavailableForLegalReasons)
+		return false
+	}
+	w.Header().Set("X-Policy", d.DsInfo.VersionID)
+	return true
+}
+
+func (ph *policyHook) After(d Download, result DownloadResult, r *http.Request) {
+	ph.results <- result
+}
+
+func TestHooks(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	hook := &policyHook{results: make(chan DownloadResult, 1)}
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Hooks = []Hook{hook}
+
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/abc", 200, "a longer string", nil)
+	if p := resp.Header.Get("X-Policy"); p != "content.0" {
+		t.Errorf("Expected X-Policy content.0, got %q", p)
+	}
+	if r := <-hook.results; r.Status != 200 || r.Bytes != 15 {
+		t.Errorf("Expected 15 bytes with status 200, got %+v", r)
+	}
+
+	checkRoute(t, "GET", ts.URL+"/123", 451, "")
+	if r := <-hook.results; r.Status != 451 {
+		t.Errorf("Expected test:123 to be refused, got %+v", r)
+	}
+
+	checkRouteX(t, "GET", ts.URL+"/abc", 304, "", func(r *http.Request) {
+		r.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	})
+	if r := <-hook.results; r.Status != 304 || r.Bytes != 0 {
+		t.Errorf("Expected a 304, got %+v", r)
+	}
+}
+
+func TestArchiveHooks(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	hook := &policyHook{results: make(chan DownloadResult, 3)}
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Hooks = []Hook{hook}
+
+	// the refused member is left out
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/0123,123,abc", 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 {
+		t.Errorf("Expected 2 members, got %d", len(zr.File))
+	}
+	var expected = []DownloadResult{
+		{Status: 200, Bytes: 5},
+		{Status: 451},
+		{Status: 200, Bytes: 15},
+	}
+	for _, e := range expected {
+		r := <-hook.results
+		if r.Status != e.Status || (r.Status == 200 && r.Bytes != e.Bytes) {
+			t.Errorf("Expected %+v, got %+v", e, r)
+		}
+	}
+
+	checkRoute(t, "GET", ts.URL+"/123/checksum?verify=true", 451, "")
+	if r := <-hook.results; r.Status != 451 {
+		t.Errorf("Expected the verification to be refused, got %+v", r)
+	}
+	// without verifying, no content is read
+	checkRoute(t, "GET", ts.URL+"/123/checksum", 200, "")
+}
@@ -0,0 +1,60 @@
+package download
+
+import (
+	"net/http"
+	"time"
+)
+
+// An archiveKeepAlive keeps a zip or tar download from looking idle while
+// it waits for slow content, such as a bendo tape recall, so load
+// balancers do not drop the connection. Each interval the archive writes
+// padding its readers skip, as described for zipArchive and tarArchive,
+// and everything written so far is sent.
+type archiveKeepAlive struct {
+	archive  archiveWriter
+	rc       *http.ResponseController
+	interval time.Duration
+}
+
+func newArchiveKeepAlive(w http.ResponseWriter, archive archiveWriter, interval time.Duration) *archiveKeepAlive {
+	return &archiveKeepAlive{
+		archive:  archive,
+		rc:       http.NewResponseController(w),
+		interval: interval,
+	}
+}
+
+// wait calls fetch, keeping the connection alive every interval until it
+// returns. fetch must not write to the response.
+func (ka *archiveKeepAlive) wait(fetch func()) {
+	if ka.interval <= 0 {
+		fetch()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fetch()
+	}()
+	t := time.NewTicker(ka.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ka.archive.Pad()
+			ka.rc.Flush()
+		}
+	}
+}
+
+// flush sends the archive data written so far, so a slow member does not
+// hold back the end of the one before it.
+func (ka *archiveKeepAlive) flush() {
+	if ka.interval <= 0 {
+		return
+	}
+	ka.archive.Flush()
+	ka.rc.Flush()
+}
@@ -0,0 +1,95 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZipKeepAlive(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora = &slowFedora{Fedora: dh.Fedora, delay: 50 * time.Millisecond}
+	dh.ZipKeepAlive = 10 * time.Millisecond
+
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/0123,123", 200, "", nil)
+	if len(body) == 0 || body[0] != 0 {
+		t.Fatalf("Expected padding ahead of the zip")
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	padded := false
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(f.Name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(f.Name, err)
+		}
+		if strings.HasPrefix(f.Name, ".keepalive") {
+			padded = true
+			continue
+		}
+		files = append(files, string(b))
+	}
+	if len(files) != 2 || files[0] != "hello" || files[1] != "goodbye" {
+		t.Errorf("Unexpected zip contents %v", files)
+	}
+	if !padded {
+		t.Errorf("Expected a padding member between the files")
+	}
+}
+
+func TestTarKeepAlive(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora = &slowFedora{Fedora: dh.Fedora, delay: 50 * time.Millisecond}
+	dh.ZipKeepAlive = 10 * time.Millisecond
+
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/tar/0123,123", 200, "", nil)
+	tr := tar.NewReader(bytes.NewReader(body))
+	var files []string
+	padded := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, ".keepalive") {
+			padded = true
+			if hdr.Size != 0 {
+				t.Errorf("Expected empty padding, got %v", hdr)
+			}
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(hdr.Name, err)
+		}
+		files = append(files, string(b))
+	}
+	if len(files) != 2 || files[0] != "hello" || files[1] != "goodbye" {
+		t.Errorf("Unexpected tar contents %v", files)
+	}
+	if !padded {
+		t.Errorf("Expected padding members in the tar")
+	}
+}
@@ -0,0 +1,125 @@
+package download
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A LocationCache remembers the last known info of datastreams whose
+// content is kept in an external store, such as bendo. While fedora is
+// down the content can still be served from the store using it. The
+// cache is saved to a file, so it survives restarts. When it holds
+// MaxItems entries an arbitrary one is dropped to make room.
+//
+// A nil *LocationCache is always empty. The implementation is safe to be
+// called by multiple goroutines.
+type LocationCache struct {
+	Filename string
+	MaxItems int
+
+	m     sync.Mutex
+	items map[string]fedora.DsInfo
+	dirty bool // changed since the last save
+}
+
+// LoadLocationCache returns the cache saved in fname, or an empty one if
+// the file does not exist. A file which cannot be decoded, such as one
+// saved by an older version, is logged and replaced by an empty cache.
+func LoadLocationCache(fname string, maxItems int) (*LocationCache, error) {
+	lc := &LocationCache{
+		Filename: fname,
+		MaxItems: maxItems,
+		items:    make(map[string]fedora.DsInfo),
+	}
+	b, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return lc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &lc.items)
+	if err != nil {
+		log.Printf("Ignoring location cache %s: %s", fname, err)
+		lc.items = make(map[string]fedora.DsInfo)
+	}
+	return lc, nil
+}
+
+// Get returns the info for key, if there is any.
+func (lc *LocationCache) Get(key string) (fedora.DsInfo, bool) {
+	if lc == nil {
+		return fedora.DsInfo{}, false
+	}
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	dsinfo, ok := lc.items[key]
+	return dsinfo, ok
+}
+
+// Set records the info for key.
+func (lc *LocationCache) Set(key string, dsinfo fedora.DsInfo) {
+	if lc == nil {
+		return
+	}
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	old, ok := lc.items[key]
+	if ok && old == dsinfo {
+		return
+	}
+	if !ok && len(lc.items) >= lc.MaxItems {
+		for k := range lc.items {
+			delete(lc.items, k)
+			break
+		}
+	}
+	lc.items[key] = dsinfo
+	lc.dirty = true
+}
+
+// Save writes the cache to its file, if it has changed. The file is
+// replaced atomically.
+func (lc *LocationCache) Save() error {
+	lc.m.Lock()
+	if !lc.dirty {
+		lc.m.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(lc.items)
+	lc.dirty = false
+	lc.m.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(lc.Filename), filepath.Base(lc.Filename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), lc.Filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// SaveEvery saves the cache every interval. It does not return.
+func (lc *LocationCache) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := lc.Save(); err != nil {
+			log.Println("Location cache:", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestLocationCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "locations.json")
+
+	lc, err := LoadLocationCache(fname, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.Set("a", fedora.DsInfo{Location: "http://bendo/a"})
+	lc.Set("b", fedora.DsInfo{Location: "http://bendo/b"})
+	lc.Set("c", fedora.DsInfo{Location: "http://bendo/c"})
+	if len(lc.items) != 2 {
+		t.Errorf("Expected 2 items, got %d", len(lc.items))
+	}
+	if err := lc.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	lc, err = LoadLocationCache(fname, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsinfo, ok := lc.Get("c")
+	if !ok || dsinfo.Location != "http://bendo/c" {
+		t.Errorf("Expected c to be loaded, got %v, %v", dsinfo, ok)
+	}
+
+	// files from older versions, with the size as a string, are ignored
+	err = ioutil.WriteFile(fname, []byte(`{"a":{"Location":"http://bendo/a","Size":"12"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err = LoadLocationCache(fname, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lc.Get("a"); ok {
+		t.Errorf("Expected the old file to be ignored")
+	}
+}
+
+func TestLastKnownLocation(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "lastknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.LastKnown, err = LoadLocationCache(filepath.Join(dir, "locations.json"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "c")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	dh.Fedora = downFedora{dh.Fedora}
+	// external content is still served, but not content inside fedora
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "c")
+	checkRoute(t, "GET", ts.URL+"/0123", 503, "")
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"net/http"
+	"time"
+)
+
+// A ConcurrencyLimit wraps a handler so that at most Max requests are in
+// progress at once. Up to Queue additional requests wait as long as Wait for
+// one of the others to finish. Requests beyond that, or which wait too long,
+// receive a 503 error with a Retry-After header. This keeps one busy handler
+// from consuming all of the process' resources.
+//
+// Use NewConcurrencyLimit to make one.
+type ConcurrencyLimit struct {
+	Handler http.Handler
+	Max     int
+	Queue   int
+	Wait    time.Duration
+
+	active chan struct{} // a token for each request in progress
+	queued chan struct{} // a token for each waiting request
+}
+
+// NewConcurrencyLimit returns a limit wrapping h.
+func NewConcurrencyLimit(h http.Handler, max, queue int, wait time.Duration) *ConcurrencyLimit {
+	return &ConcurrencyLimit{
+		Handler: h,
+		Max:     max,
+		Queue:   queue,
+		Wait:    wait,
+		active:  make(chan struct{}, max),
+		queued:  make(chan struct{}, queue),
+	}
+}
+
+func (cl *ConcurrencyLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case cl.active <- struct{}{}:
+	default:
+		if !cl.wait(r) {
+			writeUnavailable(w, cl.retryAfter())
+			return
+		}
+	}
+	defer func() { <-cl.active }()
+	cl.Handler.ServeHTTP(w, r)
+}
+
+// Wrap returns a handler calling h under the same limit, so requests to
+// either count against it.
+func (cl *ConcurrencyLimit) Wrap(h http.Handler) http.Handler {
+	c := *cl
+	c.Handler = h
+	return &c
+}
+
+// wait waits in the queue for a slot to open. It returns false if the
+// queue is full or no slot opened in time.
+func (cl *ConcurrencyLimit) wait(r *http.Request) bool {
+	select {
+	case cl.queued <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-cl.queued }()
+	t := time.NewTimer(cl.Wait)
+	defer t.Stop()
+	select {
+	case cl.active <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+// retryAfter estimates when a refused request should try again.
+func (cl *ConcurrencyLimit) retryAfter() time.Duration {
+	if cl.Wait > time.Second {
+		return cl.Wait
+	}
+	return time.Second
+}
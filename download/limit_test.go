@@ -0,0 +1,81 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	ts := httptest.NewServer(NewConcurrencyLimit(slow, 1, 1, time.Minute))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	// the first request is served, the second waits in the queue
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRoute(t, "GET", ts.URL, 200, "")
+		}()
+	}
+	<-started
+	// wait for the second request to be queued
+	time.Sleep(20 * time.Millisecond)
+
+	// the third is refused
+	r, _ := checkRouteX(t, "GET", ts.URL, 503, "", nil)
+	if r.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header")
+	}
+	close(release)
+	wg.Wait()
+
+	// waiting too long is refused
+	cl := NewConcurrencyLimit(slow, 1, 1, 10*time.Millisecond)
+	cl.active <- struct{}{}
+	rec := httptest.NewRecorder()
+	cl.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 503 {
+		t.Errorf("Expected 503 after waiting, got %d", rec.Code)
+	}
+}
+
+func TestConcurrencyLimitWrap(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	cl := NewConcurrencyLimit(slow, 1, 0, time.Minute)
+	other := cl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	done := make(chan struct{})
+	go func() {
+		cl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	<-started
+	// both handlers count against the same limit
+	w := httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 503 {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+	close(release)
+	<-done
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+}
@@ -0,0 +1,122 @@
+package download
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// manifestKinds gives the checksum type, as fedora names it, of each
+// manifest algorithm, as BagIt names it.
+var manifestKinds = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA-1",
+	"sha256": "SHA-256",
+	"sha512": "SHA-512",
+}
+
+// ParseZipManifest checks the algorithm of a zip manifest, such as "md5"
+// or "sha256".
+func ParseZipManifest(s string) (string, error) {
+	s = strings.ToLower(s)
+	if _, ok := manifestKinds[s]; !ok && s != "" {
+		return "", fmt.Errorf("unknown manifest algorithm %q", s)
+	}
+	return s, nil
+}
+
+// A zipManifest lists the checksum of each member of an archive, in the
+// format of a BagIt manifest, so recipients can verify their downloads
+// offline with tools such as md5sum. The checksums stored in fedora are
+// used, so the manifest also catches content which has changed since it
+// was deposited. Content without a stored checksum of the right type has
+// its checksum computed as it is written. A nil *zipManifest does nothing.
+type zipManifest struct {
+	algorithm string
+	entries   bytes.Buffer
+	stored    string    // the stored checksum of the current member
+	h         hash.Hash // used when there is none
+}
+
+// newZipManifest returns the manifest to add to archives, or nil if they
+// get none.
+func (dh *DownloadHandler) newZipManifest() *zipManifest {
+	if manifestKinds[dh.ZipManifest] == "" {
+		return nil
+	}
+	return &zipManifest{algorithm: dh.ZipManifest}
+}
+
+// name returns the name of the manifest in the archive.
+func (zm *zipManifest) name() string {
+	return "manifest-" + zm.algorithm + ".txt"
+}
+
+// start begins a member, and returns a writer the member's content must
+// be copied to.
+func (zm *zipManifest) start(dsinfo fedora.DsInfo, info fedora.ContentInfo) io.Writer {
+	if zm == nil {
+		return ioutil.Discard
+	}
+	kind := manifestKinds[zm.algorithm]
+	zm.stored = ""
+	switch {
+	case dsinfo.Checksum != "" && strings.EqualFold(dsinfo.ChecksumType, kind):
+		zm.stored = dsinfo.Checksum
+	case kind == "MD5" && info.MD5 != "":
+		zm.stored = info.MD5
+	case kind == "SHA-256" && info.SHA256 != "":
+		zm.stored = info.SHA256
+	}
+	if zm.stored != "" {
+		return ioutil.Discard
+	}
+	zm.h = newHash(kind)
+	return zm.h
+}
+
+// add lists the member named name, once its content has been copied.
+func (zm *zipManifest) add(name string) {
+	if zm == nil {
+		return
+	}
+	sum := zm.stored
+	if sum == "" {
+		sum = hex.EncodeToString(zm.h.Sum(nil))
+	}
+	fmt.Fprintf(&zm.entries, "%s  %s\n", strings.ToLower(sum), manifestPath(name))
+}
+
+// lineSize returns the length of the entry for a member named name.
+func (zm *zipManifest) lineSize(name string) int {
+	return 2*newHash(manifestKinds[zm.algorithm]).Size() + 3 + len(manifestPath(name))
+}
+
+// write adds the manifest to archive.
+func (zm *zipManifest) write(archive archiveWriter) error {
+	if zm == nil {
+		return nil
+	}
+	w, err := archive.Create(archiveMember{
+		Name:     zm.name(),
+		MIMEType: "text/plain",
+		Size:     int64(zm.entries.Len()),
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(zm.entries.Bytes())
+	return err
+}
+
+// manifestPath encodes the characters BagIt does not allow in the paths
+// of a manifest.
+var manifestPath = strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace
@@ -0,0 +1,390 @@
+package download
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+	"github.com/ndlib/disadis/seek"
+)
+
+// The largest forward seek in a rangeSeeker which is done by reading and
+// discarding the stream instead of making a new request.
+const mediaSkip = 256 << 10
+
+// The largest moov atom read ahead, and the most files to keep one for.
+// Movies of a few hours have moov atoms of several megabytes.
+const (
+	moovMax   = 8 << 20
+	moovFiles = 32
+)
+
+// How long reading ahead a moov atom may take, and the most top level
+// atoms looked at to find it.
+const (
+	moovTimeout = time.Minute
+	moovAtoms   = 16
+)
+
+// A rangeSeeker reads the content of a URL in an external store. Unlike a
+// seek.StreamSeeker it can seek anywhere, since a seek past the current stream
+// position, or before it, opens a new stream using a range request. This
+// lets audio and video players jump around in a file, e.g. to read the
+// moov atom at the end of an MP4, without the whole file being downloaded
+// from the store first. Short forward seeks read ahead in the open stream.
+type rangeSeeker struct {
+	ctx   context.Context
+	store *ExternalStore
+	url   string
+	size  int64
+
+	pos  int64         // our logical position
+	body io.ReadCloser // the open stream, or nil
+	bpos int64         // position of body in the content
+
+	ahead *moovAtom // content read ahead, or nil
+}
+
+// newRangeSeeker wraps body, which is the content of url starting from
+// start. The total length of the content is size.
+func newRangeSeeker(ctx context.Context, store *ExternalStore, url string, body io.ReadCloser, start, size int64) *rangeSeeker {
+	return &rangeSeeker{
+		ctx:   ctx,
+		store: store,
+		url:   url,
+		size:  size,
+		pos:   start,
+		body:  body,
+		bpos:  start,
+	}
+}
+
+// Seek implements the io.Seeker interface. No request is made until the
+// next Read.
+func (rs *rangeSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = rs.pos + offset
+	case io.SeekEnd:
+		abs = rs.size + offset
+	default:
+		return 0, seek.ErrWhence
+	}
+	if abs < 0 || abs > rs.size {
+		return 0, seek.ErrInvalidPos
+	}
+	rs.pos = abs
+	return abs, nil
+}
+
+func (rs *rangeSeeker) Read(p []byte) (int, error) {
+	if a := rs.ahead; a != nil && a.holds(rs.pos) {
+		n := copy(p, a.data[rs.pos-a.start:])
+		rs.pos += int64(n)
+		return n, nil
+	}
+	if rs.body != nil && rs.pos != rs.bpos {
+		if rs.pos > rs.bpos && rs.pos-rs.bpos <= mediaSkip {
+			n, err := io.CopyN(ioutil.Discard, rs.body, rs.pos-rs.bpos)
+			rs.bpos += n
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			rs.body.Close()
+			rs.body = nil
+		}
+	}
+	if rs.body == nil {
+		body, _, start, err := rs.store.getExternalRange(rs.ctx, rs.url, rs.pos)
+		if err != nil {
+			return 0, err
+		}
+		rs.body = body
+		rs.bpos = start
+		if start != rs.pos {
+			// the store ignored the range, so skip to our position
+			n, err := io.CopyN(ioutil.Discard, rs.body, rs.pos-start)
+			rs.bpos += n
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := rs.body.Read(p)
+	rs.bpos += int64(n)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *rangeSeeker) Close() error {
+	if rs.body == nil {
+		return nil
+	}
+	err := rs.body.Close()
+	rs.body = nil
+	return err
+}
+
+// mediaContent returns the content of an external datastream as a
+// rangeSeeker, if the handler is in media mode and the request is for a
+// range. The first request to the store already asks for the first range,
+// so nothing before it is fetched. It is false if the content is to be
+// fetched with getContent instead: content through fedora, which cannot
+// use ranges, and content which has not been scanned for viruses yet. The
+// Length of the info is of the whole content.
+func (dh *DownloadHandler) mediaContent(r *http.Request, pid string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, bool, error) {
+	var info fedora.ContentInfo
+	header := r.Header.Get("Range")
+	if !dh.Media || header == "" || !isExternal(dsinfo) {
+		return nil, info, false, nil
+	}
+	store := dh.externalStore(dsinfo.Location)
+	if store == nil || (dh.Scan != nil && !dh.Scan.clean(pid, dh.Ds, dsinfo)) {
+		return nil, info, false, nil
+	}
+	key := dsinfo.Location + "@" + dsinfo.VersionID
+	offset := mediaOffset(header)
+	atom := dh.moovs.get(key)
+	if atom != nil && atom.holds(offset) {
+		// e.g. a player reading the moov atom at the end of a movie
+		rs := newRangeSeeker(r.Context(), store, dsinfo.Location, nil, offset, atom.size)
+		rs.ahead = atom
+		return rs, atom.info, true, nil
+	}
+	body, info, start, err := store.getExternalRange(r.Context(), dsinfo.Location, offset)
+	if err != nil && offset > 0 {
+		// e.g. the range is past the end. Let ServeContent decide.
+		return nil, info, false, nil
+	} else if err != nil {
+		return nil, info, false, err
+	}
+	n, err := strconv.ParseInt(info.Length, 10, 64)
+	if err != nil || n < 0 {
+		// without a size, ranges cannot be served anyway
+		body.Close()
+		return nil, info, false, nil
+	}
+	size := start + n
+	info.Length = strconv.FormatInt(size, 10)
+	if atom == nil && start == 0 && isMP4(dsinfo.MIMEType) {
+		dh.moovs.readAhead(store, key, dsinfo.Location, size, info)
+	}
+	rs := newRangeSeeker(r.Context(), store, dsinfo.Location, body, start, size)
+	rs.ahead = atom
+	return rs, info, true, nil
+}
+
+// mediaPage returns the request to pass to http.ServeContent for audio or
+// video content of the given size. A range open at the end, such as the
+// "bytes=0-" players begin with, is cut to MediaPage bytes. The response
+// then finishes quickly, and the player asks for the rest as it needs it
+// instead of holding a stream open to the end of the file.
+func (dh *DownloadHandler) mediaPage(r *http.Request, size int64, mimetype string) *http.Request {
+	header := r.Header.Get("Range")
+	if !dh.Media || dh.MediaPage <= 0 || !isAV(mimetype) ||
+		!strings.HasSuffix(header, "-") || strings.Contains(header, ",") {
+		return r
+	}
+	ranges, ok := parseRanges(header, size)
+	if !ok || len(ranges) != 1 || ranges[0].end-ranges[0].start < dh.MediaPage {
+		return r
+	}
+	start := ranges[0].start
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	r2.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(start+dh.MediaPage-1, 10))
+	return r2
+}
+
+// isAV is true for audio and video MIME types.
+func isAV(mimetype string) bool {
+	return strings.HasPrefix(mimetype, "audio/") || strings.HasPrefix(mimetype, "video/")
+}
+
+// isMP4 is true for the MIME types of MP4 and QuickTime files, which keep
+// their index in a moov atom.
+func isMP4(mimetype string) bool {
+	switch mimetype {
+	case "video/mp4", "audio/mp4", "video/quicktime", "audio/x-m4a", "video/x-m4v":
+		return true
+	}
+	return false
+}
+
+// A moovAtom is the moov atom of an MP4 file, read ahead when it comes
+// after the media data. Players read it just after the start of the file,
+// so it is fetched while they do, and their request for it is answered
+// without going back to the store.
+type moovAtom struct {
+	info  fedora.ContentInfo // of the whole file
+	size  int64              // of the whole file
+	start int64              // where the atom is in the file
+	data  []byte
+}
+
+// holds is true if the content at pos is in the atom.
+func (a *moovAtom) holds(pos int64) bool {
+	return pos >= a.start && pos < a.start+int64(len(a.data))
+}
+
+// A moovCache holds the moov atoms read ahead, by the location and version
+// of their file. The zero value is ready to use.
+type moovCache struct {
+	atoms map[string]*moovAtom // nil while being read, or if there is none
+}
+
+// moovLock guards the atoms of every moovCache.
+var moovLock sync.Mutex
+
+// get returns the atom read ahead for key, or nil.
+func (mc *moovCache) get(key string) *moovAtom {
+	moovLock.Lock()
+	defer moovLock.Unlock()
+	return mc.atoms[key]
+}
+
+// readAhead starts reading the moov atom of the file at url in the
+// background, unless that has been done already. Files whose moov atom
+// comes first, and those it cannot be found in, are remembered as having
+// none, so they are only looked at once.
+func (mc *moovCache) readAhead(store *ExternalStore, key, url string, size int64, info fedora.ContentInfo) {
+	moovLock.Lock()
+	if _, ok := mc.atoms[key]; ok {
+		moovLock.Unlock()
+		return
+	}
+	if mc.atoms == nil {
+		mc.atoms = make(map[string]*moovAtom)
+	}
+	for k := range mc.atoms {
+		if len(mc.atoms) < moovFiles {
+			break
+		}
+		delete(mc.atoms, k)
+	}
+	mc.atoms[key] = nil
+	moovLock.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), moovTimeout)
+		defer cancel()
+		start, data, err := readMoov(ctx, store, url, size)
+		if err != nil {
+			log.Printf("Reading moov of %s: %s", url, err)
+			return
+		}
+		if data == nil {
+			return
+		}
+		info.MD5 = ""
+		info.SHA256 = ""
+		moovLock.Lock()
+		if _, ok := mc.atoms[key]; ok {
+			mc.atoms[key] = &moovAtom{info: info, size: size, start: start, data: data}
+		}
+		moovLock.Unlock()
+	}()
+}
+
+// errNoRanges is returned when a store answers a range request with the
+// whole content.
+var errNoRanges = errors.New("store does not support ranges")
+
+// readMoov walks the top level atoms of the MP4 file at url and returns
+// its moov atom and where it starts, if it comes after the media data.
+// The data is nil if the moov atom comes first, since players get it with
+// the start of the file, or if it is not found or too large.
+func readMoov(ctx context.Context, store *ExternalStore, url string, size int64) (int64, []byte, error) {
+	var offset int64
+	var mdat bool
+	for i := 0; i < moovAtoms && offset+8 <= size; i++ {
+		n := int64(16)
+		if offset+n > size {
+			n = 8
+		}
+		header, err := readRange(ctx, store, url, offset, n)
+		if err != nil {
+			return 0, nil, err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		switch length {
+		case 0:
+			// the atom goes to the end of the file
+			length = size - offset
+		case 1:
+			if n < 16 {
+				return 0, nil, nil
+			}
+			length = int64(binary.BigEndian.Uint64(header[8:]))
+		}
+		if length < 8 || length > size-offset {
+			// not an MP4 file, or a damaged one
+			return 0, nil, nil
+		}
+		switch kind {
+		case "mdat":
+			mdat = true
+		case "moov":
+			if !mdat || length > moovMax {
+				return 0, nil, nil
+			}
+			data, err := readRange(ctx, store, url, offset, length)
+			return offset, data, err
+		}
+		offset += length
+	}
+	return 0, nil, nil
+}
+
+// readRange returns n bytes of the content at url, starting at offset.
+func readRange(ctx context.Context, store *ExternalStore, url string, offset, n int64) ([]byte, error) {
+	body, _, start, err := store.getExternalRange(ctx, url, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if start != offset {
+		return nil, errNoRanges
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(body, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// mediaOffset returns where the earliest range in a Range header starts,
+// or 0 if it is counted from the end, since the size is not known yet.
+func mediaOffset(header string) int64 {
+	ranges, ok := parseRanges(header, math.MaxInt64)
+	if !ok || len(ranges) == 0 {
+		return 0
+	}
+	offset := ranges[0].start
+	for _, br := range ranges[1:] {
+		if br.start < offset {
+			offset = br.start
+		}
+	}
+	if offset > math.MaxInt64/2 {
+		return 0
+	}
+	return offset
+}
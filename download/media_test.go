@@ -0,0 +1,265 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A rangeTarget serves content with support for range requests, and
+// counts the requests and the number of bytes sent.
+type rangeTarget struct {
+	content  []byte
+	requests int
+	ranges   int
+}
+
+func (t *rangeTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.requests++
+	if r.Header.Get("Range") != "" {
+		t.ranges++
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(t.content))
+}
+
+func TestRangeSeeker(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100000))
+	target := &rangeTarget{content: content}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	store := &ExternalStore{}
+	body, _, err := store.getExternalContent(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := newRangeSeeker(context.Background(), store, server.URL, body, 0, int64(len(content)))
+	defer rs.Close()
+
+	var table = []struct {
+		pos      int64
+		requests int
+	}{
+		{0, 1},      // the original stream
+		{100, 1},    // read ahead
+		{900000, 2}, // far ahead, use a range
+		{5, 3},      // backwards
+	}
+	for _, s := range table {
+		rs.Seek(s.pos, 0)
+		buf := make([]byte, 10)
+		_, err := rs.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, content[s.pos:s.pos+10]) {
+			t.Errorf("At %d expected %q, got %q", s.pos, content[s.pos:s.pos+10], buf)
+		}
+		if target.requests != s.requests {
+			t.Errorf("At %d expected %d requests, got %d", s.pos, s.requests, target.requests)
+		}
+	}
+	if _, err := rs.Seek(int64(len(content))+1, 0); err == nil {
+		t.Errorf("Expected error seeking past the end")
+	}
+}
+
+func TestMediaDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100000))
+	target := &rangeTarget{content: content}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:video", "content",
+		fedora.DsInfo{Location: server.URL + "/video", LocationType: "URL", MIMEType: "video/webm"},
+		nil)
+	dh.Media = true
+
+	setRange := func(r *http.Request) { r.Header.Set("Range", "bytes=999990-") }
+	resp, body := checkRouteX(t, "GET", ts.URL+"/video", 206, "", setRange)
+	if string(body) != "0123456789" {
+		t.Errorf("Expected last 10 bytes, got %q", body)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Expected Accept-Ranges header")
+	}
+	if target.requests != 1 || target.ranges != 1 {
+		t.Errorf("Expected a single range request to store, got %d of %d", target.ranges, target.requests)
+	}
+	checkRouteX(t, "GET", ts.URL+"/video", 416, "", func(r *http.Request) {
+		r.Header.Set("Range", "bytes=2000000-")
+	})
+	// the size is needed before ranges from the end can be found
+	target.requests, target.ranges = 0, 0
+	checkRouteX(t, "GET", ts.URL+"/video", 206, "0123456789", func(r *http.Request) {
+		r.Header.Set("Range", "bytes=-10")
+	})
+	if target.requests != 2 || target.ranges != 1 {
+		t.Errorf("Expected 2 requests, got %d", target.requests)
+	}
+
+	// without range requests the whole stream is read
+	dh.Media = false
+	target.ranges = 0
+	_, body = checkRouteX(t, "GET", ts.URL+"/video", 206, "", setRange)
+	if string(body) != "0123456789" || target.ranges != 0 {
+		t.Errorf("Expected no range requests, got %d", target.ranges)
+	}
+}
+
+func TestMediaScan(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100000))
+	target := &rangeTarget{content: content}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Fedora.(*fedora.TestFedora).Set("test:video", "content",
+		fedora.DsInfo{Location: server.URL + "/video", LocationType: "URL", MIMEType: "video/mp4"},
+		nil)
+	dh.Media = true
+	scanner := &countScanner{}
+	dh.Scan = NewScanGate(scanner, time.Hour)
+
+	// the whole file is scanned before the first range is served
+	setRange := func(r *http.Request) { r.Header.Set("Range", "bytes=999990-") }
+	checkRouteX(t, "GET", ts.URL+"/video", 206, "0123456789", setRange)
+	if scanner.n != 1 || target.ranges != 0 {
+		t.Errorf("Expected a scan of the whole file, got %d scans and %d ranges", scanner.n, target.ranges)
+	}
+	// after which ranges are requested directly
+	target.requests = 0
+	checkRouteX(t, "GET", ts.URL+"/video", 206, "0123456789", setRange)
+	if scanner.n != 1 || target.requests != 1 || target.ranges != 1 {
+		t.Errorf("Expected a single range request, got %d of %d", target.ranges, target.requests)
+	}
+}
+
+// mp4Atom returns an MP4 atom of the given kind holding body.
+func mp4Atom(kind string, body []byte) []byte {
+	atom := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(atom, uint32(8+len(body)))
+	copy(atom[4:], kind)
+	return append(atom, body...)
+}
+
+// A countingTarget is a rangeTarget which may be used from several
+// goroutines.
+type countingTarget struct {
+	m sync.Mutex
+	rangeTarget
+}
+
+func (t *countingTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.m.Lock()
+	t.requests++
+	t.m.Unlock()
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(t.content))
+}
+
+func (t *countingTarget) count() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.requests
+}
+
+func TestMoovReadAhead(t *testing.T) {
+	var content []byte
+	content = append(content, mp4Atom("ftyp", []byte("isom\x00\x00\x02\x00"))...)
+	content = append(content, mp4Atom("mdat", bytes.Repeat([]byte("m"), 100000))...)
+	moovStart := len(content)
+	content = append(content, mp4Atom("moov", bytes.Repeat([]byte("i"), 1000))...)
+	target := &countingTarget{rangeTarget: rangeTarget{content: content}}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dsinfo := fedora.DsInfo{Location: server.URL + "/movie", LocationType: "URL", MIMEType: "video/mp4", VersionID: "content.0"}
+	dh.Fedora.(*fedora.TestFedora).Set("test:movie", "content", dsinfo, nil)
+	dh.Media = true
+
+	checkRouteX(t, "GET", ts.URL+"/movie", 206, string(content[:100]), func(r *http.Request) {
+		r.Header.Set("Range", "bytes=0-99")
+	})
+	key := dsinfo.Location + "@" + dsinfo.VersionID
+	for i := 0; dh.moovs.get(key) == nil; i++ {
+		if i == 100 {
+			t.Fatal("Expected the moov atom to be read ahead")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// the player asks for the moov atom next, which the store is not asked for
+	before := target.count()
+	checkRouteX(t, "GET", ts.URL+"/movie", 206, string(content[moovStart:]), func(r *http.Request) {
+		r.Header.Set("Range", "bytes="+strconv.Itoa(moovStart)+"-")
+	})
+	if n := target.count() - before; n != 0 {
+		t.Errorf("Expected no requests to the store for the moov atom, got %d", n)
+	}
+	// reads past the atom go to the store
+	checkRouteX(t, "GET", ts.URL+"/movie", 206, string(content[moovStart-10:moovStart+10]), func(r *http.Request) {
+		r.Header.Set("Range", "bytes="+strconv.Itoa(moovStart-10)+"-"+strconv.Itoa(moovStart+9))
+	})
+}
+
+func TestReadMoovFirst(t *testing.T) {
+	var content []byte
+	content = append(content, mp4Atom("ftyp", []byte("isom"))...)
+	content = append(content, mp4Atom("moov", []byte("index"))...)
+	content = append(content, mp4Atom("mdat", []byte("media"))...)
+	server := httptest.NewServer(&rangeTarget{content: content})
+	defer server.Close()
+
+	_, data, err := readMoov(context.Background(), &ExternalStore{}, server.URL, int64(len(content)))
+	if err != nil || data != nil {
+		t.Errorf("Expected no read ahead for a moov atom before the media, got %q, %v", data, err)
+	}
+}
+
+func TestMediaPage(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	content := strings.Repeat("0123456789", 100)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:clip", "content", fedora.DsInfo{MIMEType: "video/webm"}, []byte(content))
+	tf.Set("test:data", "content", fedora.DsInfo{MIMEType: "application/octet-stream"}, []byte(content))
+	dh.Media = true
+	dh.MediaPage = 100
+
+	var table = []struct {
+		route, header string
+		expected      string
+	}{
+		{"/clip", "bytes=0-", content[:100]},
+		{"/clip", "bytes=950-", content[950:]},
+		{"/clip", "bytes=0-499", content[:500]},
+		{"/data", "bytes=0-", content},
+	}
+	for _, s := range table {
+		resp, _ := checkRouteX(t, "GET", ts.URL+s.route, 206, s.expected, func(r *http.Request) {
+			r.Header.Set("Range", s.header)
+		})
+		if resp != nil && s.route == "/clip" && s.header == "bytes=0-" {
+			if cr := resp.Header.Get("Content-Range"); cr != "bytes 0-99/1000" {
+				t.Errorf("Expected a first page, got %q", cr)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package download
+
+import (
+	"container/list"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A MemoryCache is a bounded in-memory cache of datastream contents, for
+// keeping small, frequently requested items such as thumbnails. Items are
+// evicted in least-recently-used order once the total size of the cache
+// would exceed MaxSize. Items larger than MaxItem are never cached.
+//
+// Keys should include the datastream version so that an item is never used
+// once fedora has a newer version. Old versions will eventually age out.
+//
+// A nil *MemoryCache is a cache which is always empty. The implementation is
+// safe to be called by multiple goroutines.
+type MemoryCache struct {
+	MaxSize int64 // total size of all items, in bytes
+	MaxItem int64 // size of the largest item to keep, in bytes
+
+	m     sync.Mutex
+	size  int64
+	lru   *list.List // of *CachedItem, most recently used at the front
+	items map[string]*list.Element
+}
+
+// A CachedItem is the content of a datastream along with the metadata
+// returned when it was fetched.
+type CachedItem struct {
+	Key  string
+	Info fedora.ContentInfo
+	Data []byte
+}
+
+// NewMemoryCache returns an empty cache.
+func NewMemoryCache(maxSize, maxItem int64) *MemoryCache {
+	return &MemoryCache{
+		MaxSize: maxSize,
+		MaxItem: maxItem,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns the item having the given key, if there is one.
+func (mc *MemoryCache) Get(key string) (*CachedItem, bool) {
+	if mc == nil {
+		return nil, false
+	}
+	mc.m.Lock()
+	defer mc.m.Unlock()
+	e, ok := mc.items[key]
+	if !ok {
+		return nil, false
+	}
+	mc.lru.MoveToFront(e)
+	return e.Value.(*CachedItem), true
+}
+
+// Add puts an item into the cache, replacing any item having the same key.
+func (mc *MemoryCache) Add(item *CachedItem) {
+	if mc == nil {
+		return
+	}
+	n := int64(len(item.Data))
+	if n > mc.MaxItem || n > mc.MaxSize {
+		return
+	}
+	mc.m.Lock()
+	defer mc.m.Unlock()
+	if e, ok := mc.items[item.Key]; ok {
+		mc.remove(e)
+	}
+	for mc.size+n > mc.MaxSize {
+		mc.remove(mc.lru.Back())
+	}
+	mc.items[item.Key] = mc.lru.PushFront(item)
+	mc.size += n
+}
+
+// remove deletes the given element. The lock must be held.
+func (mc *MemoryCache) remove(e *list.Element) {
+	item := mc.lru.Remove(e).(*CachedItem)
+	delete(mc.items, item.Key)
+	mc.size -= int64(len(item.Data))
+}
+
+// Filler wraps the content for key so that it is added to the cache once it
+// has been completely read. If there is a checksum, as for a DiskCache, the
+// content is only added if it matches, so corrupt content is never served
+// from the cache. The content is returned unchanged if it is not cacheable.
+func (mc *MemoryCache) Filler(key string, dsinfo fedora.DsInfo, info fedora.ContentInfo, content io.ReadCloser) io.ReadCloser {
+	if mc == nil {
+		return content
+	}
+	n, err := strconv.ParseInt(info.Length, 10, 64)
+	if err != nil || n <= 0 || n > mc.MaxItem {
+		return content
+	}
+	h, expected := contentChecksum(dsinfo, info)
+	return &memoryFiller{
+		ReadCloser: content,
+		cache:      mc,
+		item:       &CachedItem{Key: key, Info: info, Data: make([]byte, 0, n)},
+		expect:     n,
+		h:          h,
+		checksum:   expected,
+	}
+}
+
+// memoryFiller copies everything read from a stream into a buffer, and adds
+// the buffer to the cache once the expected number of bytes has been read,
+// and verified if h is set.
+type memoryFiller struct {
+	io.ReadCloser
+	cache    *MemoryCache
+	item     *CachedItem
+	expect   int64
+	h        hash.Hash
+	checksum string
+}
+
+func (f *memoryFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.item == nil {
+		return n, err
+	}
+	if int64(len(f.item.Data)+n) > f.expect {
+		// the stream is longer than advertised. Don't cache it.
+		f.item = nil
+		return n, err
+	}
+	f.item.Data = append(f.item.Data, p[:n]...)
+	if int64(len(f.item.Data)) == f.expect {
+		if f.h != nil {
+			f.h.Write(f.item.Data)
+			if sum := hex.EncodeToString(f.h.Sum(nil)); sum != f.checksum {
+				log.Printf("memcache: checksum mismatch for %s: expected %s, got %s", f.item.Key, f.checksum, sum)
+				f.item = nil
+				return n, err
+			}
+		}
+		f.cache.Add(f.item)
+		f.item = nil
+	}
+	return n, err
+}
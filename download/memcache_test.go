@@ -0,0 +1,81 @@
+package download
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestMemoryCache(t *testing.T) {
+	mc := NewMemoryCache(10, 5)
+	mc.Add(&CachedItem{Key: "a", Data: []byte("aaaa")})
+	mc.Add(&CachedItem{Key: "b", Data: []byte("bbbb")})
+	mc.Add(&CachedItem{Key: "big", Data: []byte("too big")})
+	if _, ok := mc.Get("big"); ok {
+		t.Errorf("Expected item larger than MaxItem to be skipped")
+	}
+	// make a more recently used than b
+	if _, ok := mc.Get("a"); !ok {
+		t.Errorf("Expected a to be in cache")
+	}
+	mc.Add(&CachedItem{Key: "c", Data: []byte("cccc")})
+	if _, ok := mc.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, ok := mc.Get("a"); !ok {
+		t.Errorf("Expected a to be in cache")
+	}
+	// replacing an item updates the size
+	mc.Add(&CachedItem{Key: "c", Data: []byte("c")})
+	if mc.size != 5 {
+		t.Errorf("Expected size 5, got %d", mc.size)
+	}
+
+	var nilcache *MemoryCache
+	nilcache.Add(&CachedItem{Key: "a", Data: []byte("a")})
+	if _, ok := nilcache.Get("a"); ok {
+		t.Errorf("Expected nil cache to be empty")
+	}
+}
+
+func TestMemoryFiller(t *testing.T) {
+	mc := NewMemoryCache(100, 50)
+	info := fedora.ContentInfo{Length: "11"}
+	r := mc.Filler("k", fedora.DsInfo{}, info, ioutil.NopCloser(strings.NewReader("hello world")))
+	ioutil.ReadAll(r)
+	item, ok := mc.Get("k")
+	if !ok || string(item.Data) != "hello world" {
+		t.Errorf("Expected item to be cached, got %v", item)
+	}
+
+	// partial reads are not cached
+	r = mc.Filler("partial", fedora.DsInfo{}, info, ioutil.NopCloser(strings.NewReader("hello world")))
+	r.Read(make([]byte, 5))
+	if _, ok := mc.Get("partial"); ok {
+		t.Errorf("Expected partial read to not be cached")
+	}
+
+	// streams longer than their length are not cached
+	info.Length = "5"
+	r = mc.Filler("long", fedora.DsInfo{}, info, ioutil.NopCloser(strings.NewReader("hello world")))
+	ioutil.ReadAll(r)
+	if _, ok := mc.Get("long"); ok {
+		t.Errorf("Expected long stream to not be cached")
+	}
+
+	// content must match its checksum
+	info.Length = "11"
+	dsinfo := fedora.DsInfo{ChecksumType: "MD5", Checksum: "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+	r = mc.Filler("good", dsinfo, info, ioutil.NopCloser(strings.NewReader("hello world")))
+	ioutil.ReadAll(r)
+	if _, ok := mc.Get("good"); !ok {
+		t.Errorf("Expected verified content to be cached")
+	}
+	r = mc.Filler("corrupt", dsinfo, info, ioutil.NopCloser(strings.NewReader("hello wurld")))
+	ioutil.ReadAll(r)
+	if _, ok := mc.Get("corrupt"); ok {
+		t.Errorf("Expected corrupt content to not be cached")
+	}
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultMethods are the methods a DownloadHandler allows when its Methods
+// list is empty.
+var defaultMethods = []string{"GET", "HEAD"}
+
+// ParseMethods checks a list of methods for a DownloadHandler, returning
+// them in upper case. Only GET, HEAD, and OPTIONS are supported.
+func ParseMethods(list []string) ([]string, error) {
+	var result []string
+	for _, m := range list {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			return nil, fmt.Errorf("unsupported method %q", m)
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func (dh *DownloadHandler) methods() []string {
+	if len(dh.Methods) == 0 {
+		return defaultMethods
+	}
+	return dh.Methods
+}
+
+// checkMethod returns true if the request should be served. Otherwise it
+// has replied, either to an OPTIONS request or with a 405 error.
+func (dh *DownloadHandler) checkMethod(w http.ResponseWriter, r *http.Request) bool {
+	methods := dh.methods()
+	for _, m := range methods {
+		if m != r.Method {
+			continue
+		}
+		if m == "OPTIONS" {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			w.WriteHeader(http.StatusNoContent)
+			return false
+		}
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	return false
+}
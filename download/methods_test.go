@@ -0,0 +1,37 @@
+package download
+
+import (
+	"testing"
+)
+
+func TestParseMethods(t *testing.T) {
+	m, err := ParseMethods([]string{"get", " OPTIONS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0] != "GET" || m[1] != "OPTIONS" {
+		t.Errorf("Unexpected methods %v", m)
+	}
+	if _, err := ParseMethods([]string{"GET", "POST"}); err == nil {
+		t.Errorf("Expected an error for POST")
+	}
+}
+
+func TestMethods(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	resp, _ := checkRouteX(t, "OPTIONS", ts.URL+"/0123", 405, "", nil)
+	if a := resp.Header.Get("Allow"); a != "GET, HEAD" {
+		t.Errorf("Expected Allow GET, HEAD, got %q", a)
+	}
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Methods = []string{"GET", "OPTIONS"}
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	checkRoute(t, "HEAD", ts.URL+"/0123", 405, "")
+	resp, _ = checkRouteX(t, "OPTIONS", ts.URL+"/0123", 204, "", nil)
+	if a := resp.Header.Get("Allow"); a != "GET, OPTIONS" {
+		t.Errorf("Expected Allow GET, OPTIONS, got %q", a)
+	}
+}
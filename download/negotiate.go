@@ -0,0 +1,139 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// An Alternate is another format of a handler's datastream, kept in a
+// different datastream. For example, a webp derivative of an image.
+// Handler serves the alternate datastream; it should be configured like
+// the original handler other than its Ds.
+type Alternate struct {
+	Type    string // MIME type of the alternate, e.g. "image/webp"
+	Handler *DownloadHandler
+}
+
+// NewAlternate returns an alternate served from another datastream, using
+// the settings of dh. The description has the form "type datastream".
+func (dh *DownloadHandler) NewAlternate(description string) (Alternate, error) {
+	fields := strings.Fields(description)
+	if len(fields) != 2 {
+		return Alternate{}, fmt.Errorf("alternate %q: expected type and datastream", description)
+	}
+	return Alternate{Type: fields[0], Handler: dh.withDatastream(fields[1])}, nil
+}
+
+// withDatastream returns a handler serving the datastream ds of the same
+// objects, using the settings of dh. It shares the caches of dh, but
+// does not remember missing identifiers since the original datastream may
+// exist. The alternates and qualities of dh are not its own.
+func (dh *DownloadHandler) withDatastream(ds string) *DownloadHandler {
+	// the flights and moov atoms of dh may be changing
+	flightLock.Lock()
+	moovLock.Lock()
+	c := *dh
+	moovLock.Unlock()
+	flightLock.Unlock()
+	c.Ds = ds
+	c.NotFound = nil
+	c.Alternates = nil
+	c.Qualities = nil
+	c.flights = flightGroup{}
+	c.moovs = moovCache{}
+	return &c
+}
+
+// negotiate returns the alternate to serve instead of the datastream
+// described by dsinfo, if the request's Accept header prefers one which
+// exists for pid. Alternates are only chosen when the Accept header names
+// their type explicitly and gives it at least the quality of the original.
+// Earlier alternates are preferred over later ones with the same quality.
+func (dh *DownloadHandler) negotiate(pid string, dsinfo fedora.DsInfo, w http.ResponseWriter, r *http.Request) (*DownloadHandler, fedora.DsInfo, bool) {
+	if len(dh.Alternates) == 0 {
+		return nil, dsinfo, false
+	}
+	addVary(w.Header(), "Accept")
+	accept := parseAccept(r.Header["Accept"])
+	original, _ := accept.quality(dsinfo.MIMEType)
+	for _, alt := range dh.Alternates {
+		q, exact := accept.quality(alt.Type)
+		if !exact || q <= 0 || q < original || alt.Type == dsinfo.MIMEType {
+			continue
+		}
+		if altinfo, ok := alt.Handler.activeInfo(pid); ok {
+			return alt.Handler, altinfo, true
+		}
+	}
+	return nil, dsinfo, false
+}
+
+// activeInfo returns the info for the handler's datastream of pid, if it
+// exists and is active.
+func (dh *DownloadHandler) activeInfo(pid string) (fedora.DsInfo, bool) {
+	dsinfo, err := dh.Fedora.GetDatastreamInfo(pid, dh.Ds)
+	if err != nil {
+		if err != fedora.ErrNotFound {
+			log.Printf("Received Fedora error (%s,%s): %s", pid, dh.Ds, err)
+		}
+		return dsinfo, false
+	}
+	return dsinfo, dsinfo.State == "A"
+}
+
+// acceptList is a parsed Accept header, mapping media ranges such as
+// "image/webp", "image/*", or "*/*" to their quality.
+type acceptList map[string]float64
+
+func parseAccept(headers []string) acceptList {
+	result := make(acceptList)
+	for _, header := range headers {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			result[name] = q
+		}
+	}
+	return result
+}
+
+// quality returns the quality the accept list gives the MIME type, using
+// the most specific matching range, and whether the type was named
+// explicitly. An empty list accepts everything.
+func (a acceptList) quality(mimetype string) (float64, bool) {
+	t, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return 0, false
+	}
+	if len(a) == 0 {
+		return 1, false
+	}
+	if q, ok := a[t]; ok {
+		return q, true
+	}
+	if i := strings.Index(t, "/"); i >= 0 {
+		if q, ok := a[t[:i]+"/*"]; ok {
+			return q, false
+		}
+	}
+	if q, ok := a["*/*"]; ok {
+		return q, false
+	}
+	return 0, false
+}
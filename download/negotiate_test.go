@@ -0,0 +1,92 @@
+package download
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	accept := parseAccept([]string{"image/avif,image/webp,image/apng,image/*;q=0.9, */*;q=0.8"})
+	var table = []struct {
+		mimetype string
+		q        float64
+		exact    bool
+	}{
+		{"image/webp", 1, true},
+		{"image/jpeg", 0.9, false},
+		{"text/plain; charset=utf-8", 0.8, false},
+		{"bad type", 0, false},
+	}
+	for _, s := range table {
+		q, exact := accept.quality(s.mimetype)
+		if q != s.q || exact != s.exact {
+			t.Errorf("%s: expected %v %v, got %v %v", s.mimetype, s.q, s.exact, q, exact)
+		}
+	}
+	if q, _ := parseAccept(nil).quality("image/png"); q != 1 {
+		t.Errorf("Expected missing Accept to accept everything, got %v", q)
+	}
+}
+
+func TestAlternates(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:image", "content", fedora.DsInfo{MIMEType: "image/jpeg"}, []byte("jpeg"))
+	tf.Set("test:image", "webp", fedora.DsInfo{MIMEType: "image/webp"}, []byte("webp"))
+	tf.Set("test:image", "avif", fedora.DsInfo{MIMEType: "image/avif", State: "D"}, []byte("avif"))
+	for _, desc := range []string{"image/avif avif", "image/webp webp"} {
+		alt, err := dh.NewAlternate(desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dh.Alternates = append(dh.Alternates, alt)
+	}
+	if _, err := dh.NewAlternate("image/webp"); err == nil {
+		t.Errorf("Expected error for bad alternate")
+	}
+
+	var table = []struct {
+		route, accept, expected string
+	}{
+		{"/image", "", "jpeg"},
+		{"/image", "image/avif,image/webp,image/*,*/*;q=0.8", "webp"},
+		{"/image", "image/webp;q=0.5,image/jpeg", "jpeg"},
+		{"/image", "image/webp;q=0", "jpeg"},
+		{"/0123", "image/webp", "hello"},
+	}
+	for _, s := range table {
+		resp, _ := checkRouteX(t, "GET", ts.URL+s.route, 200, s.expected, func(r *http.Request) {
+			if s.accept != "" {
+				r.Header.Set("Accept", s.accept)
+			}
+		})
+		if resp.Header.Get("Vary") != "Accept" {
+			t.Errorf("%s %s: Expected Vary: Accept, got %v", s.route, s.accept, resp.Header["Vary"])
+		}
+	}
+}
+
+func TestWithDatastream(t *testing.T) {
+	dh := &DownloadHandler{
+		Ds:         "content",
+		Methods:    []string{"GET"},
+		Canonical:  true,
+		ZipStrict:  true,
+		LastKnown:  &LocationCache{},
+		NotFound:   NewTimeCache(0),
+		Alternates: []Alternate{{Type: "image/webp"}},
+		Qualities:  map[string]*DownloadHandler{"low": nil},
+	}
+	c := dh.withDatastream("webp")
+	if c.Ds != "webp" || len(c.Methods) != 1 || !c.Canonical || !c.ZipStrict || c.LastKnown != dh.LastKnown {
+		t.Errorf("Expected the settings to be copied, got %+v", c)
+	}
+	if c.NotFound != nil || c.Alternates != nil || c.Qualities != nil {
+		t.Errorf("Expected the datastream's own settings to be reset, got %+v", c)
+	}
+}
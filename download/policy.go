@@ -0,0 +1,136 @@
+package download
+
+import (
+	"encoding/xml"
+	"log"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// isGovernedBy is the relationship from an object to its admin policy
+// object.
+const isGovernedBy = "http://projecthydra.org/ns/relations#isGovernedBy"
+
+// isMemberOfCollection is the default relationship from an object to its
+// parent collections.
+const isMemberOfCollection = "info:fedora/fedora-system:def/relations-external#isMemberOfCollection"
+
+// relsExt is the part of a RELS-EXT datastream which is used: the
+// relationships to other objects.
+type relsExt struct {
+	Descriptions []struct {
+		Relations []struct {
+			XMLName  xml.Name
+			Resource string `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# resource,attr"`
+		} `xml:",any"`
+	} `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# Description"`
+}
+
+// related returns the identifiers of the objects pid has the relationship
+// predicate to, according to its RELS-EXT. Objects without a RELS-EXT are
+// related to nothing.
+func (ha *HydraAuth) related(pid, predicate string) ([]string, error) {
+	body, _, err := ha.Fedora.GetDatastream(pid, "RELS-EXT")
+	if err == fedora.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var rels relsExt
+	err = xml.NewDecoder(body).Decode(&rels)
+	if err != nil {
+		log.Printf("Bad RELS-EXT for %s: %s", pid, err)
+		return nil, nil
+	}
+	var result []string
+	for _, d := range rels.Descriptions {
+		for _, rel := range d.Relations {
+			if rel.XMLName.Space+rel.XMLName.Local != predicate {
+				continue
+			}
+			if target := strings.TrimPrefix(rel.Resource, "info:fedora/"); target != "" {
+				result = append(result, target)
+			}
+		}
+	}
+	return result, nil
+}
+
+// inheritedRights returns the rights of the object pid, from Inherited if
+// it was looked up recently.
+func (ha *HydraAuth) inheritedRights(pid string) (*hydraRights, error) {
+	if v, ok := ha.Inherited.Get(pid); ok {
+		return v.(*hydraRights), nil
+	}
+	rights, err := ha.readRights(pid)
+	if err == ErrDenied {
+		// unreadable rights grant nothing, and stay unreadable
+		rights, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ha.Inherited.Set(pid, rights)
+	return rights, nil
+}
+
+// inheritPolicy adds the rights of the admin policy object governing pid
+// to its rights, which may be nil.
+func (ha *HydraAuth) inheritPolicy(pid string, rights *hydraRights) (*hydraRights, error) {
+	policies, err := ha.related(pid, isGovernedBy)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		inherited, err := ha.inheritedRights(policy)
+		if err != nil {
+			return nil, err
+		}
+		rights = rights.merge(inherited)
+	}
+	return rights, nil
+}
+
+// inheritCollections adds the rights of the nearest parent collections of
+// pid which grant access, up to CollectionDepth levels up, to its rights,
+// which may be nil. Collections are searched a level at a time, and the
+// rights of every collection on the first level granting access are used.
+func (ha *HydraAuth) inheritCollections(pid string, rights *hydraRights) (*hydraRights, error) {
+	predicate := ha.CollectionPredicate
+	if predicate == "" {
+		predicate = isMemberOfCollection
+	}
+	level := []string{pid}
+	seen := map[string]bool{pid: true}
+	for depth := 0; depth < ha.CollectionDepth && len(level) > 0; depth++ {
+		var parents []string
+		var found *hydraRights
+		for _, child := range level {
+			related, err := ha.related(child, predicate)
+			if err != nil {
+				return nil, err
+			}
+			for _, parent := range related {
+				if seen[parent] {
+					continue
+				}
+				seen[parent] = true
+				parents = append(parents, parent)
+				inherited, err := ha.inheritedRights(parent)
+				if err != nil {
+					return nil, err
+				}
+				if inherited.grants() {
+					found = found.merge(inherited)
+				}
+			}
+		}
+		if found != nil {
+			return rights.merge(found), nil
+		}
+		level = parents
+	}
+	return rights, nil
+}
@@ -0,0 +1,42 @@
+package download
+
+import (
+	"strings"
+)
+
+// splitPrefix divides an identifier into a pid prefix and the rest. If the
+// identifier starts with Prefix or one of Prefixes, that prefix is used,
+// e.g. "temp:abc123" is split into "temp:" and "abc123". Otherwise the
+// identifier is returned unchanged along with Prefix.
+func (dh *DownloadHandler) splitPrefix(id string) (string, string) {
+	best := ""
+	for _, p := range append([]string{dh.Prefix}, dh.Prefixes...) {
+		if p != "" && strings.HasPrefix(id, p) && len(p) > len(best) {
+			best = p
+		}
+	}
+	if best == "" {
+		return dh.Prefix, id
+	}
+	return best, id[len(best):]
+}
+
+// allowedPrefix returns true if prefix is Prefix or one of Prefixes.
+func (dh *DownloadHandler) allowedPrefix(prefix string) bool {
+	if prefix == dh.Prefix {
+		return true
+	}
+	for _, p := range dh.Prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPid returns true if pid is in one of the handler's namespaces.
+// Every pid is allowed if Prefix is empty.
+func (dh *DownloadHandler) allowedPid(pid string) bool {
+	prefix, _ := dh.splitPrefix(pid)
+	return strings.HasPrefix(pid, prefix)
+}
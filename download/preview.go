@@ -0,0 +1,108 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Preview says how much of a datastream of the given MIME type to send
+// to users who may not download all of it, such as for embargoed items.
+// Type may be a wildcard such as "audio/*".
+type Preview struct {
+	Type  string
+	Bytes int64
+}
+
+// ParsePreview parses a preview from a string of the form "type bytes",
+// such as "audio/mpeg 480000".
+func ParsePreview(s string) (Preview, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Preview{}, fmt.Errorf("preview %q: expected a MIME type and a number of bytes", s)
+	}
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || n <= 0 {
+		return Preview{}, fmt.Errorf("preview %q: bad number of bytes", s)
+	}
+	return Preview{Type: fields[0], Bytes: n}, nil
+}
+
+// previewLength returns how many bytes of a datastream of the given type
+// to send, using the first matching preview.
+func (dh *DownloadHandler) previewLength(mimetype string) (int64, bool) {
+	for _, p := range dh.Previews {
+		if matchType([]string{p.Type}, mimetype) {
+			return p.Bytes, true
+		}
+	}
+	return 0, false
+}
+
+// servePreview replies with the beginning of the datastream of pid
+// described by dsinfo. The X-Preview header marks the response as
+// truncated, and X-Full-Length gives the size of the whole datastream, if
+// it is known. Types without a preview get a 403 error. Previews are
+// never compressed, and do not support ranges.
+func (dh *DownloadHandler) servePreview(pid string, dsinfo fedora.DsInfo, w http.ResponseWriter, r *http.Request) {
+	limit, ok := dh.previewLength(dsinfo.MIMEType)
+	if !ok {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	etag := dh.etag(dsinfo)
+	etag = etag[:len(etag)-1] + "-preview" + strconv.FormatInt(limit, 10) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", dh.cacheControl())
+	w.Header().Set("X-Preview", "true")
+	if etagMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, info, ok := dh.cached(dh.cacheKey(pid, dsinfo))
+	if !ok {
+		var err error
+		content, info, err = dh.getContent(r.Context(), pid, dsinfo)
+		if err != nil {
+			writeContentError(w, r, err)
+			return
+		}
+	}
+	defer content.Close()
+
+	filename := dsinfo.Label
+	if name := sanitizeFilename(r.FormValue("filename")); name != "" {
+		filename = name
+	}
+	kind, mimetype := dh.disposition(r, dsinfo.MIMEType)
+	w.Header().Set("Content-Disposition", contentDisposition(kind, filename))
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	size, err := strconv.ParseInt(info.Length, 10, 64)
+	if err != nil || size < 0 {
+		size, ok = dsinfo.KnownSize()
+		if !ok {
+			size = -1
+		}
+	}
+	if size >= 0 {
+		w.Header().Set("X-Full-Length", strconv.FormatInt(size, 10))
+		if size < limit {
+			limit = size
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(limit, 10))
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	_, err = CopyBuffer(w, io.LimitReader(content, limit))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,92 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestParsePreview(t *testing.T) {
+	p, err := ParsePreview("audio/* 100")
+	if err != nil || p != (Preview{Type: "audio/*", Bytes: 100}) {
+		t.Errorf("Got %v, %v", p, err)
+	}
+	for _, s := range []string{"", "audio/*", "audio/* x", "audio/* 0", "audio/* 1 2"} {
+		if _, err := ParsePreview(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:a", "content", fedora.DsInfo{MIMEType: "audio/mpeg"}, []byte("0123456789"))
+	tf.Set("test:b", "content", fedora.DsInfo{MIMEType: "audio/mpeg"}, []byte("012"))
+	tf.Set("test:r", "content", fedora.DsInfo{
+		ControlGroup: "R",
+		Location:     "http://bendo/item/r",
+		LocationType: "URL",
+		MIMEType:     "audio/mpeg",
+	}, []byte("0123456789"))
+	tf.Set("test:p", "content", fedora.DsInfo{MIMEType: "application/pdf"}, []byte("pdf"))
+	dh := &DownloadHandler{
+		Fedora:   tf,
+		Ds:       "content",
+		Prefix:   "test:",
+		Redirect: RedirectFound,
+		Previews: []Preview{{Type: "audio/*", Bytes: 4}},
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/a", 200, "0123", nil)
+	if resp.Header.Get("X-Preview") != "true" || resp.Header.Get("X-Full-Length") != "10" {
+		t.Errorf("Expected preview headers, got %v", resp.Header)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || etag == dh.etag(fedora.DsInfo{}) {
+		t.Errorf("Expected a preview etag, got %q", etag)
+	}
+	checkRouteX(t, "GET", ts.URL+"/a", 304, "", func(r *http.Request) {
+		r.Header.Set("If-None-Match", etag)
+	})
+	// shorter than the preview
+	checkRoute(t, "GET", ts.URL+"/b", 200, "012")
+	// previews are never redirected
+	checkRoute(t, "GET", ts.URL+"/r", 200, "0123")
+	// types without a preview are refused
+	checkRoute(t, "GET", ts.URL+"/p", 403, "")
+	resp, _ = checkRouteX(t, "HEAD", ts.URL+"/a", 200, "", nil)
+	if resp.ContentLength != 4 {
+		t.Errorf("Expected Content-Length 4, got %d", resp.ContentLength)
+	}
+}
+
+func TestPreviewAuth(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:a", "content", fedora.DsInfo{MIMEType: "audio/mpeg"}, []byte("0123456789"))
+	tf.Set("test:p", "content", fedora.DsInfo{MIMEType: "application/pdf"}, []byte("pdf"))
+	dh := &DownloadHandler{
+		Fedora:   tf,
+		Ds:       "content",
+		Prefix:   "test:",
+		Previews: []Preview{{Type: "audio/*", Bytes: 4}},
+		Auth:     denyAuth{},
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	// denied items get a preview, if their type has one
+	checkRoute(t, "GET", ts.URL+"/a", 200, "0123")
+	checkRoute(t, "GET", ts.URL+"/p", 403, "")
+
+	// allowed ones are sent whole
+	dh.Auth = &BearerAuth{Tokens: map[string]string{"secret": "harvester"}}
+	checkRouteX(t, "GET", ts.URL+"/a", 200, "0123456789", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret")
+	})
+	// and unauthenticated ones are not given a preview
+	checkRoute(t, "GET", ts.URL+"/a", 401, "")
+}
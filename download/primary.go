@@ -0,0 +1,75 @@
+package download
+
+import (
+	"log"
+	"path"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// lookup returns the handler and info for the datastream of pid to serve.
+// This is Ds, or if the object does not have it, the one chosen by
+// fallback. If Ds is empty the datastream is always chosen by fallback.
+func (dh *DownloadHandler) lookup(pid string) (*DownloadHandler, fedora.DsInfo, error) {
+	var dsinfo fedora.DsInfo
+	err := fedora.ErrNotFound
+	if dh.Ds != "" {
+		dsinfo, err = dh.Fedora.GetDatastreamInfo(pid, dh.Ds)
+	}
+	if err == fedora.ErrNotFound {
+		if src, info, ok := dh.fallback(pid); ok {
+			return src, info, nil
+		}
+	}
+	return dh, dsinfo, err
+}
+
+// fallback finds the datastream of pid to use when it has no datastream
+// Ds, for legacy objects which keep their file under other datastream ids
+// and for objects with assorted datastreams. The first active datastream
+// whose label matches one of Labels is used, trying the patterns in
+// order. Failing that, the first one whose MIME type matches one of
+// PrimaryTypes is used, again in order of preference. It returns a
+// handler for that datastream and its info.
+func (dh *DownloadHandler) fallback(pid string) (*DownloadHandler, fedora.DsInfo, bool) {
+	if len(dh.Labels) == 0 && len(dh.PrimaryTypes) == 0 {
+		return nil, fedora.DsInfo{}, false
+	}
+	entries, err := dh.Fedora.ListDatastreams(pid)
+	if err != nil {
+		if err != fedora.ErrNotFound {
+			log.Printf("Received Fedora error listing %s: %s", pid, err)
+		}
+		return nil, fedora.DsInfo{}, false
+	}
+	try := func(e fedora.DsEntry) (*DownloadHandler, fedora.DsInfo, bool) {
+		if e.ID == dh.Ds {
+			return nil, fedora.DsInfo{}, false
+		}
+		src := dh.withDatastream(e.ID)
+		dsinfo, ok := src.activeInfo(pid)
+		return src, dsinfo, ok
+	}
+	for _, pattern := range dh.Labels {
+		for _, e := range entries {
+			if ok, _ := path.Match(pattern, e.Label); !ok {
+				continue
+			}
+			if src, dsinfo, ok := try(e); ok {
+				log.Printf("Using datastream %s of %s, labelled %q", e.ID, pid, e.Label)
+				return src, dsinfo, true
+			}
+		}
+	}
+	for _, pattern := range dh.PrimaryTypes {
+		for _, e := range entries {
+			if !matchType([]string{pattern}, e.MIMEType) {
+				continue
+			}
+			if src, dsinfo, ok := try(e); ok {
+				return src, dsinfo, true
+			}
+		}
+	}
+	return nil, fedora.DsInfo{}, false
+}
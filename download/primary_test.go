@@ -0,0 +1,60 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestLabelFallback(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:legacy", "DC", fedora.DsInfo{Label: "Dublin Core"}, []byte("<dc/>"))
+	tf.Set("test:legacy", "old", fedora.DsInfo{Label: "thesis.pdf", State: "D"}, []byte("deleted"))
+	tf.Set("test:legacy", "file1", fedora.DsInfo{Label: "thesis.pdf"}, []byte("thesis"))
+
+	checkRoute(t, "GET", ts.URL+"/legacy", 404, "")
+
+	dh.Labels = []string{"*.pdf"}
+	checkRoute(t, "GET", ts.URL+"/legacy", 200, "thesis")
+	checkRoute(t, "GET", ts.URL+"/legacy/about", 200, "")
+	// objects having the datastream are unaffected
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/missing", 404, "")
+
+	src, _, ok := dh.fallback("test:legacy")
+	if !ok || src.Ds != "file1" {
+		t.Errorf("Expected datastream file1, got %v", src)
+	}
+	dh.Labels = []string{"*.docx"}
+	checkRoute(t, "GET", ts.URL+"/legacy", 404, "")
+}
+
+func TestPrimaryType(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:mixed", "a-tiff", fedora.DsInfo{MIMEType: "image/tiff"}, []byte("tiff"))
+	tf.Set("test:mixed", "b-pdf", fedora.DsInfo{MIMEType: "application/pdf"}, []byte("pdf"))
+	tf.Set("test:mixed", "c-text", fedora.DsInfo{MIMEType: "text/plain"}, []byte("text"))
+
+	dh.PrimaryTypes = []string{"application/pdf", "image/*"}
+	checkRoute(t, "GET", ts.URL+"/mixed", 200, "pdf")
+	// labels are tried first
+	dh.Labels = []string{"nothing"}
+	checkRoute(t, "GET", ts.URL+"/mixed", 200, "pdf")
+
+	dh.PrimaryTypes = []string{"video/*", "image/*"}
+	checkRoute(t, "GET", ts.URL+"/mixed", 200, "tiff")
+
+	// without a datastream every object is served by type
+	dh.Ds = ""
+	dh.PrimaryTypes = []string{"text/plain"}
+	checkRoute(t, "GET", ts.URL+"/mixed", 200, "text")
+	checkRoute(t, "GET", ts.URL+"/0123", 404, "")
+}
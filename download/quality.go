@@ -0,0 +1,55 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// DefaultQualityDatastream is the naming convention for the datastreams
+// holding renditions of other qualities. {ds} is the handler's datastream
+// and {quality} is the name of the quality.
+const DefaultQualityDatastream = "{ds}-{quality}"
+
+// AddQuality lets clients ask for a rendition of the datastream by adding
+// ?quality=name to a download. The rendition is kept in the datastream
+// given by the template, e.g. "{ds}-{quality}" makes the datastream
+// "content-low" for the quality "low". The quality "original" always
+// means the handler's own datastream.
+func (dh *DownloadHandler) AddQuality(name, template string) error {
+	if name == "" || name == "original" {
+		return fmt.Errorf("quality %q is reserved", name)
+	}
+	if template == "" {
+		template = DefaultQualityDatastream
+	}
+	ds := strings.NewReplacer("{ds}", dh.Ds, "{quality}", name).Replace(template)
+	if ds == dh.Ds {
+		return fmt.Errorf("quality %q: datastream is the same as the original", name)
+	}
+	if dh.Qualities == nil {
+		dh.Qualities = make(map[string]*DownloadHandler)
+	}
+	dh.Qualities[name] = dh.withDatastream(ds)
+	return nil
+}
+
+// quality returns the handler and info for the rendition named by the
+// quality parameter of the request, if there is one and pid has it.
+// Objects without the rendition get the original, so links may always
+// ask for a smaller one. It returns an error if the quality is not one
+// the handler knows.
+func (dh *DownloadHandler) quality(pid string, r *http.Request) (*DownloadHandler, fedora.DsInfo, bool, error) {
+	name := r.FormValue("quality")
+	if name == "" || name == "original" {
+		return nil, fedora.DsInfo{}, false, nil
+	}
+	rendition, ok := dh.Qualities[name]
+	if !ok {
+		return nil, fedora.DsInfo{}, false, fmt.Errorf("unknown quality %q", name)
+	}
+	dsinfo, ok := rendition.activeInfo(pid)
+	return rendition, dsinfo, ok, nil
+}
@@ -0,0 +1,36 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestQuality(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:video", "content", fedora.DsInfo{}, []byte("original"))
+	tf.Set("test:video", "content-low", fedora.DsInfo{}, []byte("low"))
+	for _, name := range []string{"low", "medium"} {
+		if err := dh.AddQuality(name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dh.AddQuality("original", ""); err == nil {
+		t.Errorf("Expected error for reserved quality")
+	}
+	if err := dh.AddQuality("high", "{ds}"); err == nil {
+		t.Errorf("Expected error for quality using the original datastream")
+	}
+
+	checkRoute(t, "GET", ts.URL+"/video", 200, "original")
+	checkRoute(t, "GET", ts.URL+"/video?quality=original", 200, "original")
+	checkRoute(t, "GET", ts.URL+"/video?quality=low", 200, "low")
+	// objects without the rendition get the original
+	checkRoute(t, "GET", ts.URL+"/video?quality=medium", 200, "original")
+	checkRoute(t, "GET", ts.URL+"/video?quality=tiny", 400, "")
+	checkRoute(t, "GET", ts.URL+"/missing?quality=low", 404, "")
+}
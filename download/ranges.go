@@ -0,0 +1,141 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The ways to answer a request for several ranges of a datastream.
+const (
+	// MultiRangeMultipart sends a multipart/byteranges response, with
+	// the ranges sorted and overlapping or nearby ones merged.
+	MultiRangeMultipart = "multipart"
+	// MultiRangeCoalesce sends the single range covering every range.
+	MultiRangeCoalesce = "coalesce"
+	// MultiRangeIgnore sends the whole datastream.
+	MultiRangeIgnore = "ignore"
+)
+
+// ParseMultiRange checks a MultiRange setting. The empty string means
+// MultiRangeMultipart.
+func ParseMultiRange(s string) (string, error) {
+	switch s {
+	case "":
+		return MultiRangeMultipart, nil
+	case MultiRangeMultipart, MultiRangeCoalesce, MultiRangeIgnore:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown multi-range %q", s)
+}
+
+// rangeMergeGap is the largest gap between two ranges which are merged
+// instead of being sent as separate parts. Each part has a boundary and
+// headers of about this size.
+const rangeMergeGap = 80
+
+type byteRange struct {
+	start, end int64 // end is inclusive
+}
+
+// parseRanges returns the ranges in a Range header for content of the
+// given size. Ranges starting past the end are left out. It returns false
+// if the header is not a list of byte ranges.
+func parseRanges(header string, size int64) ([]byteRange, bool) {
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		return nil, false
+	}
+	var result []byteRange
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, false
+		}
+		first, last := spec[:i], spec[i+1:]
+		var br byteRange
+		if first == "" {
+			// the final n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{size - n, size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			br = byteRange{start, size - 1}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+				if end < size {
+					br.end = end
+				}
+			}
+		}
+		if br.start >= size {
+			continue
+		}
+		result = append(result, br)
+	}
+	return result, true
+}
+
+// prepareRanges returns the request to pass to http.ServeContent for
+// content of the given size. Requests for several ranges are rewritten
+// according to MultiRange. Besides saving overhead, sorting the ranges
+// lets them be served from a stream, which can only seek forward.
+func (dh *DownloadHandler) prepareRanges(r *http.Request, size int64) *http.Request {
+	header := r.Header.Get("Range")
+	if !strings.Contains(header, ",") {
+		return r
+	}
+	ranges, ok := parseRanges(header, size)
+	if !ok || len(ranges) == 0 {
+		// let ServeContent reply with an error
+		return r
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	merged := ranges[:1]
+	for _, br := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if dh.MultiRange != MultiRangeCoalesce && br.start > last.end+1+rangeMergeGap {
+			merged = append(merged, br)
+			continue
+		}
+		if br.end > last.end {
+			last.end = br.end
+		}
+	}
+	specs := make([]string, len(merged))
+	for i, br := range merged {
+		specs[i] = fmt.Sprintf("%d-%d", br.start, br.end)
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	if dh.MultiRange == MultiRangeIgnore {
+		r2.Header.Del("Range")
+	} else {
+		r2.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+	}
+	return r2
+}
@@ -0,0 +1,105 @@
+package download
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestParseRanges(t *testing.T) {
+	var sequence = []struct {
+		header string
+		ranges []byteRange
+		ok     bool
+	}{
+		{"bytes=2-7,10-", []byteRange{{2, 7}, {10, 14}}, true},
+		{"bytes=-3, 0-0", []byteRange{{12, 14}, {0, 0}}, true},
+		{"bytes=20-,0-100", []byteRange{{0, 14}}, true},
+		{"bytes=7-2", nil, false},
+		{"items=0-1", nil, false},
+	}
+	for _, s := range sequence {
+		ranges, ok := parseRanges(s.header, 15)
+		if ok != s.ok || len(ranges) != len(s.ranges) {
+			t.Errorf("%s: Expected %v %v, got %v %v", s.header, s.ranges, s.ok, ranges, ok)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i] != s.ranges[i] {
+				t.Errorf("%s: Expected %v, got %v", s.header, s.ranges, ranges)
+			}
+		}
+	}
+}
+
+func TestPrepareRanges(t *testing.T) {
+	var sequence = []struct {
+		mode     string
+		header   string
+		expected string
+	}{
+		{"", "bytes=2-7", "bytes=2-7"},
+		{"", "bytes=500-599,0-9", "bytes=0-9,500-599"},
+		{"", "bytes=0-9,50-59", "bytes=0-59"},
+		{"", "bytes=0-9,5-", "bytes=0-999"},
+		{MultiRangeCoalesce, "bytes=500-599,0-9", "bytes=0-599"},
+		{MultiRangeIgnore, "bytes=500-599,0-9", ""},
+	}
+	for _, s := range sequence {
+		dh := &DownloadHandler{MultiRange: s.mode}
+		r, _ := http.NewRequest("GET", "/abc", nil)
+		r.Header.Set("Range", s.header)
+		r2 := dh.prepareRanges(r, 1000)
+		if got := r2.Header.Get("Range"); got != s.expected {
+			t.Errorf("%s %s: Expected %q, got %q", s.mode, s.header, s.expected, got)
+		}
+		if r.Header.Get("Range") != s.header {
+			t.Errorf("%s %s: original request was changed", s.mode, s.header)
+		}
+	}
+}
+
+func TestMultipleRanges(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	content := strings.Repeat("0123456789", 30)
+	dh.Fedora.(*fedora.TestFedora).Set("test:long", "content",
+		fedora.DsInfo{MIMEType: "text/plain"}, []byte(content))
+
+	// out of order ranges of a stream
+	resp, body := checkRouteX(t, "GET", ts.URL+"/long", 206, "", func(req *http.Request) {
+		req.Header.Set("Range", "bytes=250-259,0-4")
+	})
+	mediatype, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/byteranges" {
+		t.Fatalf("Expected multipart/byteranges, got %q", resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(b))
+	}
+	if len(parts) != 2 || parts[0] != "bytes 0-4/300 01234" || parts[1] != "bytes 250-259/300 0123456789" {
+		t.Errorf("Unexpected parts %q", parts)
+	}
+
+	dh.MultiRange = MultiRangeIgnore
+	checkRouteX(t, "GET", ts.URL+"/long", 200, content, func(req *http.Request) {
+		req.Header.Set("Range", "bytes=250-259,0-4")
+	})
+}
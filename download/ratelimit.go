@@ -0,0 +1,166 @@
+package download
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RateLimiter limits the rate of requests from each client IP address
+// using a token bucket. Each client may make Burst requests at once, and
+// then Rate requests a second. Requests over the limit receive a 429
+// error. One limiter is shared by every handler, so scrapers are slowed
+// before they reach fedora.
+//
+// Clients in Allow are never limited. Requests from a Trusted proxy, such
+// as the nginx front end, are attributed to the address in their
+// X-Real-IP header.
+//
+// Use NewRateLimiter to make one. It is safe to be used by multiple
+// goroutines.
+type RateLimiter struct {
+	Rate    float64 // tokens added a second
+	Burst   int     // size of each bucket
+	Allow   []*net.IPNet
+	Trusted []*net.IPNet
+
+	m       sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time // for testing
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests a second with
+// the given burst.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation. Single addresses
+// are also accepted.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// Wrap returns a handler which applies the limit before calling h.
+func (rl *RateLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, rl.Trusted)
+		if ip != nil && contains(rl.Allow, ip) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var key string
+		if ip != nil {
+			key = ip.String()
+		}
+		if ok, wait := rl.take(key); !ok {
+			writeRetry(w, http.StatusTooManyRequests, wait)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client making r, which is the one
+// in the X-Real-IP header for requests from the trusted proxies, or nil
+// if it cannot be determined.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && contains(trusted, ip) {
+		if realip := net.ParseIP(r.Header.Get("X-Real-IP")); realip != nil {
+			ip = realip
+		}
+	}
+	return ip
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a token from the bucket for key. If the bucket is empty it
+// returns false and how long until a token is available.
+func (rl *RateLimiter) take(key string) (bool, time.Duration) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	now := rl.now()
+	rl.sweep(now)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.Rate
+	if b.tokens > float64(rl.Burst) {
+		b.tokens = float64(rl.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		if rl.Rate <= 0 {
+			return false, time.Minute
+		}
+		return false, time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets which would be full by now, since they are the
+// same as a new bucket. It runs at most once a minute. The lock must be
+// held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < time.Minute || rl.Rate <= 0 {
+		return
+	}
+	rl.swept = now
+	full := time.Duration(float64(rl.Burst) / rl.Rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) >= full {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(1, 2)
+	rl.now = func() time.Time { return now }
+	var err error
+	rl.Allow, err = ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Trusted, err = ParseCIDRs([]string{"192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := rl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remote, realip string) int {
+		r := httptest.NewRequest("GET", "/0123", nil)
+		r.RemoteAddr = remote
+		if realip != "" {
+			r.Header.Set("X-Real-IP", realip)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	var table = []struct {
+		remote, realip string
+		status         int
+	}{
+		{"1.2.3.4:1000", "", 200},
+		{"1.2.3.4:1001", "", 200},
+		{"1.2.3.4:1002", "", 429},
+		{"5.6.7.8:1000", "", 200},        // a different client
+		{"1.2.3.4:1000", "5.6.7.8", 429}, // untrusted X-Real-IP is ignored
+		{"10.1.1.1:1000", "", 200},       // allowed
+		{"10.1.1.1:1000", "", 200},
+		{"10.1.1.1:1000", "", 200},
+		{"192.168.1.1:80", "5.6.7.8", 200},
+		{"192.168.1.1:80", "5.6.7.8", 429},
+		{"192.168.1.1:80", "10.2.2.2", 200},
+	}
+	for i, s := range table {
+		if status := get(s.remote, s.realip); status != s.status {
+			t.Errorf("%d: %s %s expected %d, got %d", i, s.remote, s.realip, s.status, status)
+		}
+	}
+
+	// the client is told when to come back
+	r := httptest.NewRequest("GET", "/0123", nil)
+	r.RemoteAddr = "1.2.3.4:1000"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// tokens refill over time
+	now = now.Add(time.Second)
+	if status := get("1.2.3.4:1000", ""); status != 200 {
+		t.Errorf("Expected refill, got %d", status)
+	}
+	// idle buckets are removed
+	now = now.Add(time.Hour)
+	get("9.9.9.9:1000", "")
+	if len(rl.buckets) != 1 {
+		t.Errorf("Expected 1 bucket, got %d", len(rl.buckets))
+	}
+
+	if _, err := ParseCIDRs([]string{"not an address"}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
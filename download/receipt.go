@@ -0,0 +1,58 @@
+package download
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A bundleReceipt records what was sent in a zip download, so users can
+// later show what they received. It is returned by the receipts route.
+type bundleReceipt struct {
+	Bundle  string          `json:"bundle"`
+	ID      string          `json:"id"` // the identifier the zip was named for
+	Created time.Time       `json:"created"`
+	Members []receiptMember `json:"members"`
+}
+
+// receiptMember describes one file in a zip download. SHA256 is computed
+// from the bytes sent; Checksum is the one stored in fedora, if any.
+type receiptMember struct {
+	ID           string `json:"id"`
+	Filename     string `json:"filename"`
+	Version      string `json:"version"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksum_type,omitempty"`
+}
+
+// newBundleID returns a random identifier for a zip download.
+func newBundleID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// receiptPath returns the bundle id for a path of the form
+// receipts/:bundle-id, or false if it is not one.
+func receiptPath(path string) (string, bool) {
+	const route = "receipts/"
+	if !strings.HasPrefix(path, route) || strings.Contains(path[len(route):], "/") {
+		return "", false
+	}
+	return path[len(route):], path != route
+}
+
+// receipt replies with the receipt for the bundle as JSON. Receipts are
+// kept for the TTL of the Receipts cache.
+func (dh *DownloadHandler) receipt(bundle string, w http.ResponseWriter, r *http.Request) {
+	v, ok := dh.Receipts.Get(bundle)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, v)
+}
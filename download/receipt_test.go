@@ -0,0 +1,47 @@
+package download
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReceipt(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	// receipts are off by default
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/0123/zip/123", 200, "", nil)
+	if b := resp.Header.Get("X-Bundle-Id"); b != "" {
+		t.Errorf("Expected no bundle id, got %q", b)
+	}
+	checkRoute(t, "GET", ts.URL+"/receipts/abc", 404, "")
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Receipts = NewTimeCache(time.Hour)
+
+	resp, _ = checkRouteX(t, "GET", ts.URL+"/0123/zip/0123,123", 200, "", nil)
+	bundle := resp.Header.Get("X-Bundle-Id")
+	if bundle == "" {
+		t.Fatal("Expected a bundle id")
+	}
+	checkRoute(t, "GET", ts.URL+"/receipts/abc", 404, "")
+	checkRoute(t, "GET", ts.URL+"/receipts/"+bundle+"/x", 404, "")
+
+	_, body := checkRouteX(t, "GET", ts.URL+"/receipts/"+bundle, 200, "", nil)
+	var receipt bundleReceipt
+	if err := json.Unmarshal(body, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Bundle != bundle || receipt.ID != "test:0123" {
+		t.Errorf("Unexpected receipt %#v", receipt)
+	}
+	if len(receipt.Members) != 2 {
+		t.Fatalf("Expected 2 members, got %d", len(receipt.Members))
+	}
+	m := receipt.Members[1]
+	const goodbye = "82e35a63ceba37e9646434c5dd412ea577147f1e4a41ccde1614253187e3dbf9"
+	if m.ID != "test:123" || m.Size != 7 || m.SHA256 != goodbye {
+		t.Errorf("Unexpected member %#v", m)
+	}
+}
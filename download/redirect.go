@@ -0,0 +1,72 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// The ways to hand off redirect (R) datastreams instead of streaming their
+// content through fedora.
+const (
+	// RedirectFound replies with a 302 to the datastream's location.
+	RedirectFound = "302"
+	// RedirectAccel replies with an X-Accel-Redirect header, so a front
+	// end such as nginx fetches the location itself.
+	RedirectAccel = "accel"
+)
+
+// DefaultAccelPrefix is the internal location the front end serves
+// X-Accel-Redirect targets from.
+const DefaultAccelPrefix = "/_redirect/"
+
+// ParseRedirect checks a Redirect setting. The empty string means
+// redirect datastreams are proxied like any other.
+func ParseRedirect(s string) (string, error) {
+	switch s {
+	case "", RedirectFound, RedirectAccel:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown redirect %q", s)
+}
+
+// handoff replies with the location of the redirect datastream of pid
+// described by dsinfo, if Redirect is set. The location is asked of
+// fedora without fetching the content. It returns false, having written
+// nothing, if the datastream should be served as usual, such as when it
+// is not a redirect or fedora cannot be reached.
+func (dh *DownloadHandler) handoff(pid string, dsinfo fedora.DsInfo, w http.ResponseWriter, r *http.Request) bool {
+	if dh.Redirect == "" || dsinfo.ControlGroup != "R" {
+		return false
+	}
+	location, err := dh.Fedora.GetDatastreamLocation(pid, dh.Ds)
+	if err != nil {
+		if err != fedora.ErrNoLocation {
+			log.Printf("Received Fedora error (%s,%s): %s", pid, dh.Ds, err)
+		}
+		return false
+	}
+	w.Header().Set("Cache-Control", dh.cacheControl())
+	if dh.Redirect == RedirectFound {
+		http.Redirect(w, r, location, http.StatusFound)
+		return true
+	}
+	// The front end keeps these headers when it serves the location.
+	filename := dsinfo.Label
+	if name := sanitizeFilename(r.FormValue("filename")); name != "" {
+		filename = name
+	}
+	kind, mimetype := dh.disposition(r, dsinfo.MIMEType)
+	w.Header().Set("Content-Disposition", contentDisposition(kind, filename))
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", dh.etag(dsinfo))
+	prefix := dh.AccelPrefix
+	if prefix == "" {
+		prefix = DefaultAccelPrefix
+	}
+	w.Header().Set("X-Accel-Redirect", prefix+location)
+	return true
+}
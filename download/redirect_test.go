@@ -0,0 +1,63 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestRedirectHandoff(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:r", "content", fedora.DsInfo{
+		ControlGroup: "R",
+		Location:     "http://bendo/item/r/file.pdf",
+		LocationType: "URL",
+		Label:        "file.pdf",
+		MIMEType:     "application/pdf",
+	}, []byte("through fedora"))
+	tf.Set("test:m", "content", fedora.DsInfo{}, []byte("managed"))
+	dh := &DownloadHandler{
+		Fedora: tf,
+		Ds:     "content",
+		Prefix: "test:",
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) *http.Response {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// without Redirect the content is proxied
+	checkRoute(t, "GET", ts.URL+"/r", 200, "through fedora")
+
+	dh.Redirect = RedirectFound
+	resp := get("/r")
+	if resp.StatusCode != 302 || resp.Header.Get("Location") != "http://bendo/item/r/file.pdf" {
+		t.Errorf("Expected a redirect, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	checkRoute(t, "GET", ts.URL+"/m", 200, "managed")
+
+	dh.Redirect = RedirectAccel
+	resp = get("/r")
+	if accel := resp.Header.Get("X-Accel-Redirect"); resp.StatusCode != 200 || accel != "/_redirect/http://bendo/item/r/file.pdf" {
+		t.Errorf("Expected X-Accel-Redirect, got %d %q", resp.StatusCode, accel)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("Expected Content-Type application/pdf, got %q", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `inline; filename="file.pdf"` {
+		t.Errorf("Expected Content-Disposition for file.pdf, got %q", cd)
+	}
+}
@@ -0,0 +1,139 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Resolver finds the pid of the object having an alternate identifier,
+// such as "doi:10.7274/abc123". It returns fedora.ErrNotFound if there is
+// no such object.
+type Resolver interface {
+	Resolve(identifier string) (string, error)
+}
+
+// identifierRoutes maps the first path component of a request to the
+// scheme of the identifier that follows it. For example, the route
+// /doi/10.7274/abc123 is for the identifier doi:10.7274/abc123.
+var identifierRoutes = map[string]string{
+	"doi":    "doi:",
+	"hdl":    "hdl:",
+	"handle": "hdl:",
+	"ark:":   "ark:/",
+}
+
+// alternateIdentifier returns the identifier for a path of the form
+// scheme/rest, or false if the scheme is not one we know.
+func alternateIdentifier(path string) (string, bool) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false
+	}
+	scheme, ok := identifierRoutes[strings.ToLower(parts[0])]
+	if !ok {
+		return "", false
+	}
+	return scheme + parts[1], true
+}
+
+// resolve replies with the content of the object having the alternate
+// identifier. Only objects having the handler's prefix are served.
+func (dh *DownloadHandler) resolve(identifier string, w http.ResponseWriter, r *http.Request) {
+	pid, err := dh.Resolver.Resolve(identifier)
+	if err != nil || !dh.allowedPid(pid) {
+		if err != nil && err != fedora.ErrNotFound {
+			log.Printf("Resolving %s: %s", identifier, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	dh.downloadSingleFile(pid, w, r)
+}
+
+// A LookupTable resolves identifiers using a fixed table. DOIs are case
+// insensitive, so they are matched ignoring case.
+type LookupTable map[string]string
+
+// tableKey returns the key to use for an identifier in a LookupTable.
+func tableKey(identifier string) string {
+	if strings.HasPrefix(strings.ToLower(identifier), "doi:") {
+		return strings.ToLower(identifier)
+	}
+	return identifier
+}
+
+// LoadLookupTable reads a table from a file. Each line has an identifier
+// and a pid separated by whitespace. Blank lines and lines starting with
+// '#' are skipped.
+func LoadLookupTable(fname string) (LookupTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	table := make(LookupTable)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identifier and pid", fname, line)
+		}
+		table[tableKey(fields[0])] = fields[1]
+	}
+	return table, scanner.Err()
+}
+
+// Resolve returns the pid for the identifier.
+func (t LookupTable) Resolve(identifier string) (string, error) {
+	pid, ok := t[tableKey(identifier)]
+	if !ok {
+		return "", fedora.ErrNotFound
+	}
+	return pid, nil
+}
+
+// A FedoraResolver resolves identifiers by searching the Dublin Core
+// identifiers of objects in the resource index.
+type FedoraResolver struct {
+	Fedora fedora.Fedora
+}
+
+// Resolve returns the pid of the object having the identifier. It is an
+// error if more than one object has it.
+func (fr FedoraResolver) Resolve(identifier string) (string, error) {
+	pids, err := fr.Fedora.FindIdentifier(identifier)
+	if err != nil {
+		return "", err
+	}
+	switch len(pids) {
+	case 0:
+		return "", fedora.ErrNotFound
+	case 1:
+		return pids[0], nil
+	}
+	return "", fmt.Errorf("%d objects have identifier %s", len(pids), identifier)
+}
+
+// Resolvers tries each resolver in turn, returning the first pid found.
+type Resolvers []Resolver
+
+// Resolve returns the pid for the identifier.
+func (rs Resolvers) Resolve(identifier string) (string, error) {
+	for _, r := range rs {
+		pid, err := r.Resolve(identifier)
+		if err != fedora.ErrNotFound {
+			return pid, err
+		}
+	}
+	return "", fedora.ErrNotFound
+}
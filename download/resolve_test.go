@@ -0,0 +1,69 @@
+package download
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestAlternateIdentifier(t *testing.T) {
+	var table = []struct {
+		path, id string
+		ok       bool
+	}{
+		{"doi/10.7274/ABC", "doi:10.7274/ABC", true},
+		{"hdl/2027/xyz", "hdl:2027/xyz", true},
+		{"handle/2027/xyz", "hdl:2027/xyz", true},
+		{"ark:/13030/tf5p30086k", "ark:/13030/tf5p30086k", true},
+		{"doi/", "", false},
+		{"abc123", "", false},
+		{"abc123/zip/x", "", false},
+	}
+	for _, s := range table {
+		id, ok := alternateIdentifier(s.path)
+		if id != s.id || ok != s.ok {
+			t.Errorf("%s: expected %s %v, got %s %v", s.path, s.id, s.ok, id, ok)
+		}
+	}
+}
+
+func TestLookupTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "ids.txt")
+	ioutil.WriteFile(fname, []byte("# comment\n\ndoi:10.7274/ABC test:0123\nhdl:2027/xyz test:123\n"), 0644)
+	table, err := LoadLookupTable(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf := fedora.NewTestFedora()
+	tf.AddIdentifier("test:abc", "ark:/13030/q")
+	tf.AddIdentifier("another:xyz", "doi:10.1/other")
+	tf.AddIdentifier("test:1", "hdl:dup")
+	tf.AddIdentifier("test:2", "hdl:dup")
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Resolver = Resolvers{table, FedoraResolver{Fedora: tf}}
+
+	checkRoute(t, "GET", ts.URL+"/doi/10.7274/abc", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/hdl/2027/xyz", 200, "goodbye")
+	checkRoute(t, "GET", ts.URL+"/ark:/13030/q", 200, "a longer string")
+	checkRoute(t, "GET", ts.URL+"/doi/10.1/missing", 404, "")
+	checkRoute(t, "GET", ts.URL+"/hdl/dup", 404, "")
+	// outside of the handler's namespace
+	checkRoute(t, "GET", ts.URL+"/doi/10.1/other", 404, "")
+
+	ioutil.WriteFile(fname, []byte("doi:10.7274/ABC\n"), 0644)
+	if _, err := LoadLookupTable(fname); err == nil {
+		t.Errorf("Expected error for bad line")
+	}
+}
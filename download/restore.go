@@ -0,0 +1,259 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A RestoreQueue follows content which a tiered store is staging from slow
+// storage, such as tape. Instead of a download hanging or failing, the
+// client gets a 202 response with a URL to check, and the queue checks the
+// content every Interval until it can be fetched, when downloads are
+// served normally again. Restores which take longer than Timeout fail.
+//
+// When a restore finishes, a JSON description of it, including the users
+// who asked for it, is posted to Notify, if it is set, so they can be told
+// by email or otherwise. Users are taken from UserHeader, as for an
+// AdminList. It is safe to be called by multiple goroutines.
+type RestoreQueue struct {
+	Interval   time.Duration // between checks; defaults to one minute
+	Timeout    time.Duration // defaults to one day
+	Keep       time.Duration // how long finished restores are reported; defaults to one hour
+	Notify     string
+	UserHeader string
+	Trusted    []*net.IPNet
+
+	m        sync.Mutex
+	restores map[string]*Restore // by pid and datastream
+}
+
+// A Restore describes the staging of one datastream.
+type Restore struct {
+	Pid        string     `json:"pid"`
+	Datastream string     `json:"datastream"`
+	State      string     `json:"state"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Users      []string   `json:"users,omitempty"`
+	StatusURL  string     `json:"status_url,omitempty"`
+}
+
+// the states of a restore
+const (
+	RestoreStaging = "staging"
+	RestoreReady   = "ready"
+	RestoreFailed  = "failed"
+)
+
+func (rq *RestoreQueue) interval() time.Duration {
+	if rq.Interval <= 0 {
+		return time.Minute
+	}
+	return rq.Interval
+}
+
+// Start queues a restore of the datastream ds of pid for user, if one is
+// not already in progress, and returns its state. Until it is finished,
+// check is called every Interval. It should return nil once the content
+// can be fetched, and an *UnavailableError while it cannot yet.
+func (rq *RestoreQueue) Start(pid, ds, user string, check func(context.Context) error) Restore {
+	key := pid + "/" + ds
+	rq.m.Lock()
+	defer rq.m.Unlock()
+	if rq.restores == nil {
+		rq.restores = make(map[string]*Restore)
+	}
+	rs, ok := rq.restores[key]
+	if !ok || rs.State != RestoreStaging {
+		rs = &Restore{
+			Pid:        pid,
+			Datastream: ds,
+			State:      RestoreStaging,
+			Started:    time.Now(),
+		}
+		rq.restores[key] = rs
+		go rq.poll(rs, check)
+	}
+	if user != "" && !hasString(rs.Users, user) {
+		rs.Users = append(rs.Users, user)
+	}
+	return rq.copy(rs)
+}
+
+// Status returns the state of the most recent restore of the datastream ds
+// of pid, if there is one.
+func (rq *RestoreQueue) Status(pid, ds string) (Restore, bool) {
+	rq.m.Lock()
+	defer rq.m.Unlock()
+	rs, ok := rq.restores[pid+"/"+ds]
+	if !ok {
+		return Restore{}, false
+	}
+	return rq.copy(rs), true
+}
+
+// copy returns a copy of rs which does not share its users. The lock must
+// be held.
+func (rq *RestoreQueue) copy(rs *Restore) Restore {
+	result := *rs
+	result.Users = append([]string(nil), rs.Users...)
+	return result
+}
+
+// poll checks the content until it is ready, the check fails, or the
+// restore times out.
+func (rq *RestoreQueue) poll(rs *Restore, check func(context.Context) error) {
+	timeout := rq.Timeout
+	if timeout <= 0 {
+		timeout = 24 * time.Hour
+	}
+	deadline := rs.Started.Add(timeout)
+	state := RestoreFailed
+	for time.Now().Before(deadline) {
+		time.Sleep(rq.interval())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := check(ctx)
+		cancel()
+		var unavailable *UnavailableError
+		if err == nil {
+			state = RestoreReady
+			break
+		} else if !errors.As(err, &unavailable) {
+			log.Printf("Restoring %s/%s: %s", rs.Pid, rs.Datastream, err)
+			break
+		}
+	}
+	rq.finish(rs, state)
+}
+
+// finish records the end of a restore and posts it to Notify. It is
+// forgotten after Keep.
+func (rq *RestoreQueue) finish(rs *Restore, state string) {
+	now := time.Now()
+	rq.m.Lock()
+	rs.State = state
+	rs.Finished = &now
+	result := rq.copy(rs)
+	rq.m.Unlock()
+	log.Printf("Restore of %s/%s %s after %s", rs.Pid, rs.Datastream, state, now.Sub(rs.Started))
+
+	keep := rq.Keep
+	if keep <= 0 {
+		keep = time.Hour
+	}
+	time.AfterFunc(keep, func() {
+		rq.m.Lock()
+		defer rq.m.Unlock()
+		key := rs.Pid + "/" + rs.Datastream
+		if rq.restores[key] == rs {
+			delete(rq.restores, key)
+		}
+	})
+
+	if rq.Notify == "" {
+		return
+	}
+	body, _ := json.Marshal(result)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(rq.Notify, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Restore notify:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("Restore notify:", resp.Status)
+	}
+}
+
+// hasString is true if s is in list.
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaging is true if err says content is being staged from slow
+// storage.
+func isStaging(err error) bool {
+	var unavailable *UnavailableError
+	return errors.As(err, &unavailable) && unavailable.Staging
+}
+
+// queueRestore starts a restore of the datastream of pid described by
+// dsinfo, and replies with a 202 response saying where to check on it.
+func (dh *DownloadHandler) queueRestore(pid string, dsinfo fedora.DsInfo, w http.ResponseWriter, r *http.Request) {
+	rq := dh.Restores
+	check := func(ctx context.Context) error {
+		content, _, err := dh.getContent(ctx, pid, dsinfo)
+		if err == nil {
+			content.Close()
+		}
+		return err
+	}
+	rs := rq.Start(pid, dh.Ds, RequestUser(r, rq.UserHeader, rq.Trusted), check)
+	rs.Users = nil
+	rs.StatusURL = restoreURL(r, dh.Ds)
+	w.Header().Set("Location", rs.StatusURL)
+	w.Header().Set("Retry-After", strconv.Itoa(int((rq.interval()+time.Second-1)/time.Second)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	if r.Method == "HEAD" {
+		return
+	}
+	err := json.NewEncoder(w).Encode(rs)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// restoreURL returns the path to check on a restore of ds started by r. It
+// uses the request URI as sent, since the handler may be mounted under a
+// prefix which has been stripped from r.URL.
+func restoreURL(r *http.Request, ds string) string {
+	path := r.RequestURI
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return strings.TrimSuffix(path, "/") + "/restore?ds=" + url.QueryEscape(ds)
+}
+
+// restoreStatus replies with the state of the restore of the datastream
+// given by the ds parameter, with the route
+//
+//	GET /:id/restore?ds=:ds
+//
+// The datastream defaults to the handler's.
+func (dh *DownloadHandler) restoreStatus(pid string, w http.ResponseWriter, r *http.Request) {
+	if dh.Restores == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ds := r.FormValue("ds")
+	if ds == "" {
+		ds = dh.Ds
+	}
+	rs, ok := dh.Restores.Status(pid, ds)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rs.Users = nil
+	writeJSON(w, rs)
+}
@@ -0,0 +1,87 @@
+package download
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestRestore(t *testing.T) {
+	// the store stages the content on the first two requests
+	var requests int32
+	tape := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte("from tape"))
+	}))
+	defer tape.Close()
+	notified := make(chan Restore, 1)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rs Restore
+		json.NewDecoder(r.Body).Decode(&rs)
+		notified <- rs
+	}))
+	defer notify.Close()
+
+	tf := fedora.NewTestFedora()
+	tf.Set("test:t", "content", fedora.DsInfo{
+		ControlGroup: "E",
+		Location:     tape.URL + "/t",
+		LocationType: "URL",
+	}, []byte("from fedora"))
+	dh := &DownloadHandler{
+		Fedora: tf,
+		Ds:     "content",
+		Prefix: "test:",
+		Stores: []ExternalStore{{Prefix: tape.URL, Tiered: true, Retries: 3}},
+		Restores: &RestoreQueue{
+			Interval:   10 * time.Millisecond,
+			Notify:     notify.URL,
+			UserHeader: "X-Remote-User",
+			Trusted:    loopback(),
+		},
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	resp, body := checkRouteX(t, "GET", ts.URL+"/t", 202, "", func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "alice")
+	})
+	if loc := resp.Header.Get("Location"); loc != "/t/restore?ds=content" {
+		t.Errorf("Expected a status URL, got %q", loc)
+	}
+	if !strings.Contains(string(body), `"state":"staging"`) {
+		t.Errorf("Expected staging, got %s", body)
+	}
+	// a tiered store is not retried while it stages content
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 request to the store, got %d", n)
+	}
+
+	select {
+	case rs := <-notified:
+		if rs.State != RestoreReady || len(rs.Users) != 1 || rs.Users[0] != "alice" {
+			t.Errorf("Expected ready for alice, got %+v", rs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Restore did not finish")
+	}
+	checkRoute(t, "GET", ts.URL+"/t/restore", 200, "")
+	checkRoute(t, "GET", ts.URL+"/t", 200, "from tape")
+	checkRoute(t, "GET", ts.URL+"/other/restore", 404, "")
+}
+
+func TestRestoreURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "/d/und:abc/?quality=low", nil)
+	if u := restoreURL(r, "low res"); u != "/d/und:abc/restore?ds=low+res" {
+		t.Errorf("Got %q", u)
+	}
+}
@@ -0,0 +1,234 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A VirusScanner looks for malware in content. Scan returns the name of
+// what it found, or the empty string if the content is clean.
+type VirusScanner interface {
+	Scan(ctx context.Context, r io.Reader) (string, error)
+}
+
+// A ClamdScanner scans content with a clamd daemon, using its INSTREAM
+// command. Network is "tcp" or "unix".
+type ClamdScanner struct {
+	Network string
+	Addr    string
+	Timeout time.Duration // for each scan; zero means no limit
+}
+
+// ParseClamd returns a scanner for the clamd at addr, which is either a
+// host:port or the path of a unix socket.
+func ParseClamd(addr string) *ClamdScanner {
+	if strings.HasPrefix(addr, "/") {
+		return &ClamdScanner{Network: "unix", Addr: addr}
+	}
+	return &ClamdScanner{Network: "tcp", Addr: addr}
+}
+
+// clamdChunk is the most we send clamd in one piece.
+const clamdChunk = 64 * 1024
+
+// Scan sends r to clamd, and returns the signature it found, if any.
+func (cs *ClamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, cs.Network, cs.Addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if cs.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(cs.Timeout))
+	}
+	_, err = io.WriteString(conn, "zINSTREAM\x00")
+	if err != nil {
+		return "", err
+	}
+	// each chunk is preceded by its length, and a zero length ends the
+	// stream
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets a reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// An InfectedError is returned for content in which the scanner found
+// malware.
+type InfectedError struct {
+	Pid       string
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("%s is infected with %s", e.Pid, e.Signature)
+}
+
+// A ScanGate scans external content the first time it is fetched, and
+// refuses to serve it if malware is found. Verdicts are remembered by the
+// content's checksum, or by its version if it has none, for as long as
+// the TTL of Verdicts, so content is not scanned again on every download.
+// Use NewScanGate to make one. It is safe to be called by multiple
+// goroutines.
+//
+// Content is spooled to a temporary file in Dir while it is scanned, so
+// nothing is sent to the client before the verdict. If the scanner cannot
+// be reached the content is not served.
+type ScanGate struct {
+	Scanner  VirusScanner
+	Verdicts *TimeCache
+	Dir      string // for temporary files; defaults to os.TempDir()
+
+	// Notify is a URL to POST a JSON description of each detection to,
+	// to alert the administrators. Detections are always logged.
+	// Optional.
+	Notify string
+}
+
+// NewScanGate returns a gate using scanner, which remembers its verdicts
+// for ttl.
+func NewScanGate(scanner VirusScanner, ttl time.Duration) *ScanGate {
+	return &ScanGate{
+		Scanner:  scanner,
+		Verdicts: NewTimeCache(ttl),
+	}
+}
+
+// scanKey returns the key to remember the verdict for a datastream under.
+func scanKey(pid, ds string, dsinfo fedora.DsInfo) string {
+	if dsinfo.Checksum != "" && dsinfo.ChecksumType != "" {
+		return strings.ToLower(dsinfo.ChecksumType) + ":" + dsinfo.Checksum
+	}
+	return pid + "/" + ds + "/" + dsinfo.VersionID
+}
+
+// clean is true if the datastream is known to be free of viruses, so its
+// content need not be checked.
+func (sg *ScanGate) clean(pid, ds string, dsinfo fedora.DsInfo) bool {
+	v, ok := sg.Verdicts.Get(scanKey(pid, ds, dsinfo))
+	return ok && v.(string) == ""
+}
+
+// check returns content if it is clean. Otherwise content is closed and
+// an error is returned.
+func (sg *ScanGate) check(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo, content io.ReadCloser) (io.ReadCloser, error) {
+	key := scanKey(pid, ds, dsinfo)
+	if v, ok := sg.Verdicts.Get(key); ok {
+		if v.(string) == "" {
+			return content, nil
+		}
+		content.Close()
+		return nil, &InfectedError{Pid: pid, Signature: v.(string)}
+	}
+	f, err := ioutil.TempFile(sg.Dir, "scan-")
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	spool := spoolFile{f}
+	found, err := sg.Scanner.Scan(ctx, io.TeeReader(content, f))
+	content.Close()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Println("Virus scan:", err)
+		spool.Close()
+		return nil, &UnavailableError{Service: "virus scanner"}
+	}
+	sg.Verdicts.Set(key, found)
+	if found != "" {
+		spool.Close()
+		sg.notify(pid, ds, dsinfo, found)
+		return nil, &InfectedError{Pid: pid, Signature: found}
+	}
+	return spool, nil
+}
+
+// notify reports a detection.
+func (sg *ScanGate) notify(pid, ds string, dsinfo fedora.DsInfo, signature string) {
+	log.Printf("Virus found in %s/%s (%s): %s", pid, ds, dsinfo.Location, signature)
+	if sg.Notify == "" {
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Pid        string `json:"pid"`
+		Datastream string `json:"datastream"`
+		Version    string `json:"version"`
+		Location   string `json:"location"`
+		Signature  string `json:"signature"`
+	}{pid, ds, dsinfo.VersionID, dsinfo.Location, signature})
+	go func() {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(sg.Notify, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Scan notify:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Println("Scan notify:", resp.Status)
+		}
+	}()
+}
+
+// A spoolFile is a temporary file which is removed when it is closed.
+type spoolFile struct {
+	*os.File
+}
+
+func (sf spoolFile) Close() error {
+	err := sf.File.Close()
+	os.Remove(sf.File.Name())
+	return err
+}
@@ -0,0 +1,130 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// fakeClamd answers INSTREAM commands, finding a virus in content
+// containing "EICAR".
+func fakeClamd(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var n uint32
+					if binary.Read(conn, binary.BigEndian, &n) != nil {
+						return
+					}
+					if n == 0 {
+						break
+					}
+					io.CopyN(&content, conn, int64(n))
+				}
+				if strings.Contains(content.String(), "EICAR") {
+					io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestClamdScanner(t *testing.T) {
+	ln := fakeClamd(t)
+	defer ln.Close()
+	cs := ParseClamd(ln.Addr().String())
+	var table = []struct {
+		content string
+		found   string
+	}{
+		{"", ""},
+		{"hello", ""},
+		{"xxEICARxx", "Eicar-Signature"},
+		{strings.Repeat("a", 3*clamdChunk+5) + "EICAR", "Eicar-Signature"},
+	}
+	for _, test := range table {
+		found, err := cs.Scan(context.Background(), strings.NewReader(test.content))
+		if err != nil || found != test.found {
+			t.Errorf("%.20q: expected %q, got %q, %v", test.content, test.found, found, err)
+		}
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("Expected an error")
+	}
+	if p := ParseClamd("/run/clamd.sock"); p.Network != "unix" {
+		t.Errorf("Expected a unix socket, got %q", p.Network)
+	}
+}
+
+// countScanner counts the scans, and finds a virus in content containing
+// "EICAR".
+type countScanner struct {
+	n int
+}
+
+func (cs *countScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	cs.n++
+	b, err := ioutil.ReadAll(r)
+	if bytes.Contains(b, []byte("EICAR")) {
+		return "Eicar-Signature", err
+	}
+	return "", err
+}
+
+func TestScanGate(t *testing.T) {
+	external := fedora.DsInfo{LocationType: "URL", Location: "http://elsewhere/file"}
+	tf := fedora.NewTestFedora()
+	tf.Set("test:clean", "content", external, []byte("clean"))
+	tf.Set("test:bad", "content", external, []byte("xEICARx"))
+	tf.Set("test:inside", "content", fedora.DsInfo{}, []byte("EICAR in fedora"))
+	scanner := &countScanner{}
+	dh := &DownloadHandler{
+		Fedora: tf,
+		Ds:     "content",
+		Prefix: "test:",
+		Scan:   NewScanGate(scanner, time.Hour),
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	checkRoute(t, "GET", ts.URL+"/clean", 200, "clean")
+	checkRoute(t, "GET", ts.URL+"/clean", 200, "clean")
+	checkRoute(t, "GET", ts.URL+"/bad", 403, "")
+	checkRoute(t, "GET", ts.URL+"/bad", 403, "")
+	// managed content is not scanned
+	checkRoute(t, "GET", ts.URL+"/inside", 200, "EICAR in fedora")
+	if scanner.n != 2 {
+		t.Errorf("Expected 2 scans, got %d", scanner.n)
+	}
+}
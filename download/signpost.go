@@ -0,0 +1,62 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Signpost is a template for a FAIR Signposting link, such as the
+// landing page of an item (rel "cite-as") or its metadata (rel
+// "describedby"). See https://signposting.org/.
+//
+// Href may contain the placeholders {id}, {pid}, {ds}, {label}, and
+// {mimetype}, which are replaced by the values for the datastream being
+// downloaded. The label is path escaped.
+type Signpost struct {
+	Rel  string
+	Href string
+	Type string // optional MIME type of the link target
+}
+
+// ParseSignpost parses a signpost from a string of the form
+// "rel href [type]".
+func ParseSignpost(s string) (Signpost, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Signpost{}, fmt.Errorf("signpost %q: expected rel, href, and optional type", s)
+	}
+	sp := Signpost{Rel: fields[0], Href: fields[1]}
+	if len(fields) == 3 {
+		sp.Type = fields[2]
+	}
+	return sp, nil
+}
+
+// link returns the Link header value for this signpost applied to the
+// given datastream.
+func (sp Signpost) link(id, pid, ds string, dsinfo fedora.DsInfo) string {
+	r := strings.NewReplacer(
+		"{id}", id,
+		"{pid}", pid,
+		"{ds}", ds,
+		"{label}", url.PathEscape(dsinfo.Label),
+		"{mimetype}", dsinfo.MIMEType,
+	)
+	v := "<" + r.Replace(sp.Href) + `>; rel="` + sp.Rel + `"`
+	if sp.Type != "" {
+		v += `; type="` + sp.Type + `"`
+	}
+	return v
+}
+
+// addSignposts adds a Link header for each configured signpost.
+func (dh *DownloadHandler) addSignposts(w http.ResponseWriter, pid string, dsinfo fedora.DsInfo) {
+	_, id := dh.splitPrefix(pid)
+	for _, sp := range dh.Signposts {
+		w.Header().Add("Link", sp.link(id, pid, dh.Ds, dsinfo))
+	}
+}
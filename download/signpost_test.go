@@ -0,0 +1,51 @@
+package download
+
+import (
+	"testing"
+)
+
+func TestParseSignpost(t *testing.T) {
+	var table = []struct {
+		input string
+		sp    Signpost
+		ok    bool
+	}{
+		{"cite-as https://doi.org/{id}", Signpost{Rel: "cite-as", Href: "https://doi.org/{id}"}, true},
+		{"describedby https://x/{id}.json application/ld+json", Signpost{Rel: "describedby", Href: "https://x/{id}.json", Type: "application/ld+json"}, true},
+		{"cite-as", Signpost{}, false},
+		{"a b c d", Signpost{}, false},
+	}
+	for _, s := range table {
+		sp, err := ParseSignpost(s.input)
+		if (err == nil) != s.ok || sp != s.sp {
+			t.Errorf("%q: expected %v, got %v, %v", s.input, s.sp, sp, err)
+		}
+	}
+}
+
+func TestSignposts(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Signposts = []Signpost{
+		{Rel: "cite-as", Href: "https://example.edu/show/{id}"},
+		{Rel: "describedby", Href: "https://example.edu/show/{id}.json", Type: "application/ld+json"},
+		{Rel: "type", Href: "https://schema.org/DigitalDocument"},
+	}
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/pdffile", 200, "pdf contents here", nil)
+	expected := []string{
+		`<https://example.edu/show/pdffile>; rel="cite-as"`,
+		`<https://example.edu/show/pdffile.json>; rel="describedby"; type="application/ld+json"`,
+		`<https://schema.org/DigitalDocument>; rel="type"`,
+	}
+	links := resp.Header["Link"]
+	if len(links) != len(expected) {
+		t.Fatalf("Expected %d links, got %v", len(expected), links)
+	}
+	for i := range expected {
+		if links[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], links[i])
+		}
+	}
+}
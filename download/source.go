@@ -0,0 +1,209 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// ErrNotHeld is returned by a ContentSource which does not hold the
+// content asked for, so the next source is tried.
+var ErrNotHeld = errors.New("content not held by this source")
+
+// A ContentSource supplies the content of datastreams kept in some storage
+// system, such as fedora or bendo. Open returns the content of the
+// datastream ds of pid, described by dsinfo, and whatever it knows of the
+// content's type, length, and checksums. The content should be abandoned
+// if ctx is canceled. Open returns ErrNotHeld if the source does not hold
+// the content, such as when dsinfo.Location is not one of its URLs.
+type ContentSource interface {
+	Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error)
+}
+
+// A ContentResolver is a storage system which finds content by its pid and
+// datastream alone, without needing fedora's description of it. Resolve
+// returns what it knows of the content's type, length, and checksums, and
+// the content itself, which may be seeked so range requests are answered
+// without reading what comes before them. Resolve returns ErrNotHeld if
+// the resolver does not hold the content.
+type ContentResolver interface {
+	Resolve(ctx context.Context, pid, ds string) (fedora.ContentInfo, io.ReadSeekCloser, error)
+}
+
+// ResolverSource is the ContentSource for a ContentResolver.
+type ResolverSource struct {
+	Resolver ContentResolver
+}
+
+// Open returns the content from the resolver.
+func (rs ResolverSource) Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	info, content, err := rs.Resolver.Resolve(ctx, pid, ds)
+	if err != nil {
+		return nil, info, err
+	}
+	return content, info, nil
+}
+
+// A SourceFactory makes a ContentSource from the options given for it in
+// a configuration, such as the directory it reads from.
+type SourceFactory func(options map[string]string) (ContentSource, error)
+
+var (
+	sourceMu        sync.Mutex
+	sourceFactories = make(map[string]SourceFactory)
+)
+
+// RegisterSource makes a kind of ContentSource available by name to
+// NewSource, so a program may offer storage systems of its own in its
+// configuration. It panics if the name is already registered.
+func RegisterSource(name string, factory SourceFactory) {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	if _, ok := sourceFactories[name]; ok {
+		panic("download: source " + name + " registered twice")
+	}
+	sourceFactories[name] = factory
+}
+
+// NewSource returns a ContentSource of the kind registered under name,
+// made with the given options.
+func NewSource(name string, options map[string]string) (ContentSource, error) {
+	sourceMu.Lock()
+	factory, ok := sourceFactories[name]
+	sourceMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q, expected one of %s", name, strings.Join(SourceNames(), ", "))
+	}
+	return factory(options)
+}
+
+// SourceNames returns the names of the registered kinds of ContentSource.
+func SourceNames() []string {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	var names []string
+	for name := range sourceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterSource("directory", func(options map[string]string) (ContentSource, error) {
+		root := options["root"]
+		if root == "" {
+			return nil, errors.New("directory source needs a root")
+		}
+		return ResolverSource{DirectorySource{Root: root}}, nil
+	})
+}
+
+// DirectorySource resolves content kept in a local directory tree, with
+// the datastream ds of pid in the file Root/pid/ds. It does not hold
+// content whose file is missing, so it may hold copies of only some
+// objects.
+type DirectorySource struct {
+	Root string
+}
+
+// Resolve opens the file for the datastream.
+func (ds DirectorySource) Resolve(ctx context.Context, pid, dsid string) (fedora.ContentInfo, io.ReadSeekCloser, error) {
+	if !safeName(pid) || !safeName(dsid) {
+		return fedora.ContentInfo{}, nil, ErrNotHeld
+	}
+	f, err := os.Open(filepath.Join(ds.Root, pid, dsid))
+	if os.IsNotExist(err) {
+		return fedora.ContentInfo{}, nil, ErrNotHeld
+	} else if err != nil {
+		return fedora.ContentInfo{}, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		f.Close()
+		return fedora.ContentInfo{}, nil, ErrNotHeld
+	}
+	return fedora.ContentInfo{Length: strconv.FormatInt(stat.Size(), 10)}, f, nil
+}
+
+// safeName is true if name may be used as a single path element.
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// FedoraSource fetches content through fedora. It holds every datastream,
+// since fedora will fetch external content itself.
+type FedoraSource struct {
+	Fedora fedora.Fedora
+}
+
+// Open returns the content from fedora.
+func (fs FedoraSource) Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	content, info, err := fs.Fedora.GetDatastream(pid, ds)
+	if err != nil {
+		return nil, info, err
+	}
+	return closeOnDone(ctx, content), info, nil
+}
+
+// storeSource fetches external content directly from the handler's
+// external stores, so we can supply the auth headers to the content
+// supplier ourselves.
+type storeSource struct {
+	dh *DownloadHandler
+}
+
+// Open returns the content from the store for its location.
+func (ss storeSource) Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	if dsinfo.LocationType != "URL" {
+		return nil, fedora.ContentInfo{}, ErrNotHeld
+	}
+	store := ss.dh.externalStore(dsinfo.Location)
+	if store == nil {
+		return nil, fedora.ContentInfo{}, ErrNotHeld
+	}
+	return store.getExternalContent(ctx, dsinfo.Location)
+}
+
+// getContent returns the content of the datastream described by dsinfo
+// from the first source holding it. The handler's Sources are tried
+// first, then its external stores, and finally fedora. External content
+// is scanned for viruses if the handler has a ScanGate.
+func (dh *DownloadHandler) getContent(ctx context.Context, pid string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	content, info, err := dh.openContent(ctx, pid, dsinfo)
+	if err == nil && dh.Scan != nil && isExternal(dsinfo) {
+		content, err = dh.Scan.check(ctx, pid, dh.Ds, dsinfo, content)
+	}
+	return content, info, err
+}
+
+// isExternal is true for datastreams whose content is kept outside of
+// fedora.
+func isExternal(dsinfo fedora.DsInfo) bool {
+	return dsinfo.LocationType == "URL"
+}
+
+// openContent returns the content from the first source holding it.
+func (dh *DownloadHandler) openContent(ctx context.Context, pid string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	sources := make([]ContentSource, 0, len(dh.Sources)+2)
+	sources = append(sources, dh.Sources...)
+	sources = append(sources, storeSource{dh}, FedoraSource{dh.Fedora})
+	for _, source := range sources {
+		content, info, err := source.Open(ctx, pid, dh.Ds, dsinfo)
+		if err != ErrNotHeld {
+			return content, info, err
+		}
+	}
+	// unreachable, since fedora holds everything
+	return nil, fedora.ContentInfo{}, ErrNotHeld
+}
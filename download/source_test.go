@@ -0,0 +1,104 @@
+package download
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// prefixSource holds the content of datastreams whose location starts
+// with "s3://".
+type prefixSource struct {
+	opened []string
+}
+
+func (ps *prefixSource) Open(ctx context.Context, pid, ds string, dsinfo fedora.DsInfo) (io.ReadCloser, fedora.ContentInfo, error) {
+	if !strings.HasPrefix(dsinfo.Location, "s3://") {
+		return nil, fedora.ContentInfo{}, ErrNotHeld
+	}
+	ps.opened = append(ps.opened, pid+"/"+ds)
+	return ioutil.NopCloser(strings.NewReader("from s3")), fedora.ContentInfo{Length: "7"}, nil
+}
+
+func TestContentSource(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	tf := dh.Fedora.(*fedora.TestFedora)
+	tf.Set("test:s3", "content", fedora.DsInfo{
+		Location:     "s3://bucket/key",
+		LocationType: "URL",
+	}, []byte("from fedora"))
+	source := &prefixSource{}
+	dh.Sources = []ContentSource{source}
+	dh.BendoToken = "12345"
+
+	checkRoute(t, "GET", ts.URL+"/s3", 200, "from s3")
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	// content in a store is still fetched from the store
+	checkRoute(t, "GET", ts.URL+"/remote", 200, "c")
+	if len(source.opened) != 1 || source.opened[0] != "test:s3/content" {
+		t.Errorf("Expected only test:s3 to be opened, got %v", source.opened)
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "test:0123"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "test:0123", "content"), []byte("from disk"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := setupHandler()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	source, err := NewSource("directory", map[string]string{"root": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh.Sources = []ContentSource{source}
+
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "from disk")
+	checkRouteX(t, "GET", ts.URL+"/0123", 206, "disk", func(r *http.Request) {
+		r.Header.Set("Range", "bytes=5-")
+	})
+	// objects not on disk come from fedora
+	checkRoute(t, "GET", ts.URL+"/123", 200, "goodbye")
+}
+
+func TestDirectorySourceNames(t *testing.T) {
+	ds := DirectorySource{Root: t.TempDir()}
+	for _, pid := range []string{"..", ".", "", "a/b", "a\\b"} {
+		_, _, err := ds.Resolve(context.Background(), pid, "content")
+		if err != ErrNotHeld {
+			t.Errorf("%q: Expected ErrNotHeld, got %v", pid, err)
+		}
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	RegisterSource("test-fixed", func(options map[string]string) (ContentSource, error) {
+		return &prefixSource{}, nil
+	})
+	if _, err := NewSource("test-fixed", nil); err != nil {
+		t.Errorf("Expected registered source, got %v", err)
+	}
+	if _, err := NewSource("nosuch", nil); err == nil {
+		t.Errorf("Expected an error for an unknown source")
+	}
+	if _, err := NewSource("directory", nil); err == nil {
+		t.Errorf("Expected an error for a directory without a root")
+	}
+}
@@ -0,0 +1,127 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Stamper stamps PDF downloads with the requesting user and the date, as
+// licensed collections require. Each PDF is piped through a command, such
+// as cpdf or qpdf, which overlays the text. The content is given on
+// standard input and the stamped PDF is read from standard output. The
+// string "{text}" in Args is replaced by Text, in which "{user}" and
+// "{date}" are replaced by the user and the date.
+//
+// The user is taken from UserHeader, as for an AdminList. Requests without
+// a user are refused, so every download can be attributed. Stamped PDFs are
+// never redirected or cached. Other types are served unchanged.
+type Stamper struct {
+	Args       []string
+	Text       string
+	UserHeader string
+	Trusted    []*net.IPNet
+	Timeout    time.Duration // defaults to one minute
+}
+
+// DefaultStampText is the text stamped when none is given.
+const DefaultStampText = "Downloaded by {user} on {date}"
+
+// ParseStampCommand splits a stamp command into its arguments.
+func ParseStampCommand(s string) ([]string, error) {
+	args := strings.Fields(s)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("stamp command is empty")
+	}
+	return args, nil
+}
+
+// text returns the text to stamp for user.
+func (st *Stamper) text(user string, now time.Time) string {
+	text := st.Text
+	if text == "" {
+		text = DefaultStampText
+	}
+	// keep control characters out of the PDF
+	user = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, user)
+	text = strings.Replace(text, "{user}", user, -1)
+	return strings.Replace(text, "{date}", now.UTC().Format("2006-01-02"), -1)
+}
+
+// serveStamped replies with the PDF datastream of pid, stamped for the
+// requesting user.
+func (dh *DownloadHandler) serveStamped(pid string, dsinfo fedora.DsInfo, w http.ResponseWriter, r *http.Request) {
+	st := dh.Stamp
+	user := RequestUser(r, st.UserHeader, st.Trusted)
+	if user == "" {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	filename := dsinfo.Label
+	if name := sanitizeFilename(r.FormValue("filename")); name != "" {
+		filename = name
+	}
+	kind, mimetype := dh.disposition(r, dsinfo.MIMEType)
+	w.Header().Set("Content-Disposition", contentDisposition(kind, filename))
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// each copy is different, so it must not be kept by caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	content, _, err := dh.getContent(r.Context(), pid, dsinfo)
+	if err != nil {
+		writeContentError(w, r, err)
+		return
+	}
+	defer content.Close()
+	f, err := ioutil.TempFile("", "stamp-")
+	if err != nil {
+		log.Println("Stamping:", err)
+		http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+		return
+	}
+	stamped := spoolFile{f}
+	defer stamped.Close()
+
+	timeout := st.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	text := st.text(user, time.Now())
+	args := make([]string, len(st.Args))
+	for i, arg := range st.Args {
+		args[i] = strings.Replace(arg, "{text}", text, -1)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = content
+	cmd.Stdout = f
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Stamping %s: %s: %s %s", pid, args[0], err, strings.TrimSpace(stderr.String()))
+		http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+		return
+	}
+	// ranges are allowed, since PDF viewers ask for them
+	http.ServeContent(w, r, "", time.Time{}, stamped)
+}
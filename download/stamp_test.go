@@ -0,0 +1,55 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestStamp(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:pdf", "content", fedora.DsInfo{MIMEType: "application/pdf"}, []byte("%PDF-1.4 "))
+	tf.Set("test:txt", "content", fedora.DsInfo{MIMEType: "text/plain"}, []byte("plain"))
+	dh := &DownloadHandler{
+		Fedora: tf,
+		Ds:     "content",
+		Prefix: "test:",
+		Stamp: &Stamper{
+			// appends the text to the content
+			Args:       []string{"sh", "-c", `cat; printf %s "$1"`, "sh", "{text}"},
+			Text:       "for {user}",
+			UserHeader: "X-Remote-User",
+			Trusted:    loopback(),
+		},
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+	alice := func(r *http.Request) {
+		r.Header.Set("X-Remote-User", "alice")
+	}
+
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/pdf", 200, "%PDF-1.4 for alice", alice)
+	if cc := resp.Header.Get("Cache-Control"); cc != "private, no-store" {
+		t.Errorf("Expected private, no-store, got %q", cc)
+	}
+	if resp.Header.Get("ETag") != "" {
+		t.Errorf("Expected no ETag, got %q", resp.Header.Get("ETag"))
+	}
+	checkRoute(t, "GET", ts.URL+"/pdf", 403, "")
+	checkRouteX(t, "GET", ts.URL+"/txt", 200, "plain", alice)
+
+	dh.Stamp.Args = []string{"false"}
+	checkRouteX(t, "GET", ts.URL+"/pdf", 500, "", alice)
+}
+
+func TestStampText(t *testing.T) {
+	st := &Stamper{}
+	now := time.Date(2026, 3, 4, 23, 0, 0, 0, time.FixedZone("", -5*3600))
+	text := st.text("bob\n\x01", now)
+	if text != "Downloaded by bob on 2026-03-05" {
+		t.Errorf("Got %q", text)
+	}
+}
@@ -0,0 +1,304 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for decoding
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// A Thumbnailer makes thumbnails of datastreams, so applications do not
+// need a separate derivative service for display images. JPEG, PNG, and
+// GIF images are scaled directly. Other types, such as PDFs, are first
+// rendered to an image by the first matching command.
+//
+// Thumbnails fit in a square of one of the allowed Sizes, and are never
+// larger than the original. They are kept in the handler's DiskCache, if
+// it has one, keyed by the datastream version and size.
+type Thumbnailer struct {
+	Sizes    []int
+	Commands []ThumbnailCommand
+	Timeout  time.Duration // for each command; defaults to one minute
+}
+
+// A ThumbnailCommand renders datastreams of the MIME type Type as an image.
+// The content is given on standard input, and a JPEG, PNG, or GIF image is
+// expected on standard output. The string "{size}" in Args is replaced by
+// the requested size.
+type ThumbnailCommand struct {
+	Type string
+	Args []string
+}
+
+// ParseThumbnailCommand parses a MIME type followed by a command, such as
+// "application/pdf pdftoppm -png -singlefile -scale-to {size} -".
+func ParseThumbnailCommand(s string) (ThumbnailCommand, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return ThumbnailCommand{}, fmt.Errorf("thumbnail command %q: expected a MIME type and a command", s)
+	}
+	return ThumbnailCommand{Type: fields[0], Args: fields[1:]}, nil
+}
+
+// the largest source content and image thumbnails are made from, to
+// guard against decompression bombs
+const (
+	maxThumbnailSource = 256 << 20
+	maxThumbnailPixels = 100 * 1000 * 1000
+)
+
+// errNoThumbnail is returned for datastreams of a type which cannot be
+// made into a thumbnail.
+var errNoThumbnail = errors.New("no thumbnail for this type")
+
+// thumbnail replies with a thumbnail of the datastream of pid, with the
+// route
+//
+//	GET /:id/thumbnail?size=:n
+//
+// The size defaults to the first allowed one.
+func (dh *DownloadHandler) thumbnail(pid string, w http.ResponseWriter, r *http.Request) {
+	tn := dh.Thumbnails
+	if tn == nil || len(tn.Sizes) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if !dh.authorized(Download{Pid: pid, Ds: dh.Ds}, w, r) {
+		return
+	}
+	size := tn.Sizes[0]
+	if s := r.FormValue("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !tn.allowed(n) {
+			http.Error(w, "400 Bad size", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	src, dsinfo, ok := dh.datastreamInfo(pid, w, r)
+	if !ok {
+		return
+	}
+	w, done, ok := dh.runHooks(Download{Pid: pid, Ds: src.Ds, DsInfo: dsinfo}, w, r)
+	defer done()
+	if !ok {
+		return
+	}
+	etag := src.etag(dsinfo)
+	etag = etag[:len(etag)-1] + "-thumbnail" + strconv.Itoa(size) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", dh.cacheControl())
+	if etagMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	key := src.cacheKey(pid, dsinfo) + "/thumbnail/" + strconv.Itoa(size)
+	data, err := src.cachedThumbnail(key)
+	if data == nil && err == nil {
+		// only one request at a time makes each thumbnail
+		done, leader := dh.flights.Begin(key)
+		if leader {
+			data, err = src.makeThumbnail(r.Context(), pid, dsinfo, size)
+			if err == nil {
+				if cerr := src.DiskCache.Put(key, data); cerr != nil {
+					log.Println("diskcache:", cerr)
+				}
+			}
+			dh.flights.End(key)
+		} else {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+				return
+			}
+			data, err = src.cachedThumbnail(key)
+			if data == nil && err == nil {
+				data, err = src.makeThumbnail(r.Context(), pid, dsinfo, size)
+			}
+		}
+	}
+	switch {
+	case err == errNoThumbnail:
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		writeContentError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// allowed is true if size is one of the allowed sizes.
+func (tn *Thumbnailer) allowed(size int) bool {
+	for _, n := range tn.Sizes {
+		if n == size {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedThumbnail returns the thumbnail for key from the disk cache, or
+// nil if it is not there.
+func (dh *DownloadHandler) cachedThumbnail(key string) ([]byte, error) {
+	f, _, ok := dh.DiskCache.Open(key)
+	if !ok {
+		return nil, nil
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// makeThumbnail returns a thumbnail of the datastream of pid, as a JPEG
+// or, for sources which may be transparent, a PNG.
+func (dh *DownloadHandler) makeThumbnail(ctx context.Context, pid string, dsinfo fedora.DsInfo, size int) ([]byte, error) {
+	var args []string
+	switch dsinfo.MIMEType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		for _, c := range dh.Thumbnails.Commands {
+			if matchType([]string{c.Type}, dsinfo.MIMEType) {
+				args = c.Args
+				break
+			}
+		}
+		if args == nil {
+			return nil, errNoThumbnail
+		}
+	}
+	content, _, err := dh.getContent(ctx, pid, dsinfo)
+	if err != nil {
+		return nil, err
+	}
+	source, err := ioutil.ReadAll(io.LimitReader(content, maxThumbnailSource+1))
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(source) > maxThumbnailSource {
+		return nil, fmt.Errorf("%s is larger than %d bytes", pid, maxThumbnailSource)
+	}
+	data, err := dh.Thumbnails.scale(ctx, args, source, size)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail of %s: %s", pid, err)
+	}
+	return data, nil
+}
+
+// scale returns the image in source scaled to size, after rendering it
+// with args if they are given.
+func (tn *Thumbnailer) scale(ctx context.Context, args []string, source []byte, size int) ([]byte, error) {
+	var err error
+	if args != nil {
+		source, err = tn.render(ctx, args, source, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is %dx%d", config.Width, config.Height)
+	}
+	img, format, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	img = scaleImage(img, size)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// render runs a thumbnail command on source.
+func (tn *Thumbnailer) render(ctx context.Context, args []string, source []byte, size int) ([]byte, error) {
+	timeout := tn.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = strings.Replace(arg, "{size}", strconv.Itoa(size), -1)
+	}
+	cmd := exec.CommandContext(ctx, expanded[0], expanded[1:]...)
+	cmd.Stdin = bytes.NewReader(source)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s %s", expanded[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// scaleImage returns img scaled down to fit in a square of the given size,
+// averaging the pixels covered by each new pixel. Images which already
+// fit are returned unchanged.
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,107 @@
+package download
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	dir, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dc, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := fedora.NewTestFedora()
+	tf.Set("test:png", "content", fedora.DsInfo{MIMEType: "image/png", VersionID: "content.0"}, buf.Bytes())
+	tf.Set("test:other", "content", fedora.DsInfo{MIMEType: "application/x-other"}, buf.Bytes())
+	tf.Set("test:pdf", "content", fedora.DsInfo{MIMEType: "application/pdf"}, []byte("%PDF-"))
+	dh := &DownloadHandler{
+		Fedora:    tf,
+		Ds:        "content",
+		Prefix:    "test:",
+		DiskCache: dc,
+		Thumbnails: &Thumbnailer{
+			Sizes: []int{100, 50, 1000},
+			// the "rendering" of the other type is already an image
+			Commands: []ThumbnailCommand{{Type: "application/x-other", Args: []string{"cat"}}},
+		},
+	}
+	ts := httptest.NewServer(dh)
+	defer ts.Close()
+
+	var table = []struct {
+		path          string
+		width, height int
+	}{
+		{"/png/thumbnail", 100, 50},
+		{"/png/thumbnail?size=50", 50, 25},
+		{"/png/thumbnail?size=1000", 400, 200},
+		{"/other/thumbnail", 100, 50},
+	}
+	for _, test := range table {
+		resp, body := checkRouteX(t, "GET", ts.URL+test.path, 200, "", nil)
+		if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+			t.Errorf("%s: expected image/png, got %q", test.path, ct)
+		}
+		img, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != test.width || b.Dy() != test.height {
+			t.Errorf("%s: expected %dx%d, got %v", test.path, test.width, test.height, b)
+		}
+	}
+	if f, _, ok := dc.Open("test:png/content/content.0/thumbnail/50"); ok {
+		f.Close()
+	} else {
+		t.Error("Expected the thumbnail to be cached")
+	}
+	resp, _ := checkRouteX(t, "GET", ts.URL+"/png/thumbnail", 200, "", nil)
+	etag := resp.Header.Get("ETag")
+	checkRouteX(t, "GET", ts.URL+"/png/thumbnail", 304, "", func(r *http.Request) {
+		r.Header.Set("If-None-Match", etag)
+	})
+	checkRoute(t, "GET", ts.URL+"/png/thumbnail?size=75", 400, "")
+	checkRoute(t, "GET", ts.URL+"/pdf/thumbnail", 404, "")
+	checkRoute(t, "GET", ts.URL+"/missing/thumbnail", 404, "")
+}
+
+func TestScaleImage(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := range src.Pix {
+		if i%2 == 0 {
+			src.Pix[i] = 0xff
+		}
+	}
+	img := scaleImage(src, 2)
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("Expected 2x1, got %v", b)
+	}
+	// each new pixel averages two white and two black ones
+	r, _, _, _ := img.At(0, 0).RGBA()
+	if r != 0x7fff {
+		t.Errorf("Expected 0x7fff, got %#x", r)
+	}
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+	"sync"
+	"time"
+)
+
+// A TimeCache maps keys to values which expire after TTL. Expired entries
+// are removed as new ones are added.
+//
+// A nil *TimeCache is always empty. The implementation is safe to be called
+// by multiple goroutines.
+type TimeCache struct {
+	TTL time.Duration
+
+	m         sync.Mutex
+	items     map[string]timeEntry
+	nextPurge time.Time
+}
+
+type timeEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// NewTimeCache returns an empty cache whose entries last for ttl.
+func NewTimeCache(ttl time.Duration) *TimeCache {
+	return &TimeCache{
+		TTL:   ttl,
+		items: make(map[string]timeEntry),
+	}
+}
+
+// Get returns the value for key, if there is one and it has not expired.
+func (tc *TimeCache) Get(key string) (interface{}, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	e, ok := tc.items[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set adds an entry for key, replacing any existing one.
+func (tc *TimeCache) Set(key string, value interface{}) {
+	tc.SetUntil(key, value, time.Time{})
+}
+
+// SetUntil is like Set, but the entry also expires at the time until, if
+// that is sooner than the TTL. A zero until is ignored.
+func (tc *TimeCache) SetUntil(key string, value interface{}, until time.Time) {
+	if tc == nil {
+		return
+	}
+	now := time.Now()
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	if now.After(tc.nextPurge) {
+		for k, e := range tc.items {
+			if now.After(e.expires) {
+				delete(tc.items, k)
+			}
+		}
+		tc.nextPurge = now.Add(tc.TTL)
+	}
+	expires := now.Add(tc.TTL)
+	if !until.IsZero() && until.Before(expires) {
+		expires = until
+	}
+	tc.items[key] = timeEntry{value: value, expires: expires}
+}
+
+// Delete removes the entry for key.
+func (tc *TimeCache) Delete(key string) {
+	if tc == nil {
+		return
+	}
+	tc.m.Lock()
+	delete(tc.items, key)
+	tc.m.Unlock()
+}
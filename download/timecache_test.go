@@ -0,0 +1,48 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeCache(t *testing.T) {
+	tc := NewTimeCache(20 * time.Millisecond)
+	tc.Set("a", 1)
+	v, ok := tc.Get("a")
+	if !ok || v.(int) != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+	if _, ok := tc.Get("b"); ok {
+		t.Errorf("Expected b to be missing")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := tc.Get("a"); ok {
+		t.Errorf("Expected a to expire")
+	}
+	// expired entries are purged when adding
+	tc.Set("b", 2)
+	if len(tc.items) != 1 {
+		t.Errorf("Expected 1 entry, got %d", len(tc.items))
+	}
+	tc.Delete("b")
+	if _, ok := tc.Get("b"); ok {
+		t.Errorf("Expected b to be deleted")
+	}
+
+	// entries may expire sooner than the TTL
+	tc.TTL = time.Minute
+	tc.SetUntil("c", 3, time.Now().Add(-time.Second))
+	if _, ok := tc.Get("c"); ok {
+		t.Errorf("Expected c to expire")
+	}
+	tc.SetUntil("c", 3, time.Now().Add(time.Hour))
+	if _, ok := tc.Get("c"); !ok {
+		t.Errorf("Expected c to be kept")
+	}
+
+	var nilcache *TimeCache
+	nilcache.Set("a", 1)
+	if _, ok := nilcache.Get("a"); ok {
+		t.Errorf("Expected nil cache to be empty")
+	}
+}
@@ -0,0 +1,38 @@
+package download
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// userKey is the context key for the user a request was authenticated as.
+type userKey struct{}
+
+// WithUser returns r with room to note the user an Auth learns it is
+// from, such as the owner of a bearer token, so RequestUser can report it
+// once the request has been handled.
+func WithUser(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(userKey{}).(*string); ok {
+		return r
+	}
+	user := new(string)
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// noteUser records that r was authenticated as user, if r has room for it.
+func noteUser(r *http.Request, user string) {
+	if p, ok := r.Context().Value(userKey{}).(*string); ok {
+		*p = user
+	}
+}
+
+// RequestUser returns who is making r: the user an Auth authenticated it
+// as, if any, and otherwise the given header, if a trusted proxy sent it.
+// It returns "" if the user is not known.
+func RequestUser(r *http.Request, header string, trusted []*net.IPNet) string {
+	if p, ok := r.Context().Value(userKey{}).(*string); ok && *p != "" {
+		return *p
+	}
+	return TrustedHeader(r, header, trusted)
+}
@@ -0,0 +1,117 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An IDValidator decides whether an identifier is well formed. Malformed
+// identifiers are rejected before fedora is contacted. Identifiers are
+// checked without the handler's prefix.
+type IDValidator interface {
+	Valid(id string) bool
+}
+
+// RegexpValidator accepts identifiers matching a regular expression. The
+// whole identifier must match.
+type RegexpValidator struct {
+	*regexp.Regexp
+}
+
+// NewRegexpValidator compiles the expression, anchoring it at both ends.
+func NewRegexpValidator(expr string) (RegexpValidator, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	return RegexpValidator{re}, err
+}
+
+// Valid returns true if the expression matches id.
+func (v RegexpValidator) Valid(id string) bool {
+	return v.MatchString(id)
+}
+
+// the characters a noid "e" position may hold, in ordinal order
+const noidXdigits = "0123456789bcdfghjkmnpqrstvwxz"
+
+// A NoidTemplate accepts identifiers minted by a noid minter using the
+// template, such as "und:.reeddeeddk". See the noid documentation at
+// https://metacpan.org/pod/Noid. In the mask, "d" is a digit, "e" is a
+// digit or one of the consonants bcdfghjkmnpqrstvwxz, and a final "k" is
+// a check character. Identifiers are given without the handler's prefix,
+// so the part of the template before the period may be omitted.
+//
+// Templates with an unlimited length ("z") are not supported.
+type NoidTemplate struct {
+	prefix string
+	mask   string // without the generator type character
+}
+
+// NewNoidTemplate parses the template.
+func NewNoidTemplate(template string) (NoidTemplate, error) {
+	var t NoidTemplate
+	mask := template
+	if i := strings.LastIndex(template, "."); i >= 0 {
+		t.prefix = template[:i]
+		mask = template[i+1:]
+	}
+	if strings.HasPrefix(mask, "r") || strings.HasPrefix(mask, "s") {
+		mask = mask[1:]
+	}
+	for i, c := range mask {
+		switch {
+		case c == 'd' || c == 'e':
+		case c == 'k' && i == len(mask)-1:
+		default:
+			return t, fmt.Errorf("noid template %q: unsupported mask character %q", template, c)
+		}
+	}
+	if mask == "" {
+		return t, fmt.Errorf("noid template %q: empty mask", template)
+	}
+	t.mask = mask
+	return t, nil
+}
+
+// Valid returns true if id matches the template, including its check
+// character. The template's prefix is optional.
+func (t NoidTemplate) Valid(id string) bool {
+	full := id
+	if !strings.HasPrefix(id, t.prefix) {
+		full = t.prefix + id
+	}
+	if len(full) != len(t.prefix)+len(t.mask) {
+		return false
+	}
+	body := full[len(t.prefix):]
+	for i := 0; i < len(t.mask); i++ {
+		c := body[i]
+		switch t.mask[i] {
+		case 'd':
+			if c < '0' || c > '9' {
+				return false
+			}
+		case 'e':
+			if strings.IndexByte(noidXdigits, c) < 0 {
+				return false
+			}
+		case 'k':
+			if c != noidCheckChar(full[:len(full)-1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// noidCheckChar returns the noid check character for s. It is the sum of
+// the ordinal of each character times its position (starting from 1),
+// modulo 29. Characters which are not xdigits have ordinal 0.
+func noidCheckChar(s string) byte {
+	var sum int
+	for i := 0; i < len(s); i++ {
+		if n := strings.IndexByte(noidXdigits, s[i]); n >= 0 {
+			sum += n * (i + 1)
+		}
+	}
+	return noidXdigits[sum%len(noidXdigits)]
+}
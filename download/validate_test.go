@@ -0,0 +1,58 @@
+package download
+
+import (
+	"testing"
+)
+
+func TestNoidTemplate(t *testing.T) {
+	var table = []struct {
+		template string
+		id       string
+		valid    bool
+	}{
+		{"13030/.rddeeeeedk", "tf5p30086k", false}, // wrong mask
+		{"13030/.reededddddk", "tf5p30086k", true},
+		{"13030/.reededddddk", "13030/tf5p30086k", true},
+		{"13030/.reededddddk", "tf5p30086m", false}, // bad check char
+		{"13030/.reededddddk", "tf5p3008k", false},  // too short
+		{".reeddeeddk", "xf93gt2qq", false},
+		{".reeddeedd", "b2", false},
+		{".sdd", "42", true},
+		{".sdd", "4a", false},
+		{"dd", "42", true},
+	}
+	for _, s := range table {
+		v, err := NewNoidTemplate(s.template)
+		if err != nil {
+			t.Fatal(s.template, err)
+		}
+		if v.Valid(s.id) != s.valid {
+			t.Errorf("%s %s: expected %v", s.template, s.id, s.valid)
+		}
+	}
+	for _, bad := range []string{".zeeddk", ".rkdd", ".r", "abc"} {
+		if _, err := NewNoidTemplate(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestIDValidation(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	v, err := NewRegexpValidator("[0-9]+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh.Validator = v
+	checkRoute(t, "GET", ts.URL+"/0123", 200, "hello")
+	checkRoute(t, "GET", ts.URL+"/abc", 404, "")
+	checkRoute(t, "GET", ts.URL+"/0123abc", 404, "")
+	checkRoute(t, "GET", ts.URL+"/abc/about", 404, "")
+
+	if _, err := NewRegexpValidator("[0-9"); err == nil {
+		t.Errorf("Expected error for bad expression")
+	}
+}
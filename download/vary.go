@@ -0,0 +1,25 @@
+package download
+
+import (
+	"net/http"
+	"strings"
+)
+
+// addVary adds field to the Vary header of a response, unless it is
+// already listed. Shared caches use Vary to keep the responses for
+// different requests apart, so it should name every request header that
+// influenced the response, including on 304 and error responses.
+// Responses which depend on who asked, through an Auth or the front end's
+// user headers, are sent as private instead, since a shared cache would need
+// to vary on the credentials themselves.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
@@ -0,0 +1,42 @@
+package download
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestAddVary(t *testing.T) {
+	h := make(http.Header)
+	addVary(h, "Accept")
+	addVary(h, "accept")
+	h.Add("Vary", "Origin, Accept-Encoding")
+	addVary(h, "Accept-Encoding")
+	addVary(h, "Cookie")
+	v := h.Values("Vary")
+	if len(v) != 3 || v[0] != "Accept" || v[2] != "Cookie" {
+		t.Errorf("Unexpected Vary %v", v)
+	}
+}
+
+func TestVaryNotModified(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.CompressTypes = []string{"text/*"}
+	dh.Fedora.(*fedora.TestFedora).Set("test:csv",
+		"content",
+		fedora.DsInfo{MIMEType: "text/csv", VersionID: "content.0"},
+		[]byte("a,b,c\n"))
+
+	r, _ := checkRouteX(t, "GET", ts.URL+"/csv", 200, "a,b,c\n", nil)
+	etag := r.Header.Get("ETag")
+	r, _ = checkRouteX(t, "GET", ts.URL+"/csv", 304, "", func(req *http.Request) {
+		req.Header.Set("If-None-Match", etag)
+	})
+	if r.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary on 304, got %v", r.Header["Vary"])
+	}
+}
@@ -0,0 +1,77 @@
+package download
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// verifyReader computes the checksum of a stream as it is read, and
+// compares it with the stored checksum once the whole stream has been
+// read. A mismatch is logged. If abort is set the request is also
+// aborted, by panicking with http.ErrAbortHandler before the last block
+// is returned, so the client sees a truncated response instead of
+// receiving corrupt content without knowing.
+type verifyReader struct {
+	io.ReadCloser
+	pid      string
+	h        hash.Hash // nil once finished
+	checksum string
+	expect   int64 // or -1 if the length is not known
+	n        int64
+	abort    bool
+}
+
+// verify wraps the content of pid so it is checked against its stored
+// checksum as it is streamed, if the handler verifies content. Range
+// requests are not checked, since they do not read the whole stream. The
+// content is returned unchanged if there is no checksum of a supported
+// type.
+func (dh *DownloadHandler) verify(r *http.Request, pid string, dsinfo fedora.DsInfo, info fedora.ContentInfo, content io.ReadCloser) io.ReadCloser {
+	if !dh.Verify || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+		return content
+	}
+	h, expected := contentChecksum(dsinfo, info)
+	if h == nil {
+		return content
+	}
+	n, err := strconv.ParseInt(info.Length, 10, 64)
+	if err != nil || n <= 0 {
+		n = -1
+	}
+	return &verifyReader{
+		ReadCloser: content,
+		pid:        pid,
+		h:          h,
+		checksum:   expected,
+		expect:     n,
+		abort:      dh.VerifyAbort,
+	}
+}
+
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	if vr.h == nil {
+		return n, err
+	}
+	vr.h.Write(p[:n])
+	vr.n += int64(n)
+	// ServeContent stops reading once it has the expected length, so
+	// we may not see an EOF
+	if err == io.EOF || (vr.expect > 0 && vr.n >= vr.expect) {
+		sum := hex.EncodeToString(vr.h.Sum(nil))
+		vr.h = nil
+		if sum != vr.checksum {
+			log.Printf("Checksum mismatch for %s: expected %s, got %s", vr.pid, vr.checksum, sum)
+			if vr.abort {
+				panic(http.ErrAbortHandler)
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+package download
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestVerify(t *testing.T) {
+	dsinfo := fedora.DsInfo{
+		Checksum:     "5d41402abc4b2a76b9719d911017c592", // md5 of "hello"
+		ChecksumType: "MD5",
+	}
+	info := fedora.ContentInfo{Length: "5"}
+	r := httptest.NewRequest("GET", "/0123", nil)
+
+	dh := &DownloadHandler{Verify: true, VerifyAbort: true}
+	content := dh.verify(r, "test:0123", dsinfo, info, ioutil.NopCloser(strings.NewReader("hello")))
+	if _, ok := content.(*verifyReader); !ok {
+		t.Fatalf("Expected a verifyReader, got %T", content)
+	}
+	b, err := ioutil.ReadAll(content)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("Expected hello, got %q, %v", b, err)
+	}
+
+	// a mismatch aborts the request
+	content = dh.verify(r, "test:0123", dsinfo, info, ioutil.NopCloser(strings.NewReader("jello")))
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("Expected ErrAbortHandler, got %v", p)
+			}
+		}()
+		ioutil.ReadAll(content)
+	}()
+
+	// range requests are not checked
+	r.Header.Set("Range", "bytes=0-1")
+	content = dh.verify(r, "test:0123", dsinfo, info, ioutil.NopCloser(strings.NewReader("jello")))
+	if _, ok := content.(*verifyReader); ok {
+		t.Errorf("Expected range request to not be verified")
+	}
+}
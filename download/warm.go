@@ -0,0 +1,109 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Warm loads the given identifier into the caches of the handler, if it is
+// not there already. The id need not include the handler's prefix.
+// Nothing is done if the handler has no caches.
+func (dh *DownloadHandler) Warm(id string) error {
+	if dh.Cache == nil && dh.DiskCache == nil {
+		return nil
+	}
+	prefix, id := dh.splitPrefix(id)
+	pid := prefix + id
+	dsinfo, err := dh.Fedora.GetDatastreamInfo(pid, dh.Ds)
+	if err != nil {
+		return err
+	}
+	key := dh.cacheKey(pid, dsinfo)
+	if content, _, ok := dh.cached(key); ok {
+		content.Close()
+		return nil
+	}
+	content, info, err := dh.getContent(context.Background(), pid, dsinfo)
+	if err != nil {
+		return err
+	}
+	content = dh.Cache.Filler(key, dsinfo, info, content)
+	content = dh.DiskCache.Filler(key, dsinfo, info, content)
+	_, err = CopyBuffer(ioutil.Discard, content)
+	content.Close()
+	return err
+}
+
+// A WarmHandler accepts lists of identifiers to load into the caches of
+// the download handlers, for example before a press release. It handles
+// the route
+//
+//	POST /warm/:handler
+//
+// where the body is a list of identifiers, one per line. The response is
+// sent immediately and the identifiers are loaded in the background.
+type WarmHandler struct {
+	Handlers map[string]*DownloadHandler // by handler name
+	Workers  int                         // number of items to load at once
+}
+
+func (wh *WarmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/warm/")
+	dh, ok := wh.Handlers[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var ids []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Warm %s: %d items", name, len(ids))
+	go wh.warm(name, dh, ids)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// warm loads the ids into dh using a number of workers.
+func (wh *WarmHandler) warm(name string, dh *DownloadHandler, ids []string) {
+	workers := wh.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	c := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range c {
+				if err := dh.Warm(id); err != nil {
+					log.Printf("Warm %s (%s): %s", name, id, err)
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		c <- id
+	}
+	close(c)
+	wg.Wait()
+	log.Printf("Warm %s: finished", name)
+}
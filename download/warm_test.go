@@ -0,0 +1,44 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	dh.Cache = NewMemoryCache(1000, 100)
+	wh := httptest.NewServer(&WarmHandler{
+		Handlers: map[string]*DownloadHandler{"dl": dh},
+		Workers:  2,
+	})
+	defer wh.Close()
+
+	resp, err := http.Post(wh.URL+"/warm/dl", "text/plain", strings.NewReader("0123\n\nabc\nmissing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 202 {
+		t.Errorf("Expected 202, got %d", resp.StatusCode)
+	}
+	for _, key := range []string{"test:0123/content/content.0", "test:abc/content/content.0"} {
+		var ok bool
+		for i := 0; i < 100 && !ok; i++ {
+			_, ok = dh.Cache.Get(key)
+			time.Sleep(time.Millisecond)
+		}
+		if !ok {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+
+	checkRoute(t, "POST", wh.URL+"/warm/other", 404, "")
+	checkRoute(t, "GET", wh.URL+"/warm/dl", 405, "")
+}
@@ -0,0 +1,293 @@
+package download
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// DavHandler exposes fedora objects as a read-only WebDAV tree, so the
+// repository can be mounted in a file browser. Each object is a folder
+// containing its members (according to the resource index) as subfolders,
+// and its datastreams as files. Only datastreams having an entry in
+// Handlers are shown, and their content is served by that handler.
+//
+// The paths have the form
+//
+//	/                    lists the objects in Roots
+//	/:id/                an object
+//	/:id/:id2/           member id2 of object id, and so on
+//	/:id/:dsid           datastream dsid of object id
+//
+// The methods OPTIONS, PROPFIND, GET, and HEAD are supported. PROPFIND
+// requests with a depth of infinity are refused.
+//
+// Datastreams are only listed if the Auth of their handler allows them,
+// and objects only if the Auth of every handler does. Downloads wait
+// for the Limits of their handler, if it has one, shared with the
+// handler's own listener.
+type DavHandler struct {
+	Fedora   fedora.Fedora
+	Prefix   string                       // the PID prefix to use, needs colon
+	Roots    []string                     // the pids shown at the top
+	Handlers map[string]*DownloadHandler  // by datastream id
+	Limits   map[string]*ConcurrencyLimit // by datastream id. Optional.
+}
+
+func (dav *DavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		return
+	case "PROPFIND", "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the last component of the path is either the object or the datastream
+	p := path.Clean("/" + r.URL.Path)
+	components := strings.Split(strings.Trim(p, "/"), "/")
+	last := components[len(components)-1]
+	isFolder := strings.HasSuffix(r.URL.Path, "/") || p == "/"
+	if dh, ok := dav.Handlers[last]; ok && !isFolder && len(components) > 1 {
+		id := components[len(components)-2]
+		if !dh.validID(id) {
+			http.NotFound(w, r)
+			return
+		}
+		pid := dav.Prefix + id
+		if r.Method == "PROPFIND" {
+			dav.propfindFile(w, r, p, pid, dh)
+			return
+		}
+		var get http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dh.downloadSingleFile(pid, w, r)
+		})
+		if cl := dav.Limits[last]; cl != nil {
+			get = cl.Wrap(get)
+		}
+		get.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "PROPFIND" {
+		// GET on a folder. There is nothing sensible to return.
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var pid string
+	if p != "/" {
+		if !dav.validID(last) {
+			http.NotFound(w, r)
+			return
+		}
+		pid = dav.Prefix + last
+	}
+	dav.propfindFolder(w, r, strings.TrimSuffix(p, "/")+"/", pid)
+}
+
+// validID returns true if id is well formed for every handler, since a
+// folder lists the datastreams of them all.
+func (dav *DavHandler) validID(id string) bool {
+	for _, dh := range dav.Handlers {
+		if !dh.validID(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// davResponse is a single response element in a multistatus document.
+type davResponse struct {
+	Href        string          `xml:"D:href"`
+	DisplayName string          `xml:"D:propstat>D:prop>D:displayname"`
+	Type        davResourceType `xml:"D:propstat>D:prop>D:resourcetype"`
+	Length      string          `xml:"D:propstat>D:prop>D:getcontentlength,omitempty"`
+	Modified    string          `xml:"D:propstat>D:prop>D:getlastmodified,omitempty"`
+	MIMEType    string          `xml:"D:propstat>D:prop>D:getcontenttype,omitempty"`
+	ETag        string          `xml:"D:propstat>D:prop>D:getetag,omitempty"`
+	Status      string          `xml:"D:propstat>D:status"`
+}
+
+// davResourceType is empty for files.
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// depth returns the Depth header of a PROPFIND request. The result is
+// 0, 1, or -1 for infinity, which is the default.
+func depth(r *http.Request) int {
+	switch r.Header.Get("Depth") {
+	case "0":
+		return 0
+	case "1":
+		return 1
+	}
+	return -1
+}
+
+// propfindFolder replies with the properties of the object pid, and, if
+// the depth is 1, its members and datastreams. The root folder has an
+// empty pid.
+func (dav *DavHandler) propfindFolder(w http.ResponseWriter, r *http.Request, href, pid string) {
+	d := depth(r)
+	if d < 0 {
+		http.Error(w, "403 Forbidden: infinite depth not supported", http.StatusForbidden)
+		return
+	}
+	if pid == "" {
+		responses := []davResponse{folder(href, "/")}
+		if d == 1 {
+			responses = append(responses, dav.folders(r, href, dav.Roots)...)
+		}
+		writeMultistatus(w, responses)
+		return
+	}
+	if !writeAuthError(Download{Pid: pid}, dav.check(r, pid), w) {
+		return
+	}
+	// this also checks that the object exists
+	entries, err := dav.Fedora.ListDatastreams(pid)
+	if err != nil {
+		dav.fedoraError(w, r, pid, err)
+		return
+	}
+	responses := []davResponse{folder(href, strings.TrimPrefix(pid, dav.Prefix))}
+	if d == 1 {
+		members, err := dav.Fedora.ListMembers(pid)
+		if err != nil {
+			log.Printf("dav: members of %s: %s", pid, err)
+		}
+		responses = append(responses, dav.folders(r, href, members)...)
+		for _, ds := range entries {
+			dh, ok := dav.Handlers[ds.ID]
+			if !ok {
+				continue
+			}
+			dsinfo, err := dh.Fedora.GetDatastreamInfo(pid, ds.ID)
+			if err != nil {
+				continue
+			}
+			if dh.Auth != nil && dh.Auth.Check(Download{Pid: pid, Ds: ds.ID, DsInfo: dsinfo}, r) != nil {
+				continue
+			}
+			responses = append(responses, file(href+ds.ID, ds.ID, dh, dsinfo))
+		}
+	}
+	writeMultistatus(w, responses)
+}
+
+// folders returns a response for each of the given pids inside of the
+// folder href. Pids outside of our namespace, or which r may not see, are
+// skipped.
+func (dav *DavHandler) folders(r *http.Request, href string, pids []string) []davResponse {
+	var result []davResponse
+	for _, pid := range pids {
+		if !strings.HasPrefix(pid, dav.Prefix) || dav.check(r, pid) != nil {
+			continue
+		}
+		id := strings.TrimPrefix(pid, dav.Prefix)
+		result = append(result, folder(href+id+"/", id))
+	}
+	return result
+}
+
+// check returns an error if the Auth of any handler refuses r the object
+// pid.
+func (dav *DavHandler) check(r *http.Request, pid string) error {
+	for ds, dh := range dav.Handlers {
+		if dh.Auth == nil {
+			continue
+		}
+		if err := dh.Auth.Check(Download{Pid: pid, Ds: ds}, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// propfindFile replies with the properties of a datastream.
+func (dav *DavHandler) propfindFile(w http.ResponseWriter, r *http.Request, href, pid string, dh *DownloadHandler) {
+	dsinfo, err := dh.Fedora.GetDatastreamInfo(pid, dh.Ds)
+	if err != nil {
+		dav.fedoraError(w, r, pid, err)
+		return
+	}
+	if !dh.authorized(Download{Pid: pid, Ds: dh.Ds, DsInfo: dsinfo}, w, r) {
+		return
+	}
+	writeMultistatus(w, []davResponse{file(href, path.Base(href), dh, dsinfo)})
+}
+
+func folder(href, name string) davResponse {
+	return davResponse{
+		Href:        escapeHref(href),
+		DisplayName: name,
+		Type:        davResourceType{Collection: &struct{}{}},
+		Status:      "HTTP/1.1 200 OK",
+	}
+}
+
+func file(href, name string, dh *DownloadHandler, dsinfo fedora.DsInfo) davResponse {
+	if dsinfo.Label != "" {
+		name = dsinfo.Label
+	}
+	resp := davResponse{
+		Href:        escapeHref(href),
+		DisplayName: name,
+		MIMEType:    dsinfo.MIMEType,
+		ETag:        dh.etag(dsinfo),
+		Status:      "HTTP/1.1 200 OK",
+	}
+	if size, ok := dsinfo.KnownSize(); ok {
+		resp.Length = strconv.FormatInt(size, 10)
+	}
+	if !dsinfo.Created.IsZero() {
+		resp.Modified = dsinfo.Created.UTC().Format(http.TimeFormat)
+	}
+	return resp
+}
+
+// escapeHref percent-encodes each segment of the path href.
+func escapeHref(href string) string {
+	segments := strings.Split(href, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func (dav *DavHandler) fedoraError(w http.ResponseWriter, r *http.Request, pid string, err error) {
+	if err == fedora.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("dav: %s: %s", pid, err)
+	http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207) // Multi-Status
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	err := enc.Encode(struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		Namespace string        `xml:"xmlns:D,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}{
+		Namespace: "DAV:",
+		Responses: responses,
+	})
+	if err != nil {
+		log.Println("dav:", err)
+	}
+}
@@ -0,0 +1,115 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setupDav() *httptest.Server {
+	ts := setupHandler()
+	dh := ts.Config.Handler.(*DownloadHandler)
+	ts.Close()
+	tf := dh.Fedora.(interface {
+		AddMember(id, member string)
+	})
+	tf.AddMember("test:0123", "test:123")
+	tf.AddMember("test:0123", "another:xyz")
+	tf.AddMember("test:0123", "test:a b#c")
+	dav := &DavHandler{
+		Fedora:   dh.Fedora,
+		Prefix:   "test:",
+		Roots:    []string{"test:0123"},
+		Handlers: map[string]*DownloadHandler{"content": dh},
+	}
+	return httptest.NewServer(dav)
+}
+
+func TestDav(t *testing.T) {
+	ts := setupDav()
+	defer ts.Close()
+
+	resp, _ := checkRouteX(t, "OPTIONS", ts.URL+"/", 200, "", nil)
+	if resp.Header.Get("DAV") != "1" {
+		t.Errorf("Expected DAV header, got %q", resp.Header.Get("DAV"))
+	}
+
+	depth := func(d string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Depth", d) }
+	}
+	var table = []struct {
+		route    string
+		depth    string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{"/", "0", 207, []string{"<D:href>/</D:href>"}, []string{"0123/"}},
+		{"/", "1", 207, []string{"<D:href>/0123/</D:href>"}, nil},
+		{"/0123/", "1", 207,
+			[]string{"<D:href>/0123/123/</D:href>", "<D:href>/0123/content</D:href>", "<D:getcontentlength>5</D:getcontentlength>",
+				"<D:href>/0123/a%20b%23c/</D:href>"},
+			[]string{"xyz"}},
+		{"/0123/content", "0", 207, []string{"<D:getetag>&#34;content.0&#34;</D:getetag>"}, []string{"<D:collection>"}},
+		{"/0123/", "infinity", 403, nil, nil},
+		{"/0123/", "", 403, nil, nil},
+		{"/zzz/", "0", 404, nil, nil},
+	}
+	for _, s := range table {
+		_, body := checkRouteX(t, "PROPFIND", ts.URL+s.route, s.status, "", depth(s.depth))
+		for _, c := range s.contains {
+			if !strings.Contains(string(body), c) {
+				t.Errorf("%s depth %s: expected %s in %s", s.route, s.depth, c, body)
+			}
+		}
+		for _, c := range s.excludes {
+			if strings.Contains(string(body), c) {
+				t.Errorf("%s depth %s: did not expect %s in %s", s.route, s.depth, c, body)
+			}
+		}
+	}
+
+	checkRoute(t, "GET", ts.URL+"/0123/123/content", 200, "goodbye")
+	checkRoute(t, "GET", ts.URL+"/0123/", 405, "")
+	checkRoute(t, "PUT", ts.URL+"/0123/content", 405, "")
+}
+
+func TestDavAuth(t *testing.T) {
+	ts := setupDav()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DavHandler).Handlers["content"]
+	setupAuth(dh)
+
+	depth := func(r *http.Request) { r.Header.Set("Depth", "1") }
+	_, body := checkRouteX(t, "PROPFIND", ts.URL+"/0123/", 207, "", depth)
+	if !strings.Contains(string(body), "<D:href>/0123/content</D:href>") {
+		t.Errorf("Expected the open datastream in %s", body)
+	}
+	// the restricted member, and the one without rights, are left out
+	if strings.Contains(string(body), "<D:href>/0123/123/</D:href>") || strings.Contains(string(body), "a%20b") {
+		t.Errorf("Expected no restricted members in %s", body)
+	}
+	checkRouteX(t, "PROPFIND", ts.URL+"/123/", 403, "", depth)
+	checkRouteX(t, "PROPFIND", ts.URL+"/0123/123/content", 403, "", depth)
+	checkRoute(t, "GET", ts.URL+"/0123/123/content", 403, "")
+}
+
+func TestDavValidID(t *testing.T) {
+	ts := setupDav()
+	defer ts.Close()
+	dh := ts.Config.Handler.(*DavHandler).Handlers["content"]
+	v, err := NewRegexpValidator("[0-9]+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh.Validator = v
+
+	depth := func(r *http.Request) { r.Header.Set("Depth", "0") }
+	checkRoute(t, "GET", ts.URL+"/0123/123/content", 200, "goodbye")
+	checkRoute(t, "GET", ts.URL+"/0123/abc/content", 404, "")
+	checkRoute(t, "HEAD", ts.URL+"/0123/abc/content", 404, "")
+	checkRouteX(t, "PROPFIND", ts.URL+"/0123/abc/content", 404, "", depth)
+	checkRouteX(t, "PROPFIND", ts.URL+"/abc/", 404, "", depth)
+	checkRouteX(t, "PROPFIND", ts.URL+"/0123/", 207, "", depth)
+}
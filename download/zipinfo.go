@@ -0,0 +1,241 @@
+package download
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// DefaultZipPrefetch is how many members of a zip download have their
+// datastream info looked up at once, if ZipPrefetch is not set.
+const DefaultZipPrefetch = 4
+
+// A zipMember is an item of a zip download, whose datastream info is
+// looked up ahead of the item being written.
+type zipMember struct {
+	name   string // as given in the request
+	pid    string
+	ds     string // if not the handler's
+	src    *DownloadHandler
+	dsinfo fedora.DsInfo
+	err    error
+	done   chan struct{} // closed once the lookup finishes
+}
+
+// prefetchZip starts looking up the datastream info of the items in
+// names, a few at a time and in order, so that the zip can start sooner
+// and is not held up by each lookup in turn. Each item is also checked
+// with the Auth of dh, if it has one, on behalf of r. Items with invalid
+// identifiers are left out. The lookups stop if ctx is canceled.
+func (dh *DownloadHandler) prefetchZip(ctx context.Context, r *http.Request, zipPid string, names []string) []*zipMember {
+	var members []*zipMember
+	for _, name := range names {
+		prefix, id := dh.splitPrefix(name)
+		if !dh.validID(id) {
+			log.Printf("Invalid identifier (zip:%s/%s)", zipPid, name)
+			continue
+		}
+		members = append(members, &zipMember{
+			name: name,
+			pid:  prefix + id,
+			done: make(chan struct{}),
+		})
+	}
+	dh.prefetch(ctx, r, members)
+	return members
+}
+
+// prefetch looks up the members a few at a time, in order.
+func (dh *DownloadHandler) prefetch(ctx context.Context, r *http.Request, members []*zipMember) {
+	workers := dh.ZipPrefetch
+	if workers <= 0 {
+		workers = DefaultZipPrefetch
+	}
+	if workers > len(members) {
+		workers = len(members)
+	}
+	next := make(chan *zipMember, len(members))
+	for _, m := range members {
+		next <- m
+	}
+	close(next)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for m := range next {
+				if m.err = ctx.Err(); m.err == nil {
+					src := dh
+					if m.ds != "" {
+						src = dh.withDatastream(m.ds)
+					}
+					m.src, m.dsinfo, m.err = src.lookup(m.pid)
+				}
+				if m.err == nil && dh.Auth != nil {
+					m.err = dh.Auth.Check(Download{Pid: m.pid, Ds: m.src.Ds, DsInfo: m.dsinfo}, r)
+				}
+				close(m.done)
+			}
+		}()
+	}
+}
+
+// defaultName returns the name of the member in an archive if its label
+// cannot be used.
+func (m *zipMember) defaultName() string {
+	if m.ds != "" {
+		return m.ds
+	}
+	return m.pid
+}
+
+// downloadObject streams an archive of the datastreams of pid matching
+// ZipDatastreams, with the routes
+//
+//	GET /:id/zip
+//	GET /:id/tar
+//	GET /:id/tar.gz
+func (dh *DownloadHandler) downloadObject(pid, route string, w http.ResponseWriter, r *http.Request) {
+	if len(dh.ZipDatastreams) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	format, ok := archiveFormat(route, r)
+	if !ok {
+		http.Error(w, "400 Bad format", http.StatusBadRequest)
+		return
+	}
+	entries, err := dh.Fedora.ListDatastreams(pid)
+	if err == fedora.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Received Fedora error listing %s: %s", pid, err)
+		writeUnavailable(w, fedoraRetryAfter)
+		return
+	}
+	var members []*zipMember
+	seen := make(map[string]bool)
+	for _, pattern := range dh.ZipDatastreams {
+		for _, e := range entries {
+			if ok, _ := path.Match(pattern, e.ID); !ok || seen[e.ID] {
+				continue
+			}
+			seen[e.ID] = true
+			members = append(members, &zipMember{
+				name: pid + "/" + e.ID,
+				pid:  pid,
+				ds:   e.ID,
+				done: make(chan struct{}),
+			})
+		}
+	}
+	if len(members) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	dh.prefetch(ctx, r, members)
+	dh.serveArchive(pid, format, members, len(members), w, r)
+}
+
+// the comments written in zip downloads, followed by the pid of the zip
+// and of each member
+const (
+	zipComment       = "Downloaded from CurateND: "
+	zipMemberComment = "CurateND:"
+)
+
+// the bytes the zip writer adds for each member, besides its name and
+// comment: the local header, the data descriptor, the central directory
+// entry, and a modification time field in each header. The end of the
+// central directory adds zipEndSize more.
+const (
+	zipMemberOverhead = 30 + 16 + 46 + 2*9
+	zipEndSize        = 22
+)
+
+// headZip replies to a HEAD request for an archive of the members, which
+// were looked up from the requested number of items. The
+// X-Estimated-Length header gives the size a zip would have if its
+// members did not compress, which is close to the actual size for the
+// images and PDFs usually downloaded, or the size of a tar. It is left out
+// if the size of any member is unknown, and for tar.gz. X-Zip-Members is
+// the number of members the archive would have, and X-Zip-Skipped the
+// number of items left out because they are missing, denied, or have
+// invalid identifiers. Hooks are not run, so members they would refuse are
+// still counted.
+func (dh *DownloadHandler) headZip(zipPid, format string, members []*zipMember, requested int, w http.ResponseWriter, r *http.Request) {
+	total := int64(zipEndSize + len(zipComment) + len(zipPid))
+	if format != formatZip {
+		total = tarEndSize
+	}
+	known := format != formatTarGz
+	found := 0
+	manifest := dh.newZipManifest()
+	manifestSize := 0
+	names := entryNames{}
+	if manifest != nil {
+		names.reserve(manifest.name())
+	}
+	for _, m := range members {
+		select {
+		case <-m.done:
+		case <-r.Context().Done():
+			return
+		}
+		if m.err != nil {
+			continue
+		}
+		found++
+		size, ok := m.dsinfo.KnownSize()
+		if !ok {
+			known = false
+		}
+		name := names.add(m.dsinfo.Label, m.defaultName())
+		total += archiveMemberSize(format, name, zipMemberComment+m.name, size)
+		if manifest != nil {
+			manifestSize += manifest.lineSize(name)
+		}
+	}
+	if manifest != nil {
+		total += archiveMemberSize(format, manifest.name(), "", int64(manifestSize))
+	}
+	if known {
+		w.Header().Set("X-Estimated-Length", strconv.FormatInt(total, 10))
+	}
+	w.Header().Set("X-Zip-Members", strconv.Itoa(found))
+	w.Header().Set("X-Zip-Skipped", strconv.Itoa(requested-found))
+	w.WriteHeader(http.StatusOK)
+}
+
+// zipDenied waits for the lookups of members, and returns true after
+// writing a 403 error if any member was denied. If a lookup failed
+// otherwise the member is simply left out later.
+func zipDenied(members []*zipMember, w http.ResponseWriter, r *http.Request) bool {
+	for _, m := range members {
+		select {
+		case <-m.done:
+		case <-r.Context().Done():
+			return true
+		}
+		if isDenied(m.err) {
+			log.Printf("Access denied (zip:%s)", m.name)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return true
+		}
+	}
+	return false
+}
+
+// archiveMemberSize returns the bytes an archive of the given format uses
+// for a member, if it is not compressed.
+func archiveMemberSize(format, name, comment string, size int64) int64 {
+	if format == formatZip {
+		return zipMemberOverhead + 2*int64(len(name)) + int64(len(comment)) + size
+	}
+	return tarMemberSize(name, comment, size)
+}
@@ -0,0 +1,93 @@
+package download
+
+import (
+	"archive/zip"
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+// slowInfoFedora wraps a Fedora, delaying info requests and recording
+// how many were made at once.
+type slowInfoFedora struct {
+	fedora.Fedora
+	delay time.Duration
+
+	m       sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (sf *slowInfoFedora) GetDatastreamInfo(id, dsname string) (fedora.DsInfo, error) {
+	sf.m.Lock()
+	sf.active++
+	if sf.active > sf.maxSeen {
+		sf.maxSeen = sf.active
+	}
+	sf.m.Unlock()
+	time.Sleep(sf.delay)
+	sf.m.Lock()
+	sf.active--
+	sf.m.Unlock()
+	return sf.Fedora.GetDatastreamInfo(id, dsname)
+}
+
+func TestZipPrefetch(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	dh := ts.Config.Handler.(*DownloadHandler)
+	sf := &slowInfoFedora{Fedora: dh.Fedora, delay: 20 * time.Millisecond}
+	dh.Fedora = sf
+	dh.ZipPrefetch = 3
+
+	ids := strings.Repeat("0123,123,abc,", 3) + "missing,0123"
+	_, body := checkRouteX(t, "GET", ts.URL+"/0123/zip/"+ids, 200, "", nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// members are written in the order given
+	if len(zr.File) != 10 || zr.File[1].Comment != "CurateND:123" || zr.File[9].Comment != "CurateND:0123" {
+		t.Errorf("Unexpected zip members")
+	}
+	if sf.maxSeen != 3 {
+		t.Errorf("Expected 3 lookups at once, got %d", sf.maxSeen)
+	}
+}
+
+func TestZipHead(t *testing.T) {
+	ts := setupHandler()
+	defer ts.Close()
+
+	route := ts.URL + "/0123/zip/123,0123,missing"
+	resp, _ := checkRouteX(t, "HEAD", route, 200, "", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Expected application/zip, got %q", ct)
+	}
+	if n := resp.Header.Get("X-Zip-Members"); n != "2" {
+		t.Errorf("Expected 2 members, got %q", n)
+	}
+	if n := resp.Header.Get("X-Zip-Skipped"); n != "1" {
+		t.Errorf("Expected 1 skipped, got %q", n)
+	}
+	estimate, err := strconv.ParseInt(resp.Header.Get("X-Estimated-Length"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the short members grow by about 7 bytes each when deflated
+	_, body := checkRouteX(t, "GET", route, 200, "", nil)
+	if d := int64(len(body)) - estimate; d < 0 || d > 20 {
+		t.Errorf("Expected an estimate near %d, got %d", len(body), estimate)
+	}
+
+	resp, _ = checkRouteX(t, "HEAD", ts.URL+"/0123/zip/badsize", 200, "", nil)
+	if e := resp.Header.Get("X-Estimated-Length"); e != "" {
+		t.Errorf("Expected no estimate, got %q", e)
+	}
+}
@@ -0,0 +1,99 @@
+package fedora
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// NewRemoteConditional is like NewRemoteClient, but remembers the info of
+// the last size datastreams it looked up along with the ETag and
+// Last-Modified headers fedora sent. Later lookups of the same datastream
+// are conditional requests, and the remembered info is reused if fedora
+// replies that it has not changed, saving the transfer and decoding of
+// the profile.
+func NewRemoteConditional(fedoraPath string, namespace string, client *http.Client, size int) Fedora {
+	rf := NewRemoteClient(fedoraPath, namespace, client).(*remoteFedora)
+	if size > 0 {
+		rf.infos = newInfoCache(size)
+	}
+	return rf
+}
+
+// An infoCache remembers datastream infos and their validators, evicting
+// the least recently used once it holds max of them. A nil *infoCache is
+// always empty. It is safe to be called by multiple goroutines.
+type infoCache struct {
+	max int
+
+	m     sync.Mutex
+	lru   *list.List // of *infoEntry, most recently used at the front
+	items map[string]*list.Element
+}
+
+type infoEntry struct {
+	key          string // the request URL
+	etag         string
+	lastModified string
+	info         DsInfo
+}
+
+func newInfoCache(max int) *infoCache {
+	return &infoCache{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// setConditional adds the validators remembered for key, the request's
+// URL, if any, and returns the entry they belong to.
+func (ic *infoCache) setConditional(key string, req *http.Request) (infoEntry, bool) {
+	if ic == nil {
+		return infoEntry{}, false
+	}
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	e, ok := ic.items[key]
+	if !ok {
+		return infoEntry{}, false
+	}
+	ic.lru.MoveToFront(e)
+	entry := *e.Value.(*infoEntry)
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+	return entry, true
+}
+
+// add remembers the info returned for key, if the response headers have a
+// validator.
+func (ic *infoCache) add(key string, header http.Header, info DsInfo) {
+	if ic == nil {
+		return
+	}
+	entry := &infoEntry{
+		key:          key,
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+		info:         info,
+	}
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	if e, ok := ic.items[entry.key]; ok {
+		ic.lru.Remove(e)
+		delete(ic.items, entry.key)
+	}
+	if entry.etag == "" && entry.lastModified == "" {
+		return
+	}
+	ic.items[entry.key] = ic.lru.PushFront(entry)
+	for ic.lru.Len() > ic.max {
+		e := ic.lru.Back()
+		ic.lru.Remove(e)
+		delete(ic.items, e.Value.(*infoEntry).key)
+	}
+}
@@ -0,0 +1,70 @@
+package fedora
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConditionalInfo(t *testing.T) {
+	version := 1
+	var full, notModified int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `<datastreamProfile><dsVersionID>content.%d</dsVersionID></datastreamProfile>`, version)
+	}))
+	defer ts.Close()
+
+	f := NewRemoteConditional(ts.URL, "test:", http.DefaultClient, 10)
+	for i := 0; i < 3; i++ {
+		info, err := f.GetDatastreamInfo("1", "content")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.VersionID != "content.1" {
+			t.Errorf("Expected content.1, got %q", info.VersionID)
+		}
+	}
+	if full != 1 || notModified != 2 {
+		t.Errorf("Expected 1 full and 2 conditional replies, got %d and %d", full, notModified)
+	}
+
+	version = 2
+	info, err := f.GetDatastreamInfo("1", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.VersionID != "content.2" || full != 2 {
+		t.Errorf("Expected a new version, got %q", info.VersionID)
+	}
+}
+
+func TestInfoCacheEviction(t *testing.T) {
+	ic := newInfoCache(2)
+	h := make(http.Header)
+	h.Set("ETag", `"x"`)
+	ic.add("a", h, DsInfo{})
+	ic.add("b", h, DsInfo{})
+	req, _ := http.NewRequest("GET", "http://fedora/", nil)
+	ic.setConditional("a", req) // a is now the most recent
+	ic.add("c", h, DsInfo{})
+	if _, ok := ic.items["b"]; ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, ok := ic.items["a"]; !ok {
+		t.Errorf("Expected a to be kept")
+	}
+	// responses without validators are not kept
+	ic.add("a", make(http.Header), DsInfo{})
+	if _, ok := ic.items["a"]; ok {
+		t.Errorf("Expected a to be removed")
+	}
+}
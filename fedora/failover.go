@@ -0,0 +1,181 @@
+package fedora
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// A Pinger is a Fedora which can check whether it is up.
+type Pinger interface {
+	Ping() error
+}
+
+// Failover is a Fedora which sends each request to the first of several
+// repositories which is healthy, such as a primary and its read replicas.
+// A repository is marked unhealthy when a request to it fails for any
+// reason other than the item being missing or access being denied, and
+// the request is tried on the next one. It is marked healthy again once a
+// health check passes, so requests return to the primary when it
+// recovers. If every repository is unhealthy they are tried anyway, in
+// order.
+//
+// Use NewFailover to make one, and call Monitor to run the health checks.
+type Failover struct {
+	repos []*failoverRepo
+}
+
+type failoverRepo struct {
+	Fedora
+	name string
+	down atomic.Bool
+}
+
+// NewFailover returns a Failover using the given repositories, the
+// first being the primary. The names are used when logging.
+func NewFailover(names []string, repos []Fedora) *Failover {
+	f := &Failover{}
+	for i, repo := range repos {
+		f.repos = append(f.repos, &failoverRepo{Fedora: repo, name: names[i]})
+	}
+	return f
+}
+
+// Monitor checks the health of each unhealthy repository every interval.
+// Repositories which are not Pingers are assumed to recover by the next
+// check. It does not return.
+func (f *Failover) Monitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		f.Check()
+	}
+}
+
+// Check checks the health of each unhealthy repository.
+func (f *Failover) Check() {
+	for _, repo := range f.repos {
+		if !repo.down.Load() {
+			continue
+		}
+		if p, ok := repo.Fedora.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				continue
+			}
+		}
+		log.Printf("Fedora %s is up", repo.name)
+		repo.down.Store(false)
+	}
+}
+
+// try calls fn on each repository in turn until one gives an answer.
+// Healthy repositories are tried first.
+func (f *Failover) try(fn func(Fedora) error) error {
+	var order, down []*failoverRepo
+	for _, repo := range f.repos {
+		if repo.down.Load() {
+			down = append(down, repo)
+		} else {
+			order = append(order, repo)
+		}
+	}
+	var err error
+	for _, repo := range append(order, down...) {
+		err = fn(repo.Fedora)
+		if err == nil || err == ErrNotFound || err == ErrNotAuthorized || err == ErrNoLocation {
+			return err
+		}
+		if !repo.down.Swap(true) {
+			log.Printf("Fedora %s is down: %s", repo.name, err)
+		}
+	}
+	return err
+}
+
+// GetDatastream returns the content from the first healthy repository.
+func (f *Failover) GetDatastream(id, dsname string) (io.ReadCloser, ContentInfo, error) {
+	var body io.ReadCloser
+	var info ContentInfo
+	err := f.try(func(repo Fedora) error {
+		var err error
+		body, info, err = repo.GetDatastream(id, dsname)
+		return err
+	})
+	return body, info, err
+}
+
+// GetDatastreamInfo returns the info from the first healthy repository.
+func (f *Failover) GetDatastreamInfo(id, dsname string) (DsInfo, error) {
+	var info DsInfo
+	err := f.try(func(repo Fedora) error {
+		var err error
+		info, err = repo.GetDatastreamInfo(id, dsname)
+		return err
+	})
+	return info, err
+}
+
+// GetDatastreamLocation returns the location from the first healthy repository.
+func (f *Failover) GetDatastreamLocation(id, dsname string) (string, error) {
+	var location string
+	err := f.try(func(repo Fedora) error {
+		var err error
+		location, err = repo.GetDatastreamLocation(id, dsname)
+		return err
+	})
+	return location, err
+}
+
+// GetDatastreamHistory returns the history from the first healthy repository.
+func (f *Failover) GetDatastreamHistory(id, dsname string) ([]DsInfo, error) {
+	var result []DsInfo
+	err := f.try(func(repo Fedora) error {
+		var err error
+		result, err = repo.GetDatastreamHistory(id, dsname)
+		return err
+	})
+	return result, err
+}
+
+// ListDatastreams lists the datastreams using the first healthy repository.
+func (f *Failover) ListDatastreams(id string) ([]DsEntry, error) {
+	var result []DsEntry
+	err := f.try(func(repo Fedora) error {
+		var err error
+		result, err = repo.ListDatastreams(id)
+		return err
+	})
+	return result, err
+}
+
+// Export returns the export from the first healthy repository.
+func (f *Failover) Export(id string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := f.try(func(repo Fedora) error {
+		var err error
+		body, err = repo.Export(id)
+		return err
+	})
+	return body, err
+}
+
+// ListMembers lists the members using the first healthy repository.
+func (f *Failover) ListMembers(id string) ([]string, error) {
+	var result []string
+	err := f.try(func(repo Fedora) error {
+		var err error
+		result, err = repo.ListMembers(id)
+		return err
+	})
+	return result, err
+}
+
+// FindIdentifier searches using the first healthy repository.
+func (f *Failover) FindIdentifier(identifier string) ([]string, error) {
+	var result []string
+	err := f.try(func(repo Fedora) error {
+		var err error
+		result, err = repo.FindIdentifier(identifier)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,74 @@
+package fedora
+
+import (
+	"errors"
+	"testing"
+)
+
+// flakyFedora fails every request while broken.
+type flakyFedora struct {
+	*TestFedora
+	broken bool
+}
+
+func (ff *flakyFedora) GetDatastreamInfo(id, dsname string) (DsInfo, error) {
+	if ff.broken {
+		return DsInfo{}, errors.New("connection refused")
+	}
+	return ff.TestFedora.GetDatastreamInfo(id, dsname)
+}
+
+func (ff *flakyFedora) Ping() error {
+	if ff.broken {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestFailover(t *testing.T) {
+	primary := &flakyFedora{TestFedora: NewTestFedora()}
+	primary.Set("test:1", "content", DsInfo{Label: "primary"}, nil)
+	replica := &flakyFedora{TestFedora: NewTestFedora()}
+	replica.Set("test:1", "content", DsInfo{Label: "replica"}, nil)
+	f := NewFailover([]string{"primary", "replica"}, []Fedora{primary, replica})
+
+	label := func() string {
+		info, err := f.GetDatastreamInfo("test:1", "content")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Label
+	}
+	if l := label(); l != "primary" {
+		t.Errorf("Expected primary, got %s", l)
+	}
+	// missing items are not retried on the replica
+	if _, err := f.GetDatastreamInfo("test:2", "content"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	primary.broken = true
+	if l := label(); l != "replica" {
+		t.Errorf("Expected replica, got %s", l)
+	}
+	// the primary stays down until it passes a check
+	primary.broken = false
+	if l := label(); l != "replica" {
+		t.Errorf("Expected replica, got %s", l)
+	}
+	f.Check()
+	if l := label(); l != "primary" {
+		t.Errorf("Expected primary, got %s", l)
+	}
+
+	// with everything down, every repository is still tried
+	primary.broken = true
+	replica.broken = true
+	if _, err := f.GetDatastreamInfo("test:1", "content"); err == nil {
+		t.Errorf("Expected error")
+	}
+	replica.broken = false
+	if l := label(); l != "replica" {
+		t.Errorf("Expected replica, got %s", l)
+	}
+}
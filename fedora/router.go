@@ -0,0 +1,77 @@
+package fedora
+
+import (
+	"io"
+	"strings"
+)
+
+// A Router sends each request to the repository holding the object,
+// chosen by the namespace of its identifier, e.g. "und" for "und:abc123".
+// This lets objects be spread across several repositories, such as during
+// a migration. Objects in other namespaces use Default.
+type Router struct {
+	Default Fedora
+	Routes  map[string]Fedora // by namespace, without the colon
+}
+
+// pick returns the repository for the object id.
+func (rt *Router) pick(id string) Fedora {
+	if i := strings.Index(id, ":"); i >= 0 {
+		if f, ok := rt.Routes[id[:i]]; ok {
+			return f
+		}
+	}
+	return rt.Default
+}
+
+// GetDatastream returns the content from the repository holding id.
+func (rt *Router) GetDatastream(id, dsname string) (io.ReadCloser, ContentInfo, error) {
+	return rt.pick(id).GetDatastream(id, dsname)
+}
+
+// GetDatastreamInfo returns the info from the repository holding id.
+func (rt *Router) GetDatastreamInfo(id, dsname string) (DsInfo, error) {
+	return rt.pick(id).GetDatastreamInfo(id, dsname)
+}
+
+// GetDatastreamLocation returns the location from the repository holding id.
+func (rt *Router) GetDatastreamLocation(id, dsname string) (string, error) {
+	return rt.pick(id).GetDatastreamLocation(id, dsname)
+}
+
+// GetDatastreamHistory returns the history from the repository holding id.
+func (rt *Router) GetDatastreamHistory(id, dsname string) ([]DsInfo, error) {
+	return rt.pick(id).GetDatastreamHistory(id, dsname)
+}
+
+// ListDatastreams lists the datastreams in the repository holding id.
+func (rt *Router) ListDatastreams(id string) ([]DsEntry, error) {
+	return rt.pick(id).ListDatastreams(id)
+}
+
+// Export returns the export from the repository holding id.
+func (rt *Router) Export(id string) (io.ReadCloser, error) {
+	return rt.pick(id).Export(id)
+}
+
+// ListMembers lists the members of id known to the repository holding it.
+func (rt *Router) ListMembers(id string) ([]string, error) {
+	return rt.pick(id).ListMembers(id)
+}
+
+// FindIdentifier searches every repository, since the identifier does not
+// say where the object is. An error from any of them is returned.
+func (rt *Router) FindIdentifier(identifier string) ([]string, error) {
+	result, err := rt.Default.FindIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range rt.Routes {
+		pids, err := f.FindIdentifier(identifier)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pids...)
+	}
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package fedora
+
+import (
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	fedora3 := NewTestFedora()
+	fedora3.Set("und:1", "content", DsInfo{Label: "fedora3"}, nil)
+	fedora3.AddIdentifier("und:1", "doi:10.1/a")
+	fedora6 := NewTestFedora()
+	fedora6.Set("curate:1", "content", DsInfo{Label: "fedora6"}, nil)
+	fedora6.AddIdentifier("curate:1", "doi:10.1/b")
+	rt := &Router{
+		Default: fedora3,
+		Routes:  map[string]Fedora{"curate": fedora6},
+	}
+
+	var table = []struct {
+		id, label string
+	}{
+		{"und:1", "fedora3"},
+		{"curate:1", "fedora6"},
+	}
+	for _, s := range table {
+		info, err := rt.GetDatastreamInfo(s.id, "content")
+		if err != nil || info.Label != s.label {
+			t.Errorf("%s: expected %s, got %q, %v", s.id, s.label, info.Label, err)
+		}
+	}
+	if _, err := rt.GetDatastreamInfo("curate:2", "content"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	pids, err := rt.FindIdentifier("doi:10.1/b")
+	if err != nil || len(pids) != 1 || pids[0] != "curate:1" {
+		t.Errorf("Expected curate:1, got %v, %v", pids, err)
+	}
+}
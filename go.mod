@@ -1,6 +1,6 @@
 module github.com/ndlib/disadis
 
-go 1.15
+go 1.24
 
 require (
 	gopkg.in/gcfg.v1 v1.2.1
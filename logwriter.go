@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ndlib/disadis/download"
+)
+
+// A logWriter wraps a ResponseWriter to record the status code, the number
+// of bytes sent, and the first write error, for the access log.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	err    error
+}
+
+func (lw *logWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(p)
+	lw.n += int64(n)
+	if err != nil && lw.err == nil {
+		lw.err = err
+	}
+	return n, err
+}
+
+// ReadFrom passes through to the underlying ResponseWriter, if it can, so
+// that sendfile(2) is still used for files.
+func (lw *logWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := lw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{lw}, src)
+	}
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := rf.ReadFrom(src)
+	lw.n += n
+	if err != nil && lw.err == nil {
+		lw.err = err
+	}
+	return n, err
+}
+
+// Flush passes through to the underlying ResponseWriter, if it can.
+func (lw *logWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (lw *logWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// Status returns the status code sent, or 200 if nothing was sent.
+func (lw *logWriter) Status() int {
+	if lw.status == 0 {
+		return http.StatusOK
+	}
+	return lw.status
+}
+
+// writerOnly hides any ReadFrom method of the writer, to keep io.Copy from
+// calling it.
+type writerOnly struct {
+	io.Writer
+}
+
+// accessLog returns a handler calling h, which logs each request with the
+// handler name, the client, the user, the status, the bytes sent, and the
+// time taken.
+func accessLog(name string, h http.Handler, userHeader string, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		realip := r.Header.Get("X-Real-IP")
+		if realip == "" {
+			realip = r.RemoteAddr
+		}
+		r = download.WithUser(r)
+		lw := &logWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		user := requestUser(r, userHeader, trusted)
+		// the client went away before the response was sent
+		var aborted string
+		if lw.err != nil || r.Context().Err() != nil {
+			aborted = " aborted"
+		}
+		log.Printf("%s %s %s %s %s %d %d %v%s",
+			name,
+			realip,
+			user,
+			r.Method,
+			r.RequestURI,
+			lw.Status(),
+			lw.n,
+			time.Now().Sub(t),
+			aborted)
+	})
+}
+
+// requestUser returns who is making r, for the access log. This is the
+// owner of its bearer token, if a handler checked one, or else the user in
+// the given header, which the application in front of us sets once it has
+// authenticated the user. The header is only believed from trusted
+// proxies. It returns "anon" if the user is not known.
+func requestUser(r *http.Request, header string, trusted []*net.IPNet) string {
+	user := download.RequestUser(r, header, trusted)
+	if user == "" {
+		return "anon"
+	}
+	// keep the log line parseable
+	return strings.Map(func(c rune) rune {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return '_'
+		}
+		return c
+	}, user)
+}
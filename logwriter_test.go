@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/disadis/download"
+)
+
+func TestLogWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	lw := &logWriter{ResponseWriter: rec}
+	if lw.Status() != 200 {
+		t.Errorf("Expected default status 200, got %d", lw.Status())
+	}
+	lw.WriteHeader(206)
+	lw.Write([]byte("hello"))
+	lw.ReadFrom(strings.NewReader(" world"))
+	if lw.Status() != 206 || lw.n != 11 || lw.err != nil {
+		t.Errorf("Expected 206 11 <nil>, got %d %d %v", lw.Status(), lw.n, lw.err)
+	}
+	if rec.Body.String() != "hello world" {
+		t.Errorf("Received %q", rec.Body.String())
+	}
+
+	// write errors are remembered
+	lw = &logWriter{ResponseWriter: brokenWriter{rec}}
+	lw.Write([]byte("x"))
+	if lw.err == nil {
+		t.Errorf("Expected write error to be recorded")
+	}
+}
+
+// brokenWriter is a ResponseWriter whose client has gone away.
+type brokenWriter struct {
+	http.ResponseWriter
+}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestRequestUser(t *testing.T) {
+	trusted, _ := download.ParseCIDRs([]string{"10.0.0.1"})
+	var table = []struct {
+		header, remote, user string
+		trusted              []*net.IPNet
+		output               string
+	}{
+		{"", "10.0.0.1:1234", "jdoe", nil, "anon"},
+		{"X-Remote-User", "10.0.0.1:1234", "jdoe", nil, "anon"},
+		{"X-Remote-User", "10.0.0.1:1234", "", nil, "anon"},
+		{"X-Remote-User", "10.0.0.1:1234", "jdoe", trusted, "jdoe"},
+		{"X-Remote-User", "10.0.0.2:1234", "jdoe", trusted, "anon"},
+		{"X-Remote-User", "10.0.0.1:1234", "j doe", trusted, "j_doe"},
+	}
+	for _, s := range table {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = s.remote
+		if s.user != "" {
+			r.Header.Set("X-Remote-User", s.user)
+		}
+		if out := requestUser(r, s.header, s.trusted); out != s.output {
+			t.Errorf("%v: expected %q, got %q", s, s.output, out)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gcfg "gopkg.in/gcfg.v1"
+
+	"github.com/ndlib/disadis/download"
+)
+
+// A Reloader serves the handlers made from a config file, and replaces
+// them when the file is reloaded. Requests in progress finish using the
+// handlers they started with.
+//
+// Only the handlers and the stores they use are reloaded. Changes to the
+// general section, such as the fedora address or the ports to listen on,
+// need a restart. Secrets are read again on every reload, and the
+// handlers are only replaced if the config or a secret has changed.
+// Replacing them empties the memory caches.
+type Reloader struct {
+	Filename string
+	Build    func(config) (*handlerSet, error)
+
+	m         sync.Mutex // held while reloading
+	current   atomic.Pointer[handlerSet]
+	config    config            // the config used, with secrets resolved
+	listening map[string]bool   // ports we are listening on
+	sum       [sha256.Size]byte // of the file as last loaded
+}
+
+// Start sets the handlers made from the file as it is now, and the
+// config they were made from.
+func (rl *Reloader) Start(hs *handlerSet, config config) {
+	rl.current.Store(hs)
+	rl.config = config
+	rl.listening = make(map[string]bool)
+	for port := range hs.ports {
+		rl.listening[port] = true
+	}
+	if b, err := os.ReadFile(rl.Filename); err == nil {
+		rl.sum = sha256.Sum256(b)
+	}
+}
+
+// Reload reads the config file and replaces the handlers. The current
+// handlers are kept if there is an error.
+func (rl *Reloader) Reload() error {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	b, err := os.ReadFile(rl.Filename)
+	if err != nil {
+		return err
+	}
+	return rl.reload(b)
+}
+
+// reload replaces the handlers with ones made from the file contents b.
+// The lock must be held.
+func (rl *Reloader) reload(b []byte) error {
+	// remember the file even if it is bad, so Watch does not try it
+	// again until it changes
+	rl.sum = sha256.Sum256(b)
+	var config config
+	err := gcfg.ReadStringInto(&config, string(b))
+	if err != nil {
+		log.Println(err)
+		if err = gcfg.FatalOnly(err); err != nil {
+			return err
+		}
+	}
+	err = resolveSecrets(&config)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(config, rl.config) {
+		return nil
+	}
+	hs, err := rl.Build(config)
+	if err != nil {
+		return err
+	}
+	if len(hs.ports) == 0 {
+		return fmt.Errorf("no handlers are defined")
+	}
+	for port := range hs.ports {
+		if !rl.listening[port] {
+			log.Printf("Reload: port %s is not being listened on. Restart to use it", port)
+		}
+	}
+	rl.current.Store(hs)
+	rl.config = config
+	log.Printf("Reloaded %s", rl.Filename)
+	return nil
+}
+
+// OnSignal reloads the config file whenever the process receives sig,
+// e.g. SIGHUP. It does not return.
+func (rl *Reloader) OnSignal(sig os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	for range c {
+		if err := rl.Reload(); err != nil {
+			log.Println("Reload:", err)
+		}
+	}
+}
+
+// Watch reloads the config file whenever its contents change, checking
+// every interval. The contents are compared instead of the modification
+// time, since Kubernetes updates a ConfigMap by swapping a symlink to a
+// new directory. It does not return.
+func (rl *Reloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rl.check(); err != nil {
+			log.Println("Reload:", err)
+		}
+	}
+}
+
+// Refresh reloads the config file every interval, so that changed
+// secrets are used. It does not return.
+func (rl *Reloader) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rl.Reload(); err != nil {
+			log.Println("Refresh:", err)
+		}
+	}
+}
+
+// check reloads the config file if it has changed.
+func (rl *Reloader) check() error {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	b, err := os.ReadFile(rl.Filename)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(b) == rl.sum {
+		return nil
+	}
+	return rl.reload(b)
+}
+
+// Port returns the handler for requests on port.
+func (rl *Reloader) Port(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux, ok := rl.current.Load().ports[port]
+		if !ok {
+			// the port was removed from the config file
+			http.NotFound(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Dav returns the handler for the WebDAV listener.
+func (rl *Reloader) Dav() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.current.Load().davServer.ServeHTTP(w, r)
+	})
+}
+
+// Warm returns the handler for cache warming requests, using the given
+// number of workers.
+func (rl *Reloader) Warm(workers int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh := &download.WarmHandler{Handlers: rl.current.Load().downloads, Workers: workers}
+		wh.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ndlib/disadis/download"
+)
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "disadis.ini")
+	write := func(s string) {
+		if err := ioutil.WriteFile(fname, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each build serves the datastream name of the handler on 8000
+	var builds int
+	rl := &Reloader{
+		Filename: fname,
+		Build: func(config config) (*handlerSet, error) {
+			builds++
+			hs := &handlerSet{ports: make(map[string]*download.DsidMux)}
+			for _, v := range config.Handler {
+				ds := v.Datastream
+				hs.ports[v.Port] = &download.DsidMux{DefaultHandler: http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte(ds))
+					})}
+			}
+			return hs, nil
+		},
+	}
+	get := func() string {
+		w := httptest.NewRecorder()
+		rl.Port("8000").ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+
+	write("[handler \"a\"]\nport = 8000\ndatastream = content\n")
+	var cfg config
+	hs, _ := rl.Build(cfg)
+	rl.Start(hs, cfg)
+	if err := rl.check(); err != nil || builds != 1 {
+		t.Errorf("Expected no reload of unchanged file, got %d builds, %v", builds, err)
+	}
+
+	write("[handler \"a\"]\nport = 8000\ndatastream = thumbnail\n")
+	if err := rl.check(); err != nil {
+		t.Fatal(err)
+	}
+	if out := get(); out != "thumbnail" {
+		t.Errorf("Expected thumbnail, got %q", out)
+	}
+
+	// a bad file keeps the current handlers
+	write("[handler \"a\"\nport = 8000\n")
+	if err := rl.check(); err == nil {
+		t.Errorf("Expected error for bad config file")
+	}
+	if err := rl.check(); err != nil {
+		t.Errorf("Expected bad file to not be tried again, got %v", err)
+	}
+	if out := get(); out != "thumbnail" {
+		t.Errorf("Expected thumbnail, got %q", out)
+	}
+
+	write("[handler \"a\"]\nport = 8001\ndatastream = content\n")
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	rl.Port("8000").ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for removed port, got %d", w.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Secrets, such as the bendo token, may be kept out of the config file by
+// giving a reference instead of the value:
+//
+//	env:NAME            the environment variable NAME
+//	file:/path          the contents of a file, e.g. a Kubernetes secret
+//	vault:path#key      the field key of a secret in Vault
+//
+// Other values are used as they are.
+
+// A VaultClient reads secrets from the KV secrets engine of a HashiCorp
+// Vault server, or any server answering the same API. Paths are given
+// as in the HTTP API, so for version 2 of the engine they include "data/",
+// e.g. "secret/data/disadis".
+type VaultClient struct {
+	Addr   string // e.g. "https://vault.library.nd.edu:8200"
+	Token  string
+	Client *http.Client // nil means http.DefaultClient
+}
+
+// Get returns the field key of the secret at path.
+func (vc *VaultClient) Get(path, key string) (string, error) {
+	if vc == nil || vc.Addr == "" {
+		return "", fmt.Errorf("vault:%s: no vault address is configured", path)
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(vc.Addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vc.Token)
+	client := vc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("vault:%s: received status %d", path, resp.StatusCode)
+	}
+	var body struct {
+		Data map[string]json.RawMessage
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("vault:%s: %s", path, err)
+	}
+	fields := body.Data
+	// version 2 of the engine puts the secret inside another data object
+	var inner map[string]json.RawMessage
+	if _, ok := fields["metadata"]; ok && json.Unmarshal(fields["data"], &inner) == nil {
+		fields = inner
+	}
+	var value string
+	if err := json.Unmarshal(fields[key], &value); err != nil {
+		return "", fmt.Errorf("vault:%s: no string field %q", path, key)
+	}
+	return value, nil
+}
+
+// resolveSecret returns the value of a possible secret reference.
+func resolveSecret(value string, vault *VaultClient) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := value[len("env:"):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: environment variable not set", value)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		b, err := ioutil.ReadFile(value[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(value, "vault:"):
+		ref := value[len("vault:"):]
+		i := strings.LastIndex(ref, "#")
+		if i < 0 {
+			return "", fmt.Errorf("%s: expected vault:path#key", value)
+		}
+		return vault.Get(ref[:i], ref[i+1:])
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces the secret references in the config with their
+// values. The vault settings come from the general section, or from the
+// VAULT_ADDR and VAULT_TOKEN environment variables.
+func resolveSecrets(config *config) error {
+	vault := &VaultClient{
+		Addr:  config.General.Vault_addr,
+		Token: os.Getenv("VAULT_TOKEN"),
+	}
+	if vault.Addr == "" {
+		vault.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if config.General.Vault_token_file != "" {
+		b, err := ioutil.ReadFile(config.General.Vault_token_file)
+		if err != nil {
+			return err
+		}
+		vault.Token = strings.TrimSpace(string(b))
+	}
+	secrets := []*string{
+		&config.General.Fedora_addr,
+		&config.General.Bendo_token,
+	}
+	for i := range config.General.Fedora_replica {
+		secrets = append(secrets, &config.General.Fedora_replica[i])
+	}
+	for _, v := range config.Handler {
+		secrets = append(secrets, &v.Fedora_addr, &v.Bearer_introspect_token)
+	}
+	for _, v := range config.Store {
+		secrets = append(secrets, &v.Token, &v.Access_key, &v.Secret_key)
+	}
+	for _, p := range secrets {
+		v, err := resolveSecret(*p, vault)
+		if err != nil {
+			return err
+		}
+		*p = v
+	}
+	// only the token of each "user token" entry may be a reference
+	for _, v := range config.Handler {
+		for i, entry := range v.Bearer_token {
+			fields := strings.Fields(entry)
+			if len(fields) != 2 {
+				continue // reported when the handler is made
+			}
+			token, err := resolveSecret(fields[1], vault)
+			if err != nil {
+				return err
+			}
+			v.Bearer_token[i] = fields[0] + " " + token
+		}
+	}
+	return nil
+}
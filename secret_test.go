@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(403)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/disadis":
+			w.Write([]byte(`{"data":{"token":"kv1"}}`))
+		case "/v1/secret/data/disadis":
+			w.Write([]byte(`{"data":{"data":{"token":"kv2"},"metadata":{"version":3}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	vault := &VaultClient{Addr: ts.URL, Token: "root"}
+
+	f, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	os.Setenv("DISADIS_TEST_SECRET", "from-env")
+	defer os.Unsetenv("DISADIS_TEST_SECRET")
+
+	var table = []struct {
+		input, output string
+		ok            bool
+	}{
+		{"plain", "plain", true},
+		{"env:DISADIS_TEST_SECRET", "from-env", true},
+		{"env:DISADIS_TEST_MISSING", "", false},
+		{"file:" + f.Name(), "from-file", true},
+		{"vault:secret/disadis#token", "kv1", true},
+		{"vault:secret/data/disadis#token", "kv2", true},
+		{"vault:secret/data/disadis#other", "", false},
+		{"vault:secret/missing#token", "", false},
+		{"vault:secret/disadis", "", false},
+	}
+	for _, s := range table {
+		out, err := resolveSecret(s.input, vault)
+		if out != s.output || (err == nil) != s.ok {
+			t.Errorf("%s: expected %q (ok %v), got %q, %v", s.input, s.output, s.ok, out, err)
+		}
+	}
+}
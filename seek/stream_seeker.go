@@ -1,4 +1,6 @@
-package main
+// Package seek adapts streams which can only be read forward to the
+// io.ReadSeeker interface wanted by http.ServeContent.
+package seek
 
 import (
 	"errors"
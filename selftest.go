@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+)
+
+// selfTest requests the probe identifier of each handler having one,
+// through the same chain of handlers as real requests, and writes whether
+// each succeeded to out. This catches misconfigured routes, stores, and
+// credentials before any traffic arrives. HEAD requests are used, which
+// still fetch the content from fedora or the store, unless the handler
+// does not allow them, when a GET of the first byte is used instead.
+// Handlers with an auth setting pass if they refuse the anonymous probe,
+// since that shows the item was reached. It returns false if any probe
+// failed.
+func selfTest(config config, hs *handlerSet, out io.Writer) bool {
+	var names []string
+	for k, v := range config.Handler {
+		if v.Probe != "" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	ok := true
+	for _, k := range names {
+		v := config.Handler[k]
+		target := "/" + v.Probe
+		for _, dsid := range v.Datastream_id {
+			if dsid != "default" {
+				target += "?datastream_id=" + dsid
+				break
+			}
+		}
+		method := "HEAD"
+		if len(v.Method) > 0 && !hasMethod(v.Method, "HEAD") {
+			method = "GET"
+		}
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "127.0.0.1:0"
+		if method == "GET" {
+			r.Header.Set("Range", "bytes=0-0")
+		}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		hs.ports[v.Port].ServeHTTP(w, r)
+		result := "PASS"
+		switch {
+		case w.Code == http.StatusOK || w.Code == http.StatusPartialContent:
+		case v.Auth != "" && (w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden):
+		default:
+			result = "FAIL"
+			ok = false
+		}
+		fmt.Fprintf(out, "%s handler %s: %s %s on port %s: %d (%v)\n",
+			result, k, method, target, v.Port, w.Code, time.Since(start))
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(out, "No handlers have a probe to test")
+	}
+	return ok
+}
+
+// hasMethod returns true if methods includes method, ignoring case.
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
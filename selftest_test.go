@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	gcfg "gopkg.in/gcfg.v1"
+
+	"github.com/ndlib/disadis/fedora"
+)
+
+func TestSelfTest(t *testing.T) {
+	tf := fedora.NewTestFedora()
+	tf.Set("test:1", "content", fedora.DsInfo{}, []byte("hello"))
+	tf.Set("test:1", "thumbnail", fedora.DsInfo{}, []byte("thumb"))
+
+	var config config
+	err := gcfg.ReadStringInto(&config, `
+[handler "content"]
+port = 8000
+prefix = test:
+datastream = content
+probe = 1
+
+[handler "thumbnail"]
+port = 8000
+prefix = test:
+datastream = thumbnail
+datastream-id = thumbnail
+probe = 1
+
+[handler "getonly"]
+port = 8001
+prefix = test:
+datastream = content
+method = GET
+probe = 1
+
+[handler "restricted"]
+port = 8002
+prefix = test:
+datastream = content
+auth = hydra
+probe = 1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := makeHandlers(config, tf, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !selfTest(config, hs, &out) {
+		t.Errorf("Expected self test to pass, got\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "PASS handler thumbnail: HEAD /1?datastream_id=thumbnail") {
+		t.Errorf("Expected thumbnail to be probed, got\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "PASS handler getonly: GET /1 on port 8001: 206") {
+		t.Errorf("Expected a GET where HEAD is not allowed, got\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "PASS handler restricted: HEAD /1 on port 8002: 403") {
+		t.Errorf("Expected a refusal to count as reachable, got\n%s", out.String())
+	}
+
+	config.Handler["thumbnail"].Probe = "2"
+	out.Reset()
+	if selfTest(config, hs, &out) {
+		t.Errorf("Expected self test to fail, got\n%s", out.String())
+	}
+}
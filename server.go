@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ndlib/disadis/download"
+)
+
+// ServerConfig holds the settings common to every listener.
+type ServerConfig struct {
+	CertFile string // if set, serve TLS using this certificate
+	KeyFile  string // private key for CertFile
+	H2C      bool   // allow HTTP/2 without TLS ("h2c")
+
+	// Timeouts for slow clients. Zero means no limit.
+	ReadHeaderTimeout time.Duration // to read the request headers
+	ReadTimeout       time.Duration // to read the entire request
+	IdleTimeout       time.Duration // between requests on a connection
+
+	// WriteIdleTimeout is the longest a response may go without making
+	// progress. Downloads of large files may take a long time, so this
+	// is reset on every write, instead of limiting the whole response.
+	WriteIdleTimeout time.Duration
+}
+
+// newServer returns a server for the given port, with the timeouts in cfg.
+// HTTP/1 and HTTP/2 are enabled. HTTP/2 without TLS is only enabled if cfg.H2C is set, since it
+// is only useful behind a front end, such as nginx, which speaks it.
+func newServer(port string, h http.Handler, cfg ServerConfig) *http.Server {
+	if cfg.WriteIdleTimeout > 0 {
+		h = writeDeadline(h, cfg.WriteIdleTimeout)
+	}
+	s := &http.Server{
+		Addr:              ":" + port,
+		Handler:           h,
+		Protocols:         new(http.Protocols),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	s.Protocols.SetHTTP1(true)
+	s.Protocols.SetHTTP2(true)
+	s.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+	return s
+}
+
+// listen runs the server, using TLS if a certificate was given. It only
+// returns if the server fails.
+func listen(s *http.Server, cfg ServerConfig) {
+	var err error
+	if cfg.CertFile != "" {
+		err = s.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+	} else {
+		err = s.ListenAndServe()
+	}
+	log.Printf("Listener %s: %s", s.Addr, err)
+}
+
+// writeDeadline wraps h so that every write to the response must finish
+// within d of its start. Stalled clients are disconnected, while slow but
+// steady downloads may take as long as they need.
+func writeDeadline(h http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dw := &deadlineWriter{
+			ResponseWriter: w,
+			rc:             http.NewResponseController(w),
+			d:              d,
+		}
+		dw.extend()
+		h.ServeHTTP(dw, r)
+	})
+}
+
+// deadlineWriter extends the write deadline before each write.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+	d  time.Duration
+}
+
+func (dw *deadlineWriter) extend() {
+	// ignore ErrNotSupported from writers without deadlines
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.d))
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.extend()
+	return dw.ResponseWriter.Write(p)
+}
+
+// ReadFrom copies in chunks so the deadline is extended as the copy
+// progresses. This gives up sendfile(2) for cached files.
+func (dw *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	return download.CopyBuffer(writerOnly{dw}, src)
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.extend()
+	dw.rc.Flush()
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
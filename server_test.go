@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerH2C(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	var table = []struct {
+		h2c bool
+	}{
+		{false},
+		{true},
+	}
+	for _, s := range table {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := newServer("0", h, ServerConfig{H2C: s.h2c})
+		go server.Serve(l)
+
+		// a client which only speaks h2c
+		transport := &http.Transport{Protocols: new(http.Protocols)}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		switch {
+		case !s.h2c && err == nil:
+			resp.Body.Close()
+			t.Errorf("Expected h2c to be refused")
+		case s.h2c && err != nil:
+			t.Errorf("Expected h2c to be accepted, got %s", err)
+		case s.h2c && resp.ProtoMajor != 2:
+			resp.Body.Close()
+			t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+		case s.h2c:
+			resp.Body.Close()
+		}
+		server.Close()
+	}
+}
+
+func TestWriteIdleTimeout(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 1<<20)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a slow but steady download taking longer than the timeout
+		for i := 0; i < 4; i++ {
+			w.Write(chunk[:10])
+			time.Sleep(40 * time.Millisecond)
+		}
+		if r.URL.Path == "/big" {
+			for i := 0; i < 64; i++ {
+				w.Write(chunk)
+			}
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer("0", h, ServerConfig{WriteIdleTimeout: 100 * time.Millisecond})
+	go server.Serve(l)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 40 {
+		t.Errorf("Expected steady download to finish, got %d bytes, %v", len(body), err)
+	}
+
+	// a client which stops reading is disconnected
+	resp, err = http.Get("http://" + l.Addr().String() + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && len(body) == 40+64<<20 {
+		t.Errorf("Expected stalled download to be cut off")
+	}
+}
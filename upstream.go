@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// BackendConfig holds the connection settings for an upstream service such
+// as fedora or bendo. The zero value uses the default settings.
+type BackendConfig struct {
+	CertFile string // client certificate to present, PEM encoded
+	KeyFile  string // private key for CertFile, PEM encoded
+	CAFile   string // bundle of CAs to trust instead of the system roots
+	Proxy    string // URL of the proxy to use instead of the environment's
+
+	// ServerName is the name to send with SNI and to verify the server's
+	// certificate against, instead of the host in the request URL.
+	ServerName string
+
+	// InsecureSkipVerify turns off verification of the server's
+	// certificate. It is for development only.
+	InsecureSkipVerify bool
+}
+
+// NewBackendClient returns an http client for talking to a backend. Every
+// client is built from a clone of the shared default transport, so they
+// keep its timeout behavior, and unless an explicit proxy is given, use the
+// proxy named by the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment
+// variables.
+func NewBackendClient(cfg BackendConfig) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: t}, nil
+}
+
+// tlsConfig returns the TLS settings for the backend, or nil if there are
+// none.
+func (cfg BackendConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" &&
+		cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackendClientMutualTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.PeerCertificates) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	makeClientCert(t, certFile, keyFile)
+
+	// without the CA the server is not trusted
+	client, err := NewBackendClient(BackendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(ts.URL)
+	if err == nil {
+		t.Errorf("Expected certificate error")
+	}
+
+	// without a client certificate the handshake fails
+	client, err = NewBackendClient(BackendConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(ts.URL)
+	if err == nil {
+		t.Errorf("Expected handshake error")
+	}
+
+	client, err = NewBackendClient(BackendConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	// a bad CA file is an error
+	_, err = NewBackendClient(BackendConfig{CAFile: keyFile})
+	if err == nil {
+		t.Errorf("Expected error for CA file without certificates")
+	}
+}
+
+func TestBackendClientVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "disadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+
+	var sequence = []struct {
+		cfg BackendConfig
+		ok  bool
+	}{
+		{BackendConfig{CAFile: caFile}, true},
+		// the test certificate is for example.com
+		{BackendConfig{CAFile: caFile, ServerName: "example.com"}, true},
+		{BackendConfig{CAFile: caFile, ServerName: "fedora.example.edu"}, false},
+		{BackendConfig{InsecureSkipVerify: true}, true},
+	}
+	for _, s := range sequence {
+		client, err := NewBackendClient(s.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != s.ok {
+			t.Errorf("%+v: Expected success %v, got %v", s.cfg, s.ok, err)
+		}
+	}
+}
+
+func makeClientCert(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "disadis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyder)
+}
+
+func writePEM(t *testing.T, fname, kind string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	err := ioutil.WriteFile(fname, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendClientProxy(t *testing.T) {
+	var seen string
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seen = r.URL.String()
+		}))
+	defer proxy.Close()
+
+	client, err := NewBackendClient(BackendConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://fedora.invalid/fedora/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen != "http://fedora.invalid/fedora/objects" {
+		t.Errorf("Expected request through proxy, got %q", seen)
+	}
+}